@@ -0,0 +1,54 @@
+package main
+
+import (
+	"context"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/aws/credentials/stscreds"
+	"github.com/aws/aws-sdk-go/aws/session"
+	"github.com/aws/aws-sdk-go/service/sts"
+)
+
+// defaultAccountID labels the account of the base session, whose ID isn't
+// looked up, so no permission for sts:GetCallerIdentity is needed without
+// roles to assume
+const defaultAccountID = "default"
+
+// account is an AWS account the snapshotter operates on
+type account struct {
+	id   string
+	sess *session.Session
+}
+
+// newAccounts creates an account per role to assume on top of the base
+// session. Without any roles the account of the base session is used
+func newAccounts(ctx context.Context, base *session.Session, roles []string) ([]*account, error) {
+	if len(roles) == 0 {
+		return []*account{{id: defaultAccountID, sess: base}}, nil
+	}
+
+	var sessions []*session.Session
+	for _, role := range roles {
+		sessions = append(sessions, base.Copy(aws.NewConfig().WithCredentials(
+			stscreds.NewCredentials(base, role),
+		)))
+	}
+
+	var accounts []*account
+	for _, sess := range sessions {
+		out, err := sts.New(sess).GetCallerIdentityWithContext(ctx, &sts.GetCallerIdentityInput{})
+		if err != nil {
+			return nil, err
+		}
+		accounts = append(accounts, &account{
+			id:   aws.StringValue(out.Account),
+			sess: sess,
+		})
+	}
+	return accounts, nil
+}
+
+// session returns the session to use for the given region in this account
+func (a *account) session(region string) *session.Session {
+	return a.sess.Copy(aws.NewConfig().WithRegion(region))
+}
@@ -0,0 +1,99 @@
+package main
+
+import (
+	"fmt"
+	"io/ioutil"
+	"os"
+	"time"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/aws/credentials"
+	"github.com/aws/aws-sdk-go/aws/session"
+	"github.com/aws/aws-sdk-go/service/sts"
+)
+
+const (
+	webIdentityTokenFileEnv = "AWS_WEB_IDENTITY_TOKEN_FILE"
+	roleARNEnv              = "AWS_ROLE_ARN"
+	roleSessionNameEnv      = "AWS_ROLE_SESSION_NAME"
+
+	defaultRoleSessionName = "aws-auto-snapshot"
+)
+
+// webIdentityProvider retrieves credentials by assuming a role with a web
+// identity token, e.g. as provided to pods by EKS. The vendored SDK predates
+// the support for this in its default credential chain
+type webIdentityProvider struct {
+	credentials.Expiry
+
+	client          *sts.STS
+	tokenFile       string
+	roleARN         string
+	roleSessionName string
+}
+
+// Retrieve assumes the role using the current token from the token file
+func (p *webIdentityProvider) Retrieve() (credentials.Value, error) {
+	token, err := ioutil.ReadFile(p.tokenFile)
+	if err != nil {
+		return credentials.Value{}, fmt.Errorf("cannot read web identity token: %+v", err)
+	}
+
+	out, err := p.client.AssumeRoleWithWebIdentity(&sts.AssumeRoleWithWebIdentityInput{
+		RoleArn:          aws.String(p.roleARN),
+		RoleSessionName:  aws.String(p.roleSessionName),
+		WebIdentityToken: aws.String(string(token)),
+	})
+	if err != nil {
+		return credentials.Value{}, err
+	}
+
+	p.SetExpiration(*out.Credentials.Expiration, time.Minute)
+	return credentials.Value{
+		AccessKeyID:     *out.Credentials.AccessKeyId,
+		SecretAccessKey: *out.Credentials.SecretAccessKey,
+		SessionToken:    *out.Credentials.SessionToken,
+		ProviderName:    "WebIdentityProvider",
+	}, nil
+}
+
+// newSession creates the AWS session used by all clients. Static credentials
+// are used if given. Otherwise the credentials are taken from a web identity
+// token if configured via the environment, or else from the default
+// credential chain (environment, shared credentials file, instance metadata)
+func newSession(region, accessKeyID, secretAccessKey string) (*session.Session, error) {
+	if (accessKeyID == "") != (secretAccessKey == "") {
+		return nil, fmt.Errorf("need both AWS access key ID and secret access key")
+	}
+
+	sess, err := session.NewSessionWithOptions(session.Options{
+		Config:            *aws.NewConfig().WithRegion(region),
+		SharedConfigState: session.SharedConfigEnable,
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	switch {
+	case accessKeyID != "":
+		sess = sess.Copy(aws.NewConfig().WithCredentials(
+			credentials.NewStaticCredentials(accessKeyID, secretAccessKey, ""),
+		))
+	case os.Getenv(webIdentityTokenFileEnv) != "" && os.Getenv(roleARNEnv) != "":
+		sessionName := os.Getenv(roleSessionNameEnv)
+		if sessionName == "" {
+			sessionName = defaultRoleSessionName
+		}
+		sess = sess.Copy(aws.NewConfig().WithCredentials(
+			credentials.NewCredentials(&webIdentityProvider{
+				client: sts.New(sess, aws.NewConfig().
+					WithCredentials(credentials.AnonymousCredentials)),
+				tokenFile:       os.Getenv(webIdentityTokenFileEnv),
+				roleARN:         os.Getenv(roleARNEnv),
+				roleSessionName: sessionName,
+			}),
+		))
+	}
+
+	return sess, nil
+}
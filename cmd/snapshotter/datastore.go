@@ -0,0 +1,35 @@
+package main
+
+import (
+	"fmt"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/aws/session"
+
+	"github.com/grid-x/aws-auto-snapshot/pkg/datastore"
+	// Register the datastore backends
+	_ "github.com/grid-x/aws-auto-snapshot/pkg/datastore/dynamodb"
+	_ "github.com/grid-x/aws-auto-snapshot/pkg/datastore/file"
+	_ "github.com/grid-x/aws-auto-snapshot/pkg/datastore/s3"
+)
+
+// hasDatastore reports whether a datastore is configured by either a URL or
+// the deprecated DynamoDB table flags and settings
+func hasDatastore(dsURL, dynamodbTable string) bool {
+	return dsURL != "" || dynamodbTable != ""
+}
+
+// openDatastore opens the datastore given by a URL such as dynamodb://table,
+// s3://bucket/prefix or file:///path/to/file or, if no URL is given, the
+// given DynamoDB table. The clients are created from the session and configs
+func openDatastore(sess *session.Session, dsURL, dynamodbTable string,
+	cfgs ...*aws.Config) (datastore.Datastore, error) {
+
+	if !hasDatastore(dsURL, dynamodbTable) {
+		return nil, fmt.Errorf("need a datastore, e.g. --datastore dynamodb://<table>")
+	}
+	if dsURL == "" {
+		dsURL = "dynamodb://" + dynamodbTable
+	}
+	return datastore.Open(dsURL, sess, cfgs...)
+}
@@ -0,0 +1,329 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"os"
+	"text/tabwriter"
+	"time"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/aws/session"
+	awsec2 "github.com/aws/aws-sdk-go/service/ec2"
+	"github.com/aws/aws-sdk-go/service/lightsail"
+	awsrds "github.com/aws/aws-sdk-go/service/rds"
+	"github.com/aws/aws-sdk-go/service/ssm"
+	"github.com/prometheus/client_golang/prometheus"
+	log "github.com/sirupsen/logrus"
+
+	"github.com/grid-x/aws-auto-snapshot/pkg/config"
+	"github.com/grid-x/aws-auto-snapshot/pkg/datastore"
+	"github.com/grid-x/aws-auto-snapshot/pkg/snapshot"
+	"github.com/grid-x/aws-auto-snapshot/pkg/snapshot/ec2"
+	snaplightsail "github.com/grid-x/aws-auto-snapshot/pkg/snapshot/lightsail"
+	"github.com/grid-x/aws-auto-snapshot/pkg/snapshot/rds"
+)
+
+var (
+	jobRuns = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Name: "aws_auto_snapshot_job_runs_total",
+		Help: "Total number of job runs by result",
+	}, []string{"job", "account", "region", "result"})
+	jobDuration = prometheus.NewGaugeVec(prometheus.GaugeOpts{
+		Name: "aws_auto_snapshot_job_last_duration_seconds",
+		Help: "The duration of the last run of a job",
+	}, []string{"job", "account", "region"})
+	jobLastSuccess = prometheus.NewGaugeVec(prometheus.GaugeOpts{
+		Name: "aws_auto_snapshot_job_last_success_timestamp_seconds",
+		Help: "The timestamp of the last run of a job without errors",
+	}, []string{"job", "account", "region"})
+)
+
+func init() {
+	prometheus.MustRegister(jobRuns)
+	prometheus.MustRegister(jobDuration)
+	prometheus.MustRegister(jobLastSuccess)
+}
+
+// jobSummary summarizes the outcome of running a single job
+type jobSummary struct {
+	Job            string        `json:"job"`
+	Type           string        `json:"type"`
+	Account        string        `json:"account"`
+	Region         string        `json:"region"`
+	Snapshotters   int           `json:"snapshotters"`
+	SnapshotErrors int           `json:"snapshotErrors"`
+	PruneErrors    int           `json:"pruneErrors"`
+	Duration       time.Duration `json:"duration"`
+	Error          string        `json:"error,omitempty"`
+
+	// Plan holds the actions of a dry run
+	Plan []snapshot.Action `json:"plan,omitempty"`
+}
+
+func (s *jobSummary) failed() bool {
+	return s.Error != "" || s.SnapshotErrors > 0 || s.PruneErrors > 0
+}
+
+// jobSnapshotters creates the Snapshotters for the resources of the given job.
+// If a plan is given, the Snapshotters only add their actions to it
+func jobSnapshotters(ctx context.Context, logger log.FieldLogger,
+	sess *session.Session, job *config.Job, plan *snapshot.Plan) ([]Snapshotter, error) {
+
+	switch job.Type {
+	case config.JobTypeLightsail, config.JobTypeLightsailDisk:
+		opts := []snaplightsail.Opt{
+			snaplightsail.WithRetention(job.Retention),
+			snaplightsail.WithMinKeep(job.MinKeep),
+			snaplightsail.WithLogger(logger),
+		}
+		if plan != nil {
+			opts = append(opts, snaplightsail.WithDryRun(plan))
+		}
+		if job.RetentionPolicy != "" {
+			policy, err := snapshot.ParseRetentionPolicy(job.RetentionPolicy)
+			if err != nil {
+				return nil, err
+			}
+			opts = append(opts, snaplightsail.WithRetentionPolicy(policy))
+		}
+		// Dry runs never write to the datastore, hence don't need one
+		if plan == nil && hasDatastore(job.Datastore, job.DynamoDBTable) {
+			ds, err := openDatastore(sess, job.Datastore, job.DynamoDBTable)
+			if err != nil {
+				return nil, err
+			}
+			opts = append(opts, snaplightsail.WithDatastore(ds))
+		}
+		if job.Type == config.JobTypeLightsailDisk {
+			return lightsailDiskSnapshotter(ctx, lightsail.New(sess), opts...)
+		}
+		return lightsailSnapshotter(ctx, lightsail.New(sess), opts...)
+	case config.JobTypeEBS:
+		// Dry runs and jobs that only prune, e.g. in a vault account,
+		// don't need a datastore
+		var ds datastore.Datastore
+		if plan == nil && (!job.DisableSnapshot || hasDatastore(job.Datastore, job.DynamoDBTable)) {
+			var err error
+			if ds, err = openDatastore(sess, job.Datastore, job.DynamoDBTable); err != nil {
+				return nil, err
+			}
+		}
+		opts := []ec2.Opt{
+			ec2.WithRetentionTag(job.RetentionTag),
+			ec2.WithRetentionPolicyTag(job.RetentionPolicyTag),
+			ec2.WithMinKeep(job.MinKeep),
+			ec2.WithMinKeepTag(job.MinKeepTag),
+			ec2.WithBackupTag(job.BackupTag),
+			ec2.WithLogger(logger),
+		}
+		if plan != nil {
+			opts = append(opts, ec2.WithDryRun(plan))
+		}
+		if job.CopyRegion != "" {
+			if job.CopyRegion == job.Region {
+				return nil, fmt.Errorf("copy region must differ from region %s", job.Region)
+			}
+			opts = append(opts,
+				ec2.WithCopyTo(awsec2.New(sess.Copy(aws.NewConfig().WithRegion(job.CopyRegion)))),
+				ec2.WithCopyKMSKeyID(job.CopyKMSKeyID),
+				ec2.WithCopyRetentionDays(job.CopyRetentionDays),
+			)
+		}
+		if job.GroupByInstance {
+			opts = append(opts, ec2.WithInstanceGroups())
+		}
+		if job.PreSnapshotCommand != "" || job.PostSnapshotCommand != "" {
+			opts = append(opts,
+				ec2.WithHooks(ssm.New(sess), job.PreSnapshotCommand, job.PostSnapshotCommand),
+				ec2.WithHookTag(job.HookTag),
+				ec2.WithHookTimeout(job.HookTimeout),
+			)
+		}
+		if job.VaultRole != "" {
+			vaults, err := newAccounts(ctx, sess, []string{job.VaultRole})
+			if err != nil {
+				return nil, fmt.Errorf("cannot determine vault account: %+v", err)
+			}
+			opts = append(opts,
+				ec2.WithVault(vaults[0].id, awsec2.New(vaults[0].session(job.Region))),
+				ec2.WithVaultKMSKeyID(job.VaultKMSKeyID),
+				ec2.WithVaultRetentionDays(job.VaultRetentionDays),
+			)
+		}
+		return []Snapshotter{
+			ec2.NewSnapshotManager(awsec2.New(sess), ds, opts...),
+		}, nil
+	case config.JobTypeRDS:
+		if plan != nil {
+			return nil, fmt.Errorf("dry run is not supported by %s jobs", job.Type)
+		}
+		ds, err := openDatastore(sess, job.Datastore, job.DynamoDBTable)
+		if err != nil {
+			return nil, err
+		}
+		return []Snapshotter{
+			rds.NewSnapshotManager(
+				awsrds.New(sess),
+				ds,
+				rds.WithRetentionTag(job.RetentionTag),
+				rds.WithBackupTag(job.BackupTag),
+				rds.WithLogger(logger),
+			),
+		}, nil
+	case config.JobTypeRDSCluster:
+		if plan != nil {
+			return nil, fmt.Errorf("dry run is not supported by %s jobs", job.Type)
+		}
+		ds, err := openDatastore(sess, job.Datastore, job.DynamoDBTable)
+		if err != nil {
+			return nil, err
+		}
+		return []Snapshotter{
+			rds.NewClusterSnapshotManager(
+				awsrds.New(sess),
+				ds,
+				rds.WithRetentionTag(job.RetentionTag),
+				rds.WithBackupTag(job.BackupTag),
+				rds.WithLogger(logger),
+			),
+		}, nil
+	}
+	return nil, fmt.Errorf("unknown job type %q", job.Type)
+}
+
+// runJob creates the Snapshotters of the given job in the given account and
+// runs snapshot and prune on each of them as configured
+func runJob(ctx context.Context, logger log.FieldLogger,
+	acct *account, job *config.Job) *jobSummary {
+
+	summary := doRunJob(ctx, logger, acct, job)
+	if job.DryRun {
+		return summary
+	}
+
+	jobDuration.WithLabelValues(job.Name, acct.id, job.Region).Set(summary.Duration.Seconds())
+	if summary.failed() {
+		jobRuns.WithLabelValues(job.Name, acct.id, job.Region, "failure").Inc()
+	} else {
+		jobRuns.WithLabelValues(job.Name, acct.id, job.Region, "success").Inc()
+		jobLastSuccess.WithLabelValues(job.Name, acct.id, job.Region).SetToCurrentTime()
+	}
+	return summary
+}
+
+func doRunJob(ctx context.Context, logger log.FieldLogger,
+	acct *account, job *config.Job) *jobSummary {
+
+	start := time.Now()
+	summary := &jobSummary{
+		Job:     job.Name,
+		Type:    string(job.Type),
+		Account: acct.id,
+		Region:  job.Region,
+	}
+	logger = logger.WithFields(log.Fields{
+		"job":     job.Name,
+		"account": acct.id,
+		"region":  job.Region,
+	})
+
+	var plan *snapshot.Plan
+	if job.DryRun {
+		plan = &snapshot.Plan{}
+		defer func() {
+			summary.Plan = plan.Actions()
+		}()
+	}
+
+	snaps, err := jobSnapshotters(ctx, logger, acct.session(job.Region), job, plan)
+	if err != nil {
+		logger.Error(err)
+		summary.Error = err.Error()
+		summary.Duration = time.Since(start)
+		return summary
+	}
+	summary.Snapshotters = len(snaps)
+
+	for _, s := range snaps {
+		if !job.DisableSnapshot {
+			logger.Infof("Trying to snapshot")
+			if err := s.Snapshot(ctx); err != nil {
+				logger.Error(err)
+				summary.SnapshotErrors++
+			}
+		}
+		if !job.DisablePrune {
+			logger.Infof("Trying to Prune")
+			if err := s.Prune(ctx); err != nil {
+				logger.Error(err)
+				summary.PruneErrors++
+			}
+		}
+	}
+
+	summary.Duration = time.Since(start)
+	return summary
+}
+
+// runJobs runs every given job in every given account
+func runJobs(ctx context.Context, logger log.FieldLogger,
+	accounts []*account, jobs []*config.Job) []*jobSummary {
+
+	var summaries []*jobSummary
+	for _, job := range jobs {
+		for _, acct := range accounts {
+			summary := runJob(ctx, logger, acct, job)
+			if summary.failed() {
+				logger.Errorf("job %s finished with errors in account %s", job.Name, acct.id)
+			}
+			summaries = append(summaries, summary)
+		}
+	}
+	return summaries
+}
+
+// printPlans prints the actions planned by the dry runs of the given jobs in
+// the requested output format
+func printPlans(output string, summaries []*jobSummary) error {
+	switch output {
+	case "json":
+		return json.NewEncoder(os.Stdout).Encode(summaries)
+	default:
+		w := tabwriter.NewWriter(os.Stdout, 0, 8, 2, ' ', 0)
+		fmt.Fprintln(w, "JOB\tACCOUNT\tREGION\tACTION\tRESOURCE\tSNAPSHOT\tREASON")
+		for _, s := range summaries {
+			if s.Error != "" {
+				fmt.Fprintf(w, "%s\t%s\t%s\t%s\t\t\t%s\n",
+					s.Job, s.Account, s.Region, "error", s.Error)
+			}
+			for _, a := range s.Plan {
+				fmt.Fprintf(w, "%s\t%s\t%s\t%s\t%s\t%s\t%s\n",
+					s.Job, s.Account, s.Region,
+					a.Action, a.Resource, a.Snapshot, a.Reason,
+				)
+			}
+		}
+		return w.Flush()
+	}
+}
+
+// printSummaries prints the given job summaries in the requested output format
+func printSummaries(output string, summaries []*jobSummary) error {
+	switch output {
+	case "json":
+		return json.NewEncoder(os.Stdout).Encode(summaries)
+	default:
+		w := tabwriter.NewWriter(os.Stdout, 0, 8, 2, ' ', 0)
+		fmt.Fprintln(w, "JOB\tTYPE\tACCOUNT\tREGION\tSNAPSHOTTERS\tSNAPSHOT ERRORS\tPRUNE ERRORS\tDURATION\tERROR")
+		for _, s := range summaries {
+			fmt.Fprintf(w, "%s\t%s\t%s\t%s\t%d\t%d\t%d\t%s\t%s\n",
+				s.Job, s.Type, s.Account, s.Region, s.Snapshotters,
+				s.SnapshotErrors, s.PruneErrors,
+				s.Duration.Truncate(time.Millisecond), s.Error,
+			)
+		}
+		return w.Flush()
+	}
+}
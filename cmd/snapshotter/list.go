@@ -0,0 +1,171 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"os"
+	"text/tabwriter"
+	"time"
+
+	"github.com/aws/aws-sdk-go/aws/session"
+	log "github.com/sirupsen/logrus"
+
+	"github.com/grid-x/aws-auto-snapshot/pkg/datastore"
+	"github.com/grid-x/aws-auto-snapshot/pkg/snapshot"
+)
+
+// stateMissing is the state of snapshots that are recorded in the datastore
+// but don't exist anymore
+const stateMissing = "missing"
+
+// listEntry is a managed snapshot in a given account and region
+type listEntry struct {
+	Account string `json:"account"`
+	Region  string `json:"region"`
+	snapshot.Description
+	// Recorded is true if the snapshot is recorded in the datastore
+	Recorded bool `json:"recorded"`
+}
+
+// lister returns the managed snapshots using the given session and,
+// optionally, the datastore their infos are recorded in
+type lister func(ctx context.Context, sess *session.Session) ([]snapshot.Description, datastore.Datastore, error)
+
+// location holds the entries listed in a given account and region and the
+// datastore their infos are recorded in, if any
+type location struct {
+	account string
+	region  string
+	entries []*listEntry
+	ds      datastore.Datastore
+}
+
+// listSnapshots lists the managed snapshots in all given accounts and regions,
+// optionally only those of the given resource
+func listSnapshots(ctx context.Context, logger log.FieldLogger,
+	accounts []*account, regions []string, resource string, list lister) ([]*listEntry, error) {
+
+	var locations []*location
+	// home is the first location with snapshots of a resource that are not
+	// copies, which is where the resource's snapshots are recorded from
+	home := make(map[string]*location)
+	for _, acct := range accounts {
+		for _, region := range regions {
+			descs, ds, err := list(ctx, acct.session(region))
+			if err != nil {
+				return nil, fmt.Errorf("cannot list snapshots in account %s, region %s: %+v",
+					acct.id, region, err)
+			}
+			loc := &location{account: acct.id, region: region, ds: ds}
+			for _, d := range descs {
+				loc.entries = append(loc.entries, &listEntry{
+					Account:     acct.id,
+					Region:      region,
+					Description: d,
+				})
+				if d.SourceSnapshotID == "" && home[d.Resource] == nil {
+					home[d.Resource] = loc
+				}
+			}
+			locations = append(locations, loc)
+		}
+	}
+	// The recorded snapshots of a resource without any snapshots left are
+	// listed in the first location with a datastore
+	if resource != "" && home[resource] == nil {
+		for _, loc := range locations {
+			if loc.ds != nil {
+				home[resource] = loc
+				break
+			}
+		}
+	}
+
+	var result []*listEntry
+	for _, loc := range locations {
+		if loc.ds != nil {
+			loc.entries = mergeRecorded(ctx, logger, loc, home, resource)
+		}
+		result = append(result, loc.entries...)
+	}
+	return result, nil
+}
+
+// mergeRecorded marks the entries of the location recorded in the datastore
+// and adds the recorded snapshots that don't exist anymore of the resources,
+// including the given one, whose home is the location. Copies are skipped as
+// only their sources are recorded.
+func mergeRecorded(ctx context.Context, logger log.FieldLogger, loc *location,
+	home map[string]*location, resource string) []*listEntry {
+
+	byID := make(map[string]*listEntry, len(loc.entries))
+	seen := make(map[string]bool)
+	var resources []string
+	if resource != "" && home[resource] == loc {
+		seen[resource] = true
+		resources = append(resources, resource)
+	}
+	for _, e := range loc.entries {
+		if e.SourceSnapshotID != "" {
+			continue
+		}
+		byID[e.ID] = e
+		if !seen[e.Resource] && home[e.Resource] == loc {
+			seen[e.Resource] = true
+			resources = append(resources, e.Resource)
+		}
+	}
+
+	var missing []*listEntry
+	for _, r := range resources {
+		infos, err := loc.ds.ListSnapshotInfos(ctx, datastore.SnapshotResource(r), time.Time{}, time.Now())
+		if err != nil {
+			logger.Errorf("cannot list snapshot infos of resource %s: %+v", r, err)
+			continue
+		}
+		for _, info := range infos {
+			if e := byID[string(info.ID)]; e != nil {
+				e.Recorded = true
+				continue
+			}
+			missing = append(missing, &listEntry{
+				Account: loc.account,
+				Region:  loc.region,
+				Description: snapshot.Description{
+					ID:        string(info.ID),
+					Resource:  string(info.Resource),
+					CreatedAt: info.CreatedAt,
+					State:     stateMissing,
+				},
+				Recorded: true,
+			})
+		}
+	}
+	return append(loc.entries, missing...)
+}
+
+func printListing(output string, entries []*listEntry) error {
+	switch output {
+	case "json":
+		if entries == nil {
+			entries = []*listEntry{}
+		}
+		return json.NewEncoder(os.Stdout).Encode(entries)
+	default:
+		w := tabwriter.NewWriter(os.Stdout, 0, 8, 2, ' ', 0)
+		fmt.Fprintln(w, "ACCOUNT\tREGION\tID\tRESOURCE\tCREATED AT\tDELETE AFTER\tSTATE\tSIZE\tRECORDED")
+		for _, e := range entries {
+			deleteAfter := e.RetentionPolicy
+			if e.DeleteAfter != nil {
+				deleteAfter = e.DeleteAfter.Format(time.RFC3339)
+			}
+			fmt.Fprintf(w, "%s\t%s\t%s\t%s\t%s\t%s\t%s\t%dGiB\t%t\n",
+				e.Account, e.Region, e.ID, e.Resource,
+				e.CreatedAt.Format(time.RFC3339), deleteAfter,
+				e.State, e.SizeGiB, e.Recorded,
+			)
+		}
+		return w.Flush()
+	}
+}
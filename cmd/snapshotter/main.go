@@ -3,15 +3,16 @@ package main
 import (
 	"context"
 	"fmt"
+	"net/http"
 	"os"
+	"os/signal"
 	"strings"
+	"syscall"
 	"time"
 
 	"github.com/aws/aws-sdk-go/aws"
-	"github.com/aws/aws-sdk-go/aws/credentials"
 	"github.com/aws/aws-sdk-go/aws/credentials/stscreds"
 	"github.com/aws/aws-sdk-go/aws/session"
-	awsdynamodb "github.com/aws/aws-sdk-go/service/dynamodb"
 	awsec2 "github.com/aws/aws-sdk-go/service/ec2"
 	"github.com/aws/aws-sdk-go/service/lightsail"
 	"github.com/prometheus/client_golang/prometheus"
@@ -19,8 +20,9 @@ import (
 	log "github.com/sirupsen/logrus"
 	"gopkg.in/alecthomas/kingpin.v2"
 
+	"github.com/grid-x/aws-auto-snapshot/pkg/config"
 	"github.com/grid-x/aws-auto-snapshot/pkg/datastore"
-	"github.com/grid-x/aws-auto-snapshot/pkg/datastore/dynamodb"
+	"github.com/grid-x/aws-auto-snapshot/pkg/snapshot"
 	"github.com/grid-x/aws-auto-snapshot/pkg/snapshot/ec2"
 	snaplightsail "github.com/grid-x/aws-auto-snapshot/pkg/snapshot/lightsail"
 )
@@ -40,9 +42,8 @@ type Snapshotter interface {
 	Prune(context.Context) error
 }
 
-func lightsailSnapshotter(ctx context.Context, logger log.FieldLogger,
-	client *lightsail.Lightsail,
-	retention time.Duration) ([]Snapshotter, error) {
+func lightsailSnapshotter(ctx context.Context, client *lightsail.Lightsail,
+	opts ...snaplightsail.Opt) ([]Snapshotter, error) {
 	var result []Snapshotter
 	var token *string
 	for {
@@ -60,7 +61,7 @@ func lightsailSnapshotter(ctx context.Context, logger log.FieldLogger,
 				//skip
 				continue
 			}
-			result = append(result, snaplightsail.NewSnapshotManager(client, *instance.Name, snaplightsail.WithRetention(retention)))
+			result = append(result, snaplightsail.NewSnapshotManager(client, *instance.Name, opts...))
 		}
 
 		if resp.NextPageToken == nil {
@@ -72,35 +73,140 @@ func lightsailSnapshotter(ctx context.Context, logger log.FieldLogger,
 	return result, nil
 }
 
+func lightsailDiskSnapshotter(ctx context.Context, client *lightsail.Lightsail,
+	opts ...snaplightsail.Opt) ([]Snapshotter, error) {
+	var result []Snapshotter
+	var token *string
+	for {
+		in := &lightsail.GetDisksInput{}
+		if token != nil {
+			in.PageToken = token
+		}
+
+		resp, err := client.GetDisksWithContext(ctx, in)
+		if err != nil {
+			return nil, err
+		}
+		for _, disk := range resp.Disks {
+			if disk.Name == nil {
+				//skip
+				continue
+			}
+			result = append(result, snaplightsail.NewDiskSnapshotManager(client, *disk.Name, opts...))
+		}
+
+		if resp.NextPageToken == nil {
+			break
+		}
+		token = resp.NextPageToken
+	}
+
+	return result, nil
+}
+
+// printListOrDie lists the managed snapshots and prints them in the requested
+// output format
+func printListOrDie(ctx context.Context, logger log.FieldLogger, output string,
+	accounts []*account, regions []string, resource string, list lister) {
+
+	entries, err := listSnapshots(ctx, logger, accounts, regions, resource, list)
+	if err != nil {
+		logger.Fatal(err)
+	}
+	if err := printListing(output, entries); err != nil {
+		logger.Error(err)
+	}
+}
+
 func main() {
 
 	var (
 		logger             = log.New()
 		output             = kingpin.Flag("output", "Output format").Short('o').Default("").String()
-		region             = kingpin.Flag("region", "AWS region to use").Default("eu-central-1").String()
+		regions            = kingpin.Flag("region", "AWS region to use, can be repeated to operate on multiple regions").Default("eu-central-1").Strings()
 		pushgatewayURL     = kingpin.Flag("pushgateway-url", "URL of Prometheus' pushgateway").String()
-		awsAccessKeyID     = kingpin.Flag("aws-access-key-id", "AWS Access Key ID to use").Required().String()
-		awsSecretAccessKey = kingpin.Flag("aws-secret-access-key", "AWS Secret Access Key to use").Required().String()
+		awsAccessKeyID     = kingpin.Flag("aws-access-key-id", "AWS Access Key ID to use (default: the AWS default credential chain)").String()
+		awsSecretAccessKey = kingpin.Flag("aws-secret-access-key", "AWS Secret Access Key to use (default: the AWS default credential chain)").String()
+		assumeRoles        = kingpin.Flag("assume-role", "ARN of a role to assume for all AWS clients, can be repeated to operate on multiple accounts").Strings()
+		datastoreURL       = kingpin.Flag("datastore", "URL of the datastore for snapshot metadata, e.g. dynamodb://Snapshots?role=<role ARN>&region=<region>, s3://bucket/prefix or file:///var/lib/snapshotter/meta.db").String()
+		dryRun             = kingpin.Flag("dry-run", "Only print the snapshots that would be created and deleted, without creating or deleting any").Default("false").Bool()
 
 		snapshotCmd     = kingpin.Command("snapshot", "Snapshot a resource")
 		disablePrune    = snapshotCmd.Flag("disable-prune", "Disable pruning of old snapshots").Default("false").Bool()
 		disableSnapshot = snapshotCmd.Flag("disable-snapshot", "Disable snapshot").Default("false").Bool()
+		minKeep         = snapshotCmd.Flag("min-keep", "Number of newest successful snapshots of each resource that are never pruned").Default("0").Int()
+
+		lightsailCmd    = snapshotCmd.Command("lightsail", "Run snapshotter for lightsail")
+		retention       = lightsailCmd.Flag("retention", "Retention duration").Default("240h").Duration()
+		retentionPolicy = lightsailCmd.Flag("retention-policy", "Grandfather-father-son retention policy replacing the retention duration, e.g. 7d,4w,12m").String()
+
+		lightsailDiskCmd             = snapshotCmd.Command("lightsail-disk", "Run snapshotter for lightsail block storage disks")
+		lightsailDiskRetention       = lightsailDiskCmd.Flag("retention", "Retention duration").Default("240h").Duration()
+		lightsailDiskRetentionPolicy = lightsailDiskCmd.Flag("retention-policy", "Grandfather-father-son retention policy replacing the retention duration, e.g. 7d,4w,12m").String()
+
+		ebsCmd                = snapshotCmd.Command("ebs", "Run snapshotter for EBS")
+		ebsBackupTag          = ebsCmd.Flag("ebs-backup-tag", "EBS tag that needs to be set for this EBS volume to be backed up").Default("backup").String()
+		ebsRetentionTag       = ebsCmd.Flag("ebs-retention-tag", "EBS tag that indicates the number of retention days").Default("retention").String()
+		ebsRetentionPolicyTag = ebsCmd.Flag("ebs-retention-policy-tag", "EBS tag that holds a grandfather-father-son retention policy replacing the retention days, e.g. 7d,4w,12m").Default("retention-policy").String()
+		ebsMinKeepTag         = ebsCmd.Flag("ebs-min-keep-tag", "EBS tag that overrides --min-keep for this EBS volume").Default("min-keep").String()
+		ebsDynamodbTable      = ebsCmd.Flag("dynamodb-table", "Deprecated: DynamoDB table to use for metadata storage, use --datastore dynamodb://<table>").String()
+		ebsCopyRegion         = ebsCmd.Flag("copy-region", "Region to copy new snapshots to, e.g. for disaster recovery").String()
+		ebsCopyKMSKeyID       = ebsCmd.Flag("copy-kms-key-id", "ARN of the KMS key to encrypt the copies with (requires copy-region)").String()
+		ebsCopyRetention      = ebsCmd.Flag("copy-retention-days", "Number of days to keep the copies (default: the retention of the source snapshot)").Int64()
+		ebsVaultRole          = ebsCmd.Flag("vault-role", "ARN of a role in a vault account to share new snapshots with and copy them to").String()
+		ebsVaultKMSKeyID      = ebsCmd.Flag("vault-kms-key-id", "ARN of the KMS key of the vault account to encrypt the vault copies with (requires vault-role)").String()
+		ebsVaultRetention     = ebsCmd.Flag("vault-retention-days", "Number of days to keep the vault copies (default: the retention of the source snapshot)").Int64()
+		ebsGroupByInstance    = ebsCmd.Flag("group-by-instance", "Select instances instead of volumes by the backup tag and snapshot all EBS volumes of an instance as one group").Default("false").Bool()
+		ebsHookTag            = ebsCmd.Flag("ebs-hook-tag", "EBS tag that needs to be set for the snapshot hooks to run for this EBS volume").Default("snapshot-hook").String()
+		ebsPreSnapshotCommand = ebsCmd.Flag("pre-snapshot-command", "Shell command to run via SSM on the instance of a volume with the hook tag before snapshotting it, e.g. fsfreeze -f /data").String()
+		ebsPostSnapshotCmd    = ebsCmd.Flag("post-snapshot-command", "Shell command to run via SSM on the instance of a volume with the hook tag after snapshotting it, e.g. fsfreeze -u /data").String()
+		ebsHookTimeout        = ebsCmd.Flag("hook-timeout", "How long each snapshot hook may run").Default("5m").Duration()
+
+		rdsCmd           = snapshotCmd.Command("rds", "Run snapshotter for RDS DB instances")
+		rdsBackupTag     = rdsCmd.Flag("rds-backup-tag", "RDS tag that needs to be set for this DB instance to be backed up").Default("backup").String()
+		rdsRetentionTag  = rdsCmd.Flag("rds-retention-tag", "RDS tag that indicates the number of retention days").Default("retention").String()
+		rdsDynamodbTable = rdsCmd.Flag("dynamodb-table", "Deprecated: DynamoDB table to use for metadata storage, use --datastore dynamodb://<table>").String()
+
+		rdsClusterCmd           = snapshotCmd.Command("rds-cluster", "Run snapshotter for RDS DB clusters")
+		rdsClusterBackupTag     = rdsClusterCmd.Flag("rds-backup-tag", "RDS tag that needs to be set for this DB cluster to be backed up").Default("backup").String()
+		rdsClusterRetentionTag  = rdsClusterCmd.Flag("rds-retention-tag", "RDS tag that indicates the number of retention days").Default("retention").String()
+		rdsClusterDynamodbTable = rdsClusterCmd.Flag("dynamodb-table", "Deprecated: DynamoDB table to use for metadata storage, use --datastore dynamodb://<table>").String()
 
-		lightsailCmd = snapshotCmd.Command("lightsail", "Run snapshotter for lightsail")
-		retention    = lightsailCmd.Flag("retention", "Retention duration").Default("240h").Duration()
+		runCmd    = kingpin.Command("run", "Run the snapshot jobs given in a config file")
+		runConfig = runCmd.Flag("config", "Path to the YAML config file describing the jobs").Required().ExistingFile()
 
-		ebsCmd           = snapshotCmd.Command("ebs", "Run snapshotter for EBS")
-		ebsBackupTag     = ebsCmd.Flag("ebs-backup-tag", "EBS tag that needs to be set for this EBS volume to be backed up").Default("backup").String()
-		ebsRetentionTag  = ebsCmd.Flag("ebs-retention-tag", "EBS tag that indicates the number of retention days").Default("retention").String()
-		ebsDynamodbTable = ebsCmd.Flag("dynamodb-table", "DynamoDB table to use for metadata storage").Required().String()
+		serveCmd           = kingpin.Command("serve", "Run the snapshot jobs given in a config file on their schedules")
+		serveConfig        = serveCmd.Flag("config", "Path to the YAML config file describing the jobs").Required().ExistingFile()
+		serveListenAddress = serveCmd.Flag("listen-address", "Address to serve metrics and health checks on").Default(":8080").String()
+
+		listCmd = kingpin.Command("list", "List the snapshots managed by this tool")
+
+		listEBSCmd                = listCmd.Command("ebs", "List EBS snapshots")
+		listEBSResource           = listEBSCmd.Flag("resource", "Only list the snapshots of this EBS volume").String()
+		listEBSRetentionPolicyTag = listEBSCmd.Flag("ebs-retention-policy-tag", "EBS tag that holds a grandfather-father-son retention policy replacing the retention days").Default("retention-policy").String()
+		listEBSDynamodbTable      = listEBSCmd.Flag("dynamodb-table", "Deprecated: DynamoDB table used for metadata storage, use --datastore dynamodb://<table>").String()
+
+		listLightsailCmd             = listCmd.Command("lightsail", "List lightsail instance snapshots")
+		listLightsailResource        = listLightsailCmd.Flag("resource", "Only list the snapshots of this instance").String()
+		listLightsailRetention       = listLightsailCmd.Flag("retention", "Retention duration").Default("240h").Duration()
+		listLightsailRetentionPolicy = listLightsailCmd.Flag("retention-policy", "Grandfather-father-son retention policy replacing the retention duration, e.g. 7d,4w,12m").String()
+
+		listLightsailDiskCmd             = listCmd.Command("lightsail-disk", "List lightsail disk snapshots")
+		listLightsailDiskResource        = listLightsailDiskCmd.Flag("resource", "Only list the snapshots of this disk").String()
+		listLightsailDiskRetention       = listLightsailDiskCmd.Flag("retention", "Retention duration").Default("240h").Duration()
+		listLightsailDiskRetentionPolicy = listLightsailDiskCmd.Flag("retention-policy", "Grandfather-father-son retention policy replacing the retention duration, e.g. 7d,4w,12m").String()
 
 		restoreCmd    = kingpin.Command("restore", "Restore a resource")
 		restoreEBSCmd = restoreCmd.Command("ebs", "Restore from an EBS snapshot")
 
 		restoreEBSSnapshotID         = restoreEBSCmd.Flag("from-snapshot", "Snapshot from to restore from").String()
 		restoreEBSResource           = restoreEBSCmd.Flag("from-resource", "Resource to restore from").String()
-		restoreEBSDynamoDBTable      = restoreEBSCmd.Flag("dynamodb-table", "DynamoDB Table used for storing snapshot infos").String()
-		restoreEBSDynamoDBAssumeRole = restoreEBSCmd.Flag("dynamodb-assume-role", "ARN of the role to assume for accessing DynamoDB table").String()
+		restoreEBSDynamoDBTable      = restoreEBSCmd.Flag("dynamodb-table", "Deprecated: DynamoDB Table used for storing snapshot infos, use --datastore dynamodb://<table>").String()
+		restoreEBSDynamoDBAssumeRole = restoreEBSCmd.Flag("dynamodb-assume-role", "Deprecated: ARN of the role to assume for accessing the datastore, use --datastore <URL>?role=<role ARN>").String()
+		restoreEBSDynamoDBRegion     = restoreEBSCmd.Flag("dynamodb-region", "Deprecated: Region of the datastore (default: --region), use --datastore <URL>?region=<region>").String()
+		restoreEBSAt                 = restoreEBSCmd.Flag("at", "Restore from the latest snapshot of the resource created at or before this RFC 3339 timestamp, e.g. 2020-03-04T12:00:00Z (default: the latest snapshot)").String()
+		restoreEBSGroup              = restoreEBSCmd.Flag("group", "ID of a snapshot group to restore all volumes of, see snapshot ebs --group-by-instance").String()
+		restoreEBSFromCopy           = restoreEBSCmd.Flag("from-copy", "Restore from the cross-region copy of the latest snapshot of the resource, e.g. if its region is unavailable").Default("false").Bool()
 
 		restoreEBSAZ        = restoreEBSCmd.Flag("availability-zone", "AZ to create volume in ").Required().String()
 		restoreEBSSize      = restoreEBSCmd.Flag("size", "The size of the volume (default: the snapshot's size)").Int64()
@@ -108,6 +214,27 @@ func main() {
 		restoreEBSType      = restoreEBSCmd.Flag("type", "The type of the volume. This can be gp2 for General Purpose SSD, io1 for Provisioned IOPS SSD, st1 for Throughput Optimized HDD, sc1 for Cold HDD, or standard for Magnetic volumes.").Default("").String()
 		restoreEBSEncrypted = restoreEBSCmd.Flag("encrypted", "Encrypt volume").Default("false").Bool()
 		restoreEBSKMSKeyID  = restoreEBSCmd.Flag("kms-key-id", "ARN of the KMS Key to use when encrypting (requires encrypt flag)").Default("").String()
+
+		restoreEBSTags           = restoreEBSCmd.Flag("tag", "Tag to set on the volume as key=value, overriding the tags of the source volume (repeatable)").StringMap()
+		restoreEBSAttachTo       = restoreEBSCmd.Flag("attach-to-instance", "ID of an instance in the AZ to attach the volume to once it is available (requires device)").String()
+		restoreEBSDevice         = restoreEBSCmd.Flag("device", "Device name to attach the volume at, e.g. /dev/sdf").String()
+		restoreEBSStopInstance   = restoreEBSCmd.Flag("stop-instance", "Stop the instance while attaching the volume and start it again afterwards, e.g. to replace its root volume").Default("false").Bool()
+		restoreEBSDetachExisting = restoreEBSCmd.Flag("detach-existing", "Detach the volume attached to the instance at the device, if any. The detached volume is kept").Default("false").Bool()
+
+		verifyCmd          = kingpin.Command("verify", "Verify that backups can be restored")
+		verifyEBSCmd       = verifyCmd.Command("ebs", "Restore the latest completed snapshot of EBS volumes into a scratch AZ and delete the restored volume again")
+		verifyEBSAZ        = verifyEBSCmd.Flag("availability-zone", "Scratch AZ to restore the volumes in").Required().String()
+		verifyEBSBackupTag = verifyEBSCmd.Flag("ebs-backup-tag", "EBS tag of the volumes to verify").Default("backup").String()
+		verifyEBSSample    = verifyEBSCmd.Flag("sample-rate", "Share of the volumes to verify per run, between 0 and 1, e.g. to limit cost").Default("1").Float64()
+		verifyEBSTimeout   = verifyEBSCmd.Flag("timeout", "How long to wait for a restored volume to become available").Default("10m").Duration()
+
+		restoreLightsailCmd          = restoreCmd.Command("lightsail", "Restore a lightsail instance from an instance snapshot")
+		restoreLightsailSnapshotName = restoreLightsailCmd.Flag("from-snapshot", "Name of the instance snapshot to restore from").String()
+		restoreLightsailInstance     = restoreLightsailCmd.Flag("from-instance", "Instance whose latest automated snapshot to restore from").String()
+		restoreLightsailName         = restoreLightsailCmd.Flag("instance-name", "Name of the instance to create").Required().String()
+		restoreLightsailAZ           = restoreLightsailCmd.Flag("availability-zone", "AZ to create the instance in").Required().String()
+		restoreLightsailBundleID     = restoreLightsailCmd.Flag("bundle-id", "Bundle ID of the instance to create, e.g. micro_1_0").Required().String()
+		restoreLightsailKeyPairName  = restoreLightsailCmd.Flag("key-pair-name", "Name of the key pair to use for the new instance").String()
 	)
 	cmd := kingpin.Parse()
 
@@ -118,67 +245,260 @@ func main() {
 		logger.Out = os.Stderr
 	}
 
-	creds := credentials.NewCredentials(&credentials.StaticProvider{
-		Value: credentials.Value{
-			AccessKeyID:     *awsAccessKeyID,
-			SecretAccessKey: *awsSecretAccessKey,
-		},
-	})
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
 
-	sess := session.New(aws.NewConfig().
-		WithCredentials(creds).
-		WithRegion(*region),
-	)
+	baseSess, err := newSession((*regions)[0], *awsAccessKeyID, *awsSecretAccessKey)
+	if err != nil {
+		logger.Fatalf("cannot create AWS session: %+v", err)
+	}
+	accounts, err := newAccounts(ctx, baseSess, *assumeRoles)
+	if err != nil {
+		logger.Fatalf("cannot determine AWS accounts: %+v", err)
+	}
+
+	if *dryRun && (strings.HasPrefix(cmd, "restore ") || strings.HasPrefix(cmd, "list ") || strings.HasPrefix(cmd, "verify ")) {
+		logger.Fatalf("dry run is not supported by %s", cmd)
+	}
+	// Restores and restore drills operate on a single account and region
+	if (strings.HasPrefix(cmd, "restore ") || strings.HasPrefix(cmd, "verify ")) && (len(accounts) > 1 || len(*regions) > 1) {
+		logger.Fatalf("%s needs a single region and at most one role to assume", strings.Fields(cmd)[0])
+	}
+	sess := accounts[0].session((*regions)[0])
 	lightsailClient := lightsail.New(sess)
 	ec2Client := awsec2.New(sess)
 
-	ctx, cancel := context.WithCancel(context.Background())
-	defer cancel()
-
-	var snaps []Snapshotter
-	var err error
+	var job *config.Job
 	switch cmd {
 	case "snapshot lightsail":
-		snaps, err = lightsailSnapshotter(ctx, logger, lightsailClient, *retention)
-		if err != nil {
-			logger.Fatal(err)
+		job = &config.Job{
+			Type:            config.JobTypeLightsail,
+			Retention:       *retention,
+			RetentionPolicy: *retentionPolicy,
+		}
+	case "snapshot lightsail-disk":
+		job = &config.Job{
+			Type:            config.JobTypeLightsailDisk,
+			Retention:       *lightsailDiskRetention,
+			RetentionPolicy: *lightsailDiskRetentionPolicy,
 		}
 	case "snapshot ebs":
-		dydb := awsdynamodb.New(sess)
-		dynamodbDs, err := dynamodb.New(dydb, *ebsDynamodbTable)
+		job = &config.Job{
+			Type:               config.JobTypeEBS,
+			BackupTag:          *ebsBackupTag,
+			RetentionTag:       *ebsRetentionTag,
+			RetentionPolicyTag: *ebsRetentionPolicyTag,
+			MinKeepTag:         *ebsMinKeepTag,
+			DynamoDBTable:      *ebsDynamodbTable,
+
+			CopyRegion:        *ebsCopyRegion,
+			CopyKMSKeyID:      *ebsCopyKMSKeyID,
+			CopyRetentionDays: *ebsCopyRetention,
+
+			VaultRole:          *ebsVaultRole,
+			VaultKMSKeyID:      *ebsVaultKMSKeyID,
+			VaultRetentionDays: *ebsVaultRetention,
+
+			GroupByInstance: *ebsGroupByInstance,
+
+			HookTag:             *ebsHookTag,
+			PreSnapshotCommand:  *ebsPreSnapshotCommand,
+			PostSnapshotCommand: *ebsPostSnapshotCmd,
+			HookTimeout:         *ebsHookTimeout,
+		}
+	case "snapshot rds":
+		job = &config.Job{
+			Type:          config.JobTypeRDS,
+			BackupTag:     *rdsBackupTag,
+			RetentionTag:  *rdsRetentionTag,
+			DynamoDBTable: *rdsDynamodbTable,
+		}
+	case "snapshot rds-cluster":
+		job = &config.Job{
+			Type:          config.JobTypeRDSCluster,
+			BackupTag:     *rdsClusterBackupTag,
+			RetentionTag:  *rdsClusterRetentionTag,
+			DynamoDBTable: *rdsClusterDynamodbTable,
+		}
+	case "run":
+		conf, err := config.Load(*runConfig)
+		if err != nil {
+			logger.Fatalf("config.Load: %+v", err)
+		}
+		conf.ExpandRegions(*regions)
+		for _, job := range conf.Jobs {
+			job.DryRun = *dryRun
+		}
+
+		summaries := runJobs(ctx, logger, accounts, conf.Jobs)
+		printResult := printSummaries
+		if *dryRun {
+			printResult = printPlans
+		}
+		if err := printResult(*output, summaries); err != nil {
+			logger.Error(err)
+		}
+	case "serve":
+		conf, err := config.Load(*serveConfig)
 		if err != nil {
-			logger.Fatalf("dynamodb.New: %+v", err)
+			logger.Fatalf("config.Load: %+v", err)
+		}
+		if *dryRun {
+			logger.Fatal("dry run is not supported by serve, use run instead")
+		}
+		conf.ExpandRegions(*regions)
+		if err := conf.ValidateSchedules(); err != nil {
+			logger.Fatal(err)
 		}
 
-		snaps = []Snapshotter{
-			ec2.NewSnapshotManager(
-				ec2Client,
-				dynamodbDs,
-				ec2.WithRetentionTag(*ebsRetentionTag),
-				ec2.WithBackupTag(*ebsBackupTag),
-			),
+		sched := newScheduler(ctx, logger)
+		for _, job := range conf.Jobs {
+			for _, acct := range accounts {
+				if err := sched.add(acct, job); err != nil {
+					logger.Fatal(err)
+				}
+			}
+		}
+
+		srv := &http.Server{
+			Addr:    *serveListenAddress,
+			Handler: newServeMux(sched),
+		}
+		go func() {
+			if err := srv.ListenAndServe(); err != nil && err != http.ErrServerClosed {
+				logger.Fatalf("cannot serve on %s: %+v", *serveListenAddress, err)
+			}
+		}()
+		sched.start()
+
+		sigs := make(chan os.Signal, 1)
+		signal.Notify(sigs, syscall.SIGTERM, os.Interrupt)
+		sig := <-sigs
+		logger.Infof("Received %s, waiting for running jobs to finish", sig)
+		sched.stop()
+
+		shutdownCtx, shutdownCancel := context.WithTimeout(context.Background(), 10*time.Second)
+		defer shutdownCancel()
+		if err := srv.Shutdown(shutdownCtx); err != nil {
+			logger.Errorf("cannot shut down HTTP server: %+v", err)
+		}
+		return
+	case "list ebs":
+		list := func(ctx context.Context, sess *session.Session) ([]snapshot.Description, datastore.Datastore, error) {
+			var ds datastore.Datastore
+			if hasDatastore(*datastoreURL, *listEBSDynamodbTable) {
+				var err error
+				if ds, err = openDatastore(sess, *datastoreURL, *listEBSDynamodbTable); err != nil {
+					return nil, nil, err
+				}
+			}
+			descs, err := ec2.NewSnapshotManager(awsec2.New(sess), ds,
+				ec2.WithRetentionPolicyTag(*listEBSRetentionPolicyTag),
+				ec2.WithLogger(logger),
+			).List(ctx, *listEBSResource)
+			return descs, ds, err
+		}
+		printListOrDie(ctx, logger, *output, accounts, *regions, *listEBSResource, list)
+		return
+	case "list lightsail", "list lightsail-disk":
+		resource, ret, policy := *listLightsailResource, *listLightsailRetention, *listLightsailRetentionPolicy
+		listFn := snaplightsail.ListInstanceSnapshots
+		if cmd == "list lightsail-disk" {
+			resource, ret, policy = *listLightsailDiskResource, *listLightsailDiskRetention, *listLightsailDiskRetentionPolicy
+			listFn = snaplightsail.ListDiskSnapshots
+		}
+		opts := []snaplightsail.Opt{snaplightsail.WithRetention(ret), snaplightsail.WithLogger(logger)}
+		if policy != "" {
+			p, err := snapshot.ParseRetentionPolicy(policy)
+			if err != nil {
+				logger.Fatal(err)
+			}
+			opts = append(opts, snaplightsail.WithRetentionPolicy(p))
 		}
+		list := func(ctx context.Context, sess *session.Session) ([]snapshot.Description, datastore.Datastore, error) {
+			var ds datastore.Datastore
+			if hasDatastore(*datastoreURL, "") {
+				var err error
+				if ds, err = openDatastore(sess, *datastoreURL, ""); err != nil {
+					return nil, nil, err
+				}
+			}
+			descs, err := listFn(ctx, lightsail.New(sess), resource, opts...)
+			return descs, ds, err
+		}
+		printListOrDie(ctx, logger, *output, accounts, *regions, resource, list)
+		return
 	case "restore ebs":
-		var snapshot string
-		if *restoreEBSResource == "" && *restoreEBSSnapshotID == "" {
-			logger.Fatal("need either snapshotID or resource")
+		var (
+			snapshot   string
+			sourceTags map[string]string
+		)
+		if *restoreEBSResource == "" && *restoreEBSSnapshotID == "" && *restoreEBSGroup == "" {
+			logger.Fatal("need either snapshotID, resource or group")
 		}
-		if *restoreEBSResource != "" {
+		if (*restoreEBSAttachTo == "") != (*restoreEBSDevice == "") {
+			logger.Fatal("attaching the volume needs both an instance and a device")
+		}
+		if *restoreEBSAttachTo == "" && (*restoreEBSStopInstance || *restoreEBSDetachExisting) {
+			logger.Fatal("stopping the instance or detaching the existing volume needs an instance to attach to")
+		}
+		if *restoreEBSGroup != "" && *restoreEBSAttachTo != "" {
+			logger.Fatal("restoring a group can't be combined with attaching to an instance")
+		}
+		if *restoreEBSGroup != "" && (*restoreEBSResource != "" || *restoreEBSSnapshotID != "" || *restoreEBSFromCopy || *restoreEBSAt != "") {
+			logger.Fatal("restoring a group can't be combined with a snapshotID, resource, copy or point in time")
+		}
+		if *restoreEBSFromCopy && *restoreEBSResource == "" {
+			logger.Fatal("restoring from a copy needs a resource")
+		}
+		if *restoreEBSAt != "" && *restoreEBSResource == "" {
+			logger.Fatal("restoring from a point in time needs a resource")
+		}
+		var ds datastore.Datastore
+		if *restoreEBSResource != "" || *restoreEBSGroup != "" {
 			conf := &aws.Config{}
 			if *restoreEBSDynamoDBAssumeRole != "" {
 				conf.Credentials = stscreds.NewCredentials(sess, *restoreEBSDynamoDBAssumeRole)
 			}
-			dydb := awsdynamodb.New(sess, conf)
-			if *restoreEBSDynamoDBTable == "" {
-				logger.Fatal("need to dynamodb table to retrieve snapshot infos from")
+			if *restoreEBSDynamoDBRegion != "" {
+				conf.Region = aws.String(*restoreEBSDynamoDBRegion)
 			}
-			dynamodbDs, err := dynamodb.New(dydb, *restoreEBSDynamoDBTable)
-			info, err := dynamodbDs.GetLatestSnapshotInfo(datastore.SnapshotResource(*restoreEBSResource))
-			if err != nil {
-				logger.Fatalf("getLatestSnapshotInfo: %+v", err)
+			if ds, err = openDatastore(sess, *datastoreURL, *restoreEBSDynamoDBTable, conf); err != nil {
+				logger.Fatalf("cannot create datastore to retrieve snapshot infos from: %+v", err)
+			}
+		}
+		if *restoreEBSResource != "" {
+			var info *datastore.SnapshotInfo
+			if *restoreEBSAt != "" {
+				at, perr := time.Parse(time.RFC3339, *restoreEBSAt)
+				if perr != nil {
+					logger.Fatalf("invalid point in time %q: %+v", *restoreEBSAt, perr)
+				}
+				info, err = ds.GetSnapshotInfoAt(ctx, datastore.SnapshotResource(*restoreEBSResource), at)
+			} else {
+				info, err = ds.GetLatestSnapshotInfo(ctx, datastore.SnapshotResource(*restoreEBSResource))
+			}
+			if datastore.IsNotFound(err) {
+				logger.Fatalf("no snapshot of %s recorded in the datastore", *restoreEBSResource)
+			} else if err != nil {
+				logger.Fatalf("cannot get snapshot info: %+v", err)
 			}
 			snapshot = string(info.ID)
-		} else {
+			// Older snapshot infos don't record the tags of the volume,
+			// which are then derived from the snapshot tags
+			if tags := ec2.VolumeTags(info.Labels); len(tags) > 0 {
+				sourceTags = tags
+			}
+			if *restoreEBSFromCopy {
+				copyID, copyRegion := info.Labels[ec2.CopySnapshotIDLabel], info.Labels[ec2.CopyRegionLabel]
+				if copyID == "" || copyRegion == "" {
+					logger.Fatalf("snapshot %s has no copy", info.ID)
+				}
+				logger.Infof("restoring from copy %s of snapshot %s in region %s", copyID, info.ID, copyRegion)
+				snapshot = copyID
+				ec2Client = awsec2.New(sess, aws.NewConfig().WithRegion(copyRegion))
+			}
+		} else if *restoreEBSSnapshotID != "" {
 			snapshot = *restoreEBSSnapshotID
 		}
 
@@ -202,6 +522,24 @@ func main() {
 			opts = append(opts, ec2.RestoreWithEncrypted(true), ec2.RestoreWithKMSKeyID(*restoreEBSKMSKeyID))
 		}
 
+		if *restoreEBSAttachTo != "" {
+			logger.Infof("attaching volume to instance %s at %s", *restoreEBSAttachTo, *restoreEBSDevice)
+			opts = append(opts,
+				ec2.RestoreWithAttachment(*restoreEBSAttachTo, *restoreEBSDevice),
+				ec2.RestoreWithStopInstance(*restoreEBSStopInstance),
+				ec2.RestoreWithDetachExisting(*restoreEBSDetachExisting),
+			)
+		}
+		if sourceTags != nil {
+			opts = append(opts, ec2.RestoreWithSourceTags(sourceTags))
+		}
+		opts = append(opts, ec2.RestoreWithTags(*restoreEBSTags), ec2.RestoreWithLogger(logger))
+
+		if *restoreEBSGroup != "" {
+			restoreGroupOrDie(ctx, logger, *output, ec2Client, ds, *restoreEBSGroup, *restoreEBSAZ, opts...)
+			return
+		}
+
 		logger.Infof("running restore manager for snapshot %s in AZ %s", snapshot, *restoreEBSAZ)
 		if volumeID, err := ec2.NewRestoreManager(ec2Client, snapshot, *restoreEBSAZ, opts...).Run(ctx); err != nil {
 			logger.Errorf("restoreManager: %+v", err)
@@ -214,22 +552,85 @@ func main() {
 			}
 		}
 		return
+	case "restore lightsail":
+		if *restoreLightsailInstance == "" && *restoreLightsailSnapshotName == "" {
+			logger.Fatal("need either snapshot name or instance")
+		}
+		if *restoreLightsailInstance != "" && *restoreLightsailSnapshotName != "" {
+			logger.Fatal("need either snapshot name or instance, not both")
+		}
+
+		var opts []snaplightsail.RestoreOption
+		if *restoreLightsailSnapshotName != "" {
+			opts = append(opts, snaplightsail.RestoreFromSnapshot(*restoreLightsailSnapshotName))
+		} else {
+			opts = append(opts, snaplightsail.RestoreFromInstance(*restoreLightsailInstance))
+		}
+		if *restoreLightsailKeyPairName != "" {
+			opts = append(opts, snaplightsail.RestoreWithKeyPairName(*restoreLightsailKeyPairName))
+		}
+
+		logger.Infof("running restore manager for instance %s in AZ %s", *restoreLightsailName, *restoreLightsailAZ)
+		instance, err := snaplightsail.NewRestoreManager(
+			lightsailClient,
+			*restoreLightsailName,
+			*restoreLightsailAZ,
+			*restoreLightsailBundleID,
+			opts...,
+		).Run(ctx)
+		if err != nil {
+			logger.Errorf("restoreManager: %+v", err)
+		} else {
+			switch *output {
+			case "json":
+				fmt.Printf("{ \"instanceName\": \"%s\", \"publicIpAddress\": \"%s\"}",
+					aws.StringValue(instance.Name), aws.StringValue(instance.PublicIpAddress))
+			default:
+				fmt.Printf("created instance %s with public IP address: %s\n",
+					aws.StringValue(instance.Name), aws.StringValue(instance.PublicIpAddress))
+			}
+		}
+		return
+	case "verify ebs":
+		if *verifyEBSSample <= 0 || *verifyEBSSample > 1 {
+			logger.Fatal("sample rate must be greater than 0 and at most 1")
+		}
+		ds, err := openDatastore(sess, *datastoreURL, "")
+		if err != nil {
+			logger.Fatalf("cannot create datastore to retrieve snapshot infos from: %+v", err)
+		}
+		results, err := ec2.NewVerifyManager(ec2Client, ds, *verifyEBSAZ,
+			ec2.VerifyWithBackupTag(*verifyEBSBackupTag),
+			ec2.VerifyWithSampleRate(*verifyEBSSample),
+			ec2.VerifyWithTimeout(*verifyEBSTimeout),
+			ec2.VerifyWithLogger(logger),
+		).Run(ctx)
+		if err != nil {
+			logger.Errorf("verifyManager: %+v", err)
+		}
+		if err := printDrills(*output, results); err != nil {
+			logger.Error(err)
+		}
 	default:
 		logger.Fatalf("Invalid command %q", cmd)
 	}
 
-	for _, s := range snaps {
-		if !*disableSnapshot {
-			logger.Infof("Trying to snapshot")
-			if err := s.Snapshot(ctx); err != nil {
-				logger.Error(err)
-			}
-		}
-		if !*disablePrune {
-			logger.Infof("Trying to Prune")
-			if err := s.Prune(ctx); err != nil {
+	if job != nil {
+		job.Name = strings.Replace(cmd, " ", "-", -1)
+		job.DisablePrune = *disablePrune
+		job.DisableSnapshot = *disableSnapshot
+		job.MinKeep = *minKeep
+		job.DryRun = *dryRun
+		job.Datastore = *datastoreURL
+
+		conf := &config.Config{Jobs: []*config.Job{job}}
+		conf.ExpandRegions(*regions)
+		summaries := runJobs(ctx, logger, accounts, conf.Jobs)
+		if *dryRun {
+			if err := printPlans(*output, summaries); err != nil {
 				logger.Error(err)
 			}
+			return
 		}
 	}
 
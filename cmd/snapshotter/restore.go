@@ -0,0 +1,73 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"os"
+
+	awsec2 "github.com/aws/aws-sdk-go/service/ec2"
+	log "github.com/sirupsen/logrus"
+
+	"github.com/grid-x/aws-auto-snapshot/pkg/datastore"
+	"github.com/grid-x/aws-auto-snapshot/pkg/snapshot/ec2"
+)
+
+// restoredVolume is a volume restored from a snapshot of a group
+type restoredVolume struct {
+	Device     string `json:"device"`
+	SnapshotID string `json:"snapshotID"`
+	VolumeID   string `json:"volumeID"`
+}
+
+// restoreGroupOrDie restores all volumes of the given snapshot group into the
+// given AZ and prints them. The group has to be complete, so no inconsistent
+// set of volumes is restored
+func restoreGroupOrDie(ctx context.Context, logger log.FieldLogger, output string,
+	client *awsec2.EC2, ds datastore.Datastore, id, az string, opts ...ec2.RestoreOption) {
+
+	group, err := ec2.LookupGroup(ctx, ds, id)
+	if datastore.IsNotFound(err) {
+		logger.Fatalf("no snapshot group %s recorded in the datastore", id)
+	} else if err != nil {
+		logger.Fatalf("cannot get snapshot group: %+v", err)
+	}
+	if !group.Complete() {
+		logger.Fatalf("snapshot group %s is %s", id, group.State)
+	}
+
+	var restored []*restoredVolume
+	for _, device := range group.Devices() {
+		snapshotID := group.Snapshots[device]
+		logger.Infof("running restore manager for snapshot %s of device %s in AZ %s", snapshotID, device, az)
+		volumeID, err := ec2.NewRestoreManager(client, snapshotID, az, opts...).Run(ctx)
+		if err != nil {
+			// Print the volumes restored so far, so they can be
+			// cleaned up
+			logger.Errorf("restoreManager: %+v", err)
+			break
+		}
+		restored = append(restored, &restoredVolume{
+			Device:     device,
+			SnapshotID: snapshotID,
+			VolumeID:   volumeID,
+		})
+	}
+
+	switch output {
+	case "json":
+		if restored == nil {
+			restored = []*restoredVolume{}
+		}
+		if err := json.NewEncoder(os.Stdout).Encode(restored); err != nil {
+			logger.Fatal(err)
+		}
+	default:
+		for _, v := range restored {
+			fmt.Printf("created volume with ID: %s for device %s\n", v.VolumeID, v.Device)
+		}
+	}
+	if len(restored) < len(group.Snapshots) {
+		logger.Fatalf("restored only %d of %d volumes of snapshot group %s", len(restored), len(group.Snapshots), id)
+	}
+}
@@ -0,0 +1,141 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"sync"
+	"sync/atomic"
+
+	"github.com/prometheus/client_golang/prometheus/promhttp"
+	"github.com/robfig/cron"
+	log "github.com/sirupsen/logrus"
+
+	"github.com/grid-x/aws-auto-snapshot/pkg/config"
+)
+
+// scheduler runs jobs on their cron schedules and keeps track of the runs in
+// flight so they can be finished on shutdown
+type scheduler struct {
+	ctx    context.Context
+	logger log.FieldLogger
+	cron   *cron.Cron
+
+	mu       sync.Mutex
+	stopping bool
+	inflight sync.WaitGroup
+
+	ready int32
+}
+
+func newScheduler(ctx context.Context, logger log.FieldLogger) *scheduler {
+	return &scheduler{
+		ctx:    ctx,
+		logger: logger,
+		cron:   cron.New(),
+	}
+}
+
+// add schedules the given job in the given account. If the job has a separate
+// prune schedule, snapshotting and pruning are scheduled independently
+func (s *scheduler) add(acct *account, job *config.Job) error {
+	if job.PruneSchedule == "" {
+		return s.schedule(job.Schedule, acct, job)
+	}
+
+	snapshotJob := *job
+	snapshotJob.DisablePrune = true
+	if err := s.schedule(job.Schedule, acct, &snapshotJob); err != nil {
+		return err
+	}
+
+	pruneJob := *job
+	pruneJob.DisableSnapshot = true
+	return s.schedule(job.PruneSchedule, acct, &pruneJob)
+}
+
+func (s *scheduler) schedule(spec string, acct *account, job *config.Job) error {
+	sched, err := cron.ParseStandard(spec)
+	if err != nil {
+		return fmt.Errorf("job %s: invalid schedule %q: %+v", job.Name, spec, err)
+	}
+	if job.DisableSnapshot && job.DisablePrune {
+		// nothing to do
+		return nil
+	}
+
+	logger := s.logger.WithFields(log.Fields{
+		"job":      job.Name,
+		"account":  acct.id,
+		"region":   job.Region,
+		"schedule": spec,
+	})
+
+	var running int32
+	s.cron.Schedule(sched, cron.FuncJob(func() {
+		// Don't let runs of the same job overlap
+		if !atomic.CompareAndSwapInt32(&running, 0, 1) {
+			logger.Warn("Previous run still in progress, skipping")
+			return
+		}
+		defer atomic.StoreInt32(&running, 0)
+
+		s.mu.Lock()
+		if s.stopping {
+			s.mu.Unlock()
+			return
+		}
+		s.inflight.Add(1)
+		s.mu.Unlock()
+		defer s.inflight.Done()
+
+		logger.Info("Running job")
+		summary := runJob(s.ctx, s.logger, acct, job)
+		if summary.failed() {
+			logger.Errorf("Job finished with errors after %s", summary.Duration)
+			return
+		}
+		logger.Infof("Job finished after %s", summary.Duration)
+	}))
+	logger.Info("Scheduled job")
+	return nil
+}
+
+func (s *scheduler) start() {
+	s.cron.Start()
+	atomic.StoreInt32(&s.ready, 1)
+}
+
+// stop prevents new runs from being started and waits for the runs in flight
+// to finish
+func (s *scheduler) stop() {
+	atomic.StoreInt32(&s.ready, 0)
+
+	s.mu.Lock()
+	s.stopping = true
+	s.mu.Unlock()
+
+	s.cron.Stop()
+	s.inflight.Wait()
+}
+
+func (s *scheduler) isReady() bool {
+	return atomic.LoadInt32(&s.ready) == 1
+}
+
+// newServeMux creates the handler for the HTTP endpoints of the serve command
+func newServeMux(s *scheduler) *http.ServeMux {
+	mux := http.NewServeMux()
+	mux.Handle("/metrics", promhttp.Handler())
+	mux.HandleFunc("/healthz", func(w http.ResponseWriter, r *http.Request) {
+		fmt.Fprintln(w, "ok")
+	})
+	mux.HandleFunc("/readyz", func(w http.ResponseWriter, r *http.Request) {
+		if !s.isReady() {
+			http.Error(w, "not ready", http.StatusServiceUnavailable)
+			return
+		}
+		fmt.Fprintln(w, "ok")
+	})
+	return mux
+}
@@ -0,0 +1,29 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+	"text/tabwriter"
+
+	"github.com/grid-x/aws-auto-snapshot/pkg/snapshot/ec2"
+)
+
+// printDrills prints the results of restore drills in the requested output
+// format
+func printDrills(output string, results []*ec2.DrillResult) error {
+	switch output {
+	case "json":
+		if results == nil {
+			results = []*ec2.DrillResult{}
+		}
+		return json.NewEncoder(os.Stdout).Encode(results)
+	default:
+		w := tabwriter.NewWriter(os.Stdout, 0, 8, 2, ' ', 0)
+		fmt.Fprintln(w, "RESOURCE\tSNAPSHOT\tSUCCEEDED\tSECONDS\tERROR")
+		for _, r := range results {
+			fmt.Fprintf(w, "%s\t%s\t%t\t%.0f\t%s\n", r.Resource, r.SnapshotID, r.Succeeded, r.Seconds, r.Error)
+		}
+		return w.Flush()
+	}
+}
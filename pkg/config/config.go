@@ -0,0 +1,295 @@
+// Package config contains the declarative configuration of snapshot jobs
+package config
+
+import (
+	"fmt"
+	"io/ioutil"
+	"net/url"
+	"time"
+
+	"github.com/robfig/cron"
+	"gopkg.in/yaml.v2"
+
+	"github.com/grid-x/aws-auto-snapshot/pkg/snapshot"
+)
+
+// JobType describes which kind of resources a job is snapshotting
+type JobType string
+
+// The supported job types
+const (
+	JobTypeEBS           JobType = "ebs"
+	JobTypeLightsail     JobType = "lightsail"
+	JobTypeLightsailDisk JobType = "lightsail-disk"
+	JobTypeRDS           JobType = "rds"
+	JobTypeRDSCluster    JobType = "rds-cluster"
+)
+
+const (
+	defaultBackupTag          = "backup"
+	defaultRetentionTag       = "retention"
+	defaultRetentionPolicyTag = "retention-policy"
+	defaultMinKeepTag         = "min-keep"
+	defaultHookTag            = "snapshot-hook"
+	defaultRetention          = 240 * time.Hour
+	defaultHookTimeout        = 5 * time.Minute
+)
+
+// Config is the configuration of a snapshotter run consisting of multiple
+// jobs
+type Config struct {
+	Jobs []*Job `yaml:"jobs"`
+}
+
+// Job describes a single set of resources to snapshot and prune
+type Job struct {
+	// Name is used to identify the job in logs and summaries. It defaults
+	// to <type>-<region>-<index>
+	Name string  `yaml:"name"`
+	Type JobType `yaml:"type"`
+	// Region defaults to the regions given on the command line, i.e. the
+	// job is run once per region
+	Region string `yaml:"region"`
+
+	// BackupTag and RetentionTag are used by EBS and RDS jobs to select
+	// resources and their retention days
+	BackupTag    string `yaml:"backupTag"`
+	RetentionTag string `yaml:"retentionTag"`
+	// RetentionPolicyTag is used by EBS jobs to look up a grandfather-father-son
+	// retention policy of a volume, which replaces its retention days
+	RetentionPolicyTag string `yaml:"retentionPolicyTag"`
+	// Retention is used by lightsail jobs. RetentionPolicy optionally
+	// replaces it by a grandfather-father-son policy such as 7d,4w,12m
+	Retention       time.Duration `yaml:"retention"`
+	RetentionPolicy string        `yaml:"retentionPolicy"`
+
+	// MinKeep is the number of newest successful snapshots of a resource
+	// that are never pruned. EBS volumes can override it via MinKeepTag
+	MinKeep    int    `yaml:"minKeep"`
+	MinKeepTag string `yaml:"minKeepTag"`
+
+	// DynamoDBTable or Datastore is required by EBS and RDS jobs for
+	// metadata storage, unless EBS jobs only prune. Datastore is a URL such
+	// as s3://bucket/prefix or file:///var/lib/snapshotter/meta.db
+	DynamoDBTable string `yaml:"dynamodbTable"`
+	Datastore     string `yaml:"datastore"`
+
+	// CopyRegion makes EBS jobs copy every new snapshot to this region,
+	// optionally encrypted with CopyKMSKeyID. The copies are kept for
+	// CopyRetentionDays, defaulting to the retention of the source snapshot
+	CopyRegion        string `yaml:"copyRegion"`
+	CopyKMSKeyID      string `yaml:"copyKmsKeyId"`
+	CopyRetentionDays int64  `yaml:"copyRetentionDays"`
+
+	// VaultRole makes EBS jobs share every new snapshot with the account of
+	// this role and copy it there using the role, optionally encrypted with
+	// VaultKMSKeyID. The copies are kept for VaultRetentionDays, defaulting
+	// to the retention of the source snapshot
+	VaultRole          string `yaml:"vaultRole"`
+	VaultKMSKeyID      string `yaml:"vaultKmsKeyId"`
+	VaultRetentionDays int64  `yaml:"vaultRetentionDays"`
+
+	// GroupByInstance makes EBS jobs select instances by the BackupTag and
+	// snapshot all volumes of an instance as one group
+	GroupByInstance bool `yaml:"groupByInstance"`
+
+	// PreSnapshotCommand and PostSnapshotCommand are run by EBS jobs via SSM
+	// Run Command on the instance a volume with the HookTag is attached to,
+	// right before and after snapshotting it, e.g. to freeze and unfreeze its
+	// file system. Each command may run for HookTimeout
+	HookTag             string        `yaml:"hookTag"`
+	PreSnapshotCommand  string        `yaml:"preSnapshotCommand"`
+	PostSnapshotCommand string        `yaml:"postSnapshotCommand"`
+	HookTimeout         time.Duration `yaml:"hookTimeout"`
+
+	DisablePrune    bool `yaml:"disablePrune"`
+	DisableSnapshot bool `yaml:"disableSnapshot"`
+	// DryRun is set via the command line only, see --dry-run
+	DryRun bool `yaml:"-"`
+
+	// Schedule is the cron expression the job is run on in serve mode.
+	// PruneSchedule optionally runs the pruning on a different schedule
+	Schedule      string `yaml:"schedule"`
+	PruneSchedule string `yaml:"pruneSchedule"`
+}
+
+// Load reads and parses the config file at the given path
+func Load(path string) (*Config, error) {
+	data, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	return Parse(data)
+}
+
+// Parse parses the given YAML config, sets defaults and validates it
+func Parse(data []byte) (*Config, error) {
+	var conf Config
+	if err := yaml.UnmarshalStrict(data, &conf); err != nil {
+		return nil, err
+	}
+	if len(conf.Jobs) == 0 {
+		return nil, fmt.Errorf("no jobs configured")
+	}
+
+	names := make(map[string]bool, len(conf.Jobs))
+	for i, job := range conf.Jobs {
+		if job == nil {
+			return nil, fmt.Errorf("job %d is empty", i)
+		}
+		job.setDefaults()
+		if err := job.validate(); err != nil {
+			return nil, fmt.Errorf("job %d: %+v", i, err)
+		}
+		if job.Name != "" {
+			if names[job.Name] {
+				return nil, fmt.Errorf("job %d: duplicate job name %q", i, job.Name)
+			}
+			names[job.Name] = true
+		}
+	}
+	return &conf, nil
+}
+
+func (j *Job) setDefaults() {
+	if j.BackupTag == "" {
+		j.BackupTag = defaultBackupTag
+	}
+	if j.RetentionTag == "" {
+		j.RetentionTag = defaultRetentionTag
+	}
+	if j.RetentionPolicyTag == "" {
+		j.RetentionPolicyTag = defaultRetentionPolicyTag
+	}
+	if j.MinKeepTag == "" {
+		j.MinKeepTag = defaultMinKeepTag
+	}
+	if j.HookTag == "" {
+		j.HookTag = defaultHookTag
+	}
+	if j.Retention == 0 {
+		j.Retention = defaultRetention
+	}
+	if j.HookTimeout == 0 {
+		j.HookTimeout = defaultHookTimeout
+	}
+}
+
+func (j *Job) validate() error {
+	switch j.Type {
+	case JobTypeEBS, JobTypeRDS, JobTypeRDSCluster:
+		// EBS jobs that only prune, e.g. the vault copies in a vault
+		// account, don't record anything
+		prunesOnly := j.Type == JobTypeEBS && j.DisableSnapshot
+		if j.DynamoDBTable == "" && j.Datastore == "" && !prunesOnly {
+			return fmt.Errorf("%s jobs need a dynamodbTable or a datastore", j.Type)
+		}
+	case JobTypeLightsail, JobTypeLightsailDisk:
+	case "":
+		return fmt.Errorf("job type is missing")
+	default:
+		return fmt.Errorf("unknown job type %q", j.Type)
+	}
+	if j.DynamoDBTable != "" && j.Datastore != "" {
+		return fmt.Errorf("only one of dynamodbTable and datastore may be set")
+	}
+	if j.Datastore != "" {
+		if u, err := url.Parse(j.Datastore); err != nil || u.Scheme == "" {
+			return fmt.Errorf("invalid datastore URL %q", j.Datastore)
+		}
+	}
+	if j.Retention < 0 {
+		return fmt.Errorf("retention must not be negative")
+	}
+	if j.MinKeep < 0 {
+		return fmt.Errorf("minKeep must not be negative")
+	}
+	if j.RetentionPolicy != "" {
+		if j.Type != JobTypeLightsail && j.Type != JobTypeLightsailDisk {
+			return fmt.Errorf("retentionPolicy is only supported by lightsail jobs, use a retention policy tag instead")
+		}
+		if _, err := snapshot.ParseRetentionPolicy(j.RetentionPolicy); err != nil {
+			return err
+		}
+	}
+	if j.Type != JobTypeEBS && (j.CopyRegion != "" || j.CopyKMSKeyID != "" || j.CopyRetentionDays != 0) {
+		return fmt.Errorf("copying snapshots is only supported by %s jobs", JobTypeEBS)
+	}
+	if j.CopyRegion == "" && (j.CopyKMSKeyID != "" || j.CopyRetentionDays != 0) {
+		return fmt.Errorf("copyKmsKeyId and copyRetentionDays require copyRegion to be set")
+	}
+	if j.CopyRegion != "" && j.CopyRegion == j.Region {
+		return fmt.Errorf("copyRegion must differ from region")
+	}
+	if j.CopyRetentionDays < 0 {
+		return fmt.Errorf("copyRetentionDays must not be negative")
+	}
+	if j.Type != JobTypeEBS && (j.VaultRole != "" || j.VaultKMSKeyID != "" || j.VaultRetentionDays != 0) {
+		return fmt.Errorf("copying snapshots to a vault account is only supported by %s jobs", JobTypeEBS)
+	}
+	if j.VaultRole != "" && j.DisableSnapshot {
+		return fmt.Errorf("vaultRole has no effect if disableSnapshot is set, prune the vault copies by a job in the vault account")
+	}
+	if j.VaultRole == "" && (j.VaultKMSKeyID != "" || j.VaultRetentionDays != 0) {
+		return fmt.Errorf("vaultKmsKeyId and vaultRetentionDays require vaultRole to be set")
+	}
+	if j.VaultRetentionDays < 0 {
+		return fmt.Errorf("vaultRetentionDays must not be negative")
+	}
+	if j.Type != JobTypeEBS && j.GroupByInstance {
+		return fmt.Errorf("groupByInstance is only supported by %s jobs", JobTypeEBS)
+	}
+	if j.Type != JobTypeEBS && (j.PreSnapshotCommand != "" || j.PostSnapshotCommand != "") {
+		return fmt.Errorf("snapshot hooks are only supported by %s jobs", JobTypeEBS)
+	}
+	if j.HookTimeout < 0 {
+		return fmt.Errorf("hookTimeout must not be negative")
+	}
+	for _, spec := range []string{j.Schedule, j.PruneSchedule} {
+		if spec == "" {
+			continue
+		}
+		if _, err := cron.ParseStandard(spec); err != nil {
+			return fmt.Errorf("invalid schedule %q: %+v", spec, err)
+		}
+	}
+	if j.PruneSchedule != "" && j.Schedule == "" {
+		return fmt.Errorf("pruneSchedule requires schedule to be set")
+	}
+	return nil
+}
+
+// ValidateSchedules checks whether all jobs can be scheduled, i.e. have a
+// schedule set
+func (c *Config) ValidateSchedules() error {
+	for i, job := range c.Jobs {
+		if job.Schedule == "" {
+			return fmt.Errorf("job %d: no schedule set", i)
+		}
+	}
+	return nil
+}
+
+// ExpandRegions replaces every job without an explicit region by one job per
+// given region. The names of unnamed jobs are derived from their type, region
+// and position in the config
+func (c *Config) ExpandRegions(regions []string) {
+	var jobs []*Job
+	for i, job := range c.Jobs {
+		jobRegions := regions
+		if job.Region != "" {
+			jobRegions = []string{job.Region}
+		}
+		for _, region := range jobRegions {
+			j := *job
+			j.Region = region
+			if job.Name == "" {
+				j.Name = fmt.Sprintf("%s-%s-%d", job.Type, region, i)
+			} else if job.Region == "" && len(regions) > 1 {
+				j.Name = fmt.Sprintf("%s-%s", job.Name, region)
+			}
+			jobs = append(jobs, &j)
+		}
+	}
+	c.Jobs = jobs
+}
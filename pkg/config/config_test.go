@@ -0,0 +1,340 @@
+package config_test
+
+import (
+	"testing"
+	"time"
+
+	"github.com/google/go-cmp/cmp"
+
+	"github.com/grid-x/aws-auto-snapshot/pkg/config"
+)
+
+func Test_Parse(t *testing.T) {
+	testcases := []struct {
+		input   string
+		want    *config.Config
+		wantErr bool
+	}{
+		{
+			input: `
+jobs:
+- name: volumes
+  type: ebs
+  region: eu-west-1
+  backupTag: Backup
+  dynamodbTable: Snapshots
+  disablePrune: true
+  copyRegion: eu-central-1
+  copyRetentionDays: 30
+  vaultRole: arn:aws:iam::123456789012:role/vault
+  groupByInstance: true
+  preSnapshotCommand: fsfreeze -f /data
+  postSnapshotCommand: fsfreeze -u /data
+  hookTimeout: 1m
+- type: lightsail
+  retention: 72h
+  retentionPolicy: 7d,4w
+  minKeep: 3
+`,
+			want: &config.Config{
+				Jobs: []*config.Job{
+					{
+						Name:               "volumes",
+						Type:               config.JobTypeEBS,
+						Region:             "eu-west-1",
+						BackupTag:          "Backup",
+						RetentionTag:       "retention",
+						RetentionPolicyTag: "retention-policy",
+						MinKeepTag:         "min-keep",
+						Retention:          240 * time.Hour,
+						DynamoDBTable:      "Snapshots",
+						DisablePrune:       true,
+
+						CopyRegion:        "eu-central-1",
+						CopyRetentionDays: 30,
+
+						VaultRole: "arn:aws:iam::123456789012:role/vault",
+
+						GroupByInstance: true,
+
+						HookTag:             "snapshot-hook",
+						PreSnapshotCommand:  "fsfreeze -f /data",
+						PostSnapshotCommand: "fsfreeze -u /data",
+						HookTimeout:         time.Minute,
+					},
+					{
+						Type:               config.JobTypeLightsail,
+						BackupTag:          "backup",
+						RetentionTag:       "retention",
+						RetentionPolicyTag: "retention-policy",
+						MinKeepTag:         "min-keep",
+						Retention:          72 * time.Hour,
+						RetentionPolicy:    "7d,4w",
+						MinKeep:            3,
+						HookTag:            "snapshot-hook",
+						HookTimeout:        5 * time.Minute,
+					},
+				},
+			},
+		},
+		{
+			input: `
+jobs:
+- type: rds
+  datastore: s3://backups/snapshots
+`,
+			want: &config.Config{
+				Jobs: []*config.Job{
+					{
+						Type:               config.JobTypeRDS,
+						BackupTag:          "backup",
+						RetentionTag:       "retention",
+						RetentionPolicyTag: "retention-policy",
+						MinKeepTag:         "min-keep",
+						Retention:          240 * time.Hour,
+						Datastore:          "s3://backups/snapshots",
+						HookTag:            "snapshot-hook",
+						HookTimeout:        5 * time.Minute,
+					},
+				},
+			},
+		},
+		{
+			// EBS jobs that only prune, e.g. in a vault account, don't
+			// need a datastore
+			input: `
+jobs:
+- type: ebs
+  disableSnapshot: true
+`,
+			want: &config.Config{
+				Jobs: []*config.Job{
+					{
+						Type:               config.JobTypeEBS,
+						BackupTag:          "backup",
+						RetentionTag:       "retention",
+						RetentionPolicyTag: "retention-policy",
+						MinKeepTag:         "min-keep",
+						Retention:          240 * time.Hour,
+						DisableSnapshot:    true,
+						HookTag:            "snapshot-hook",
+						HookTimeout:        5 * time.Minute,
+					},
+				},
+			},
+		},
+		{
+			input: `
+jobs:
+- type: ebs
+  dynamodbTable: Snapshots
+  disableSnapshot: true
+  vaultRole: arn:aws:iam::123456789012:role/vault
+`,
+			wantErr: true,
+		},
+		{
+			// EBS jobs need a table
+			input: `
+jobs:
+- type: ebs
+`,
+			wantErr: true,
+		},
+		{
+			input: `
+jobs:
+- type: efs
+`,
+			wantErr: true,
+		},
+		{
+			input: `
+jobs:
+- name: a
+  type: lightsail
+- name: a
+  type: lightsail-disk
+`,
+			wantErr: true,
+		},
+		{
+			// unknown keys are rejected
+			input: `
+jobs:
+- type: lightsail
+  retentoin: 24h
+`,
+			wantErr: true,
+		},
+		{
+			input: `
+jobs:
+- type: rds
+  dynamodbTable: Snapshots
+  groupByInstance: true
+`,
+			wantErr: true,
+		},
+		{
+			// hooks are only run for EBS volumes
+			input: `
+jobs:
+- type: lightsail
+  preSnapshotCommand: sync
+`,
+			wantErr: true,
+		},
+		{
+			input: `
+jobs:
+- type: ebs
+  dynamodbTable: Snapshots
+  hookTimeout: -1m
+`,
+			wantErr: true,
+		},
+		{
+			input:   `jobs: []`,
+			wantErr: true,
+		},
+		{
+			input: `
+jobs:
+- type: lightsail
+  schedule: "every night"
+`,
+			wantErr: true,
+		},
+		{
+			input: `
+jobs:
+- type: lightsail
+  pruneSchedule: "@daily"
+`,
+			wantErr: true,
+		},
+		{
+			input: `
+jobs:
+- type: lightsail
+  retentionPolicy: 7h
+`,
+			wantErr: true,
+		},
+		{
+			input: `
+jobs:
+- type: ebs
+  dynamodbTable: Snapshots
+  retentionPolicy: 7d
+`,
+			wantErr: true,
+		},
+		{
+			input: `
+jobs:
+- type: lightsail
+  minKeep: -1
+`,
+			wantErr: true,
+		},
+		{
+			// only EBS snapshots can be copied
+			input: `
+jobs:
+- type: lightsail
+  copyRegion: eu-west-1
+`,
+			wantErr: true,
+		},
+		{
+			input: `
+jobs:
+- type: ebs
+  region: eu-west-1
+  dynamodbTable: Snapshots
+  copyRegion: eu-west-1
+`,
+			wantErr: true,
+		},
+		{
+			input: `
+jobs:
+- type: ebs
+  dynamodbTable: Snapshots
+  copyKmsKeyId: alias/dr
+`,
+			wantErr: true,
+		},
+		{
+			input: `
+jobs:
+- type: ebs
+  dynamodbTable: Snapshots
+  vaultRetentionDays: 90
+`,
+			wantErr: true,
+		},
+		{
+			input: `
+jobs:
+- type: ebs
+  dynamodbTable: Snapshots
+  datastore: s3://backups
+`,
+			wantErr: true,
+		},
+		{
+			input: `
+jobs:
+- type: ebs
+  datastore: backups
+`,
+			wantErr: true,
+		},
+	}
+
+	for i, tc := range testcases {
+		got, err := config.Parse([]byte(tc.input))
+		if tc.wantErr {
+			if err == nil {
+				t.Errorf("%d: expected error, got none", i)
+			}
+			continue
+		}
+		if err != nil {
+			t.Fatalf("%d: parse: %+v", i, err)
+		}
+		if !cmp.Equal(tc.want, got) {
+			t.Errorf("%d: parse unexpected output: %s", i, cmp.Diff(tc.want, got))
+		}
+	}
+}
+
+func Test_ExpandRegions(t *testing.T) {
+	conf := &config.Config{
+		Jobs: []*config.Job{
+			{Type: config.JobTypeLightsail},
+			{Type: config.JobTypeLightsail, Region: "us-east-1"},
+			{Name: "named", Type: config.JobTypeLightsail},
+		},
+	}
+	conf.ExpandRegions([]string{"eu-central-1", "eu-west-1"})
+
+	want := []struct{ name, region string }{
+		{"lightsail-eu-central-1-0", "eu-central-1"},
+		{"lightsail-eu-west-1-0", "eu-west-1"},
+		{"lightsail-us-east-1-1", "us-east-1"},
+		{"named-eu-central-1", "eu-central-1"},
+		{"named-eu-west-1", "eu-west-1"},
+	}
+	if len(conf.Jobs) != len(want) {
+		t.Fatalf("expected %d jobs, got %d", len(want), len(conf.Jobs))
+	}
+	for i, w := range want {
+		if got := conf.Jobs[i]; got.Name != w.name || got.Region != w.region {
+			t.Errorf("%d: got name %q region %q, want %q %q", i, got.Name, got.Region, w.name, w.region)
+		}
+	}
+}
@@ -1,6 +1,8 @@
 package datastore
 
 import (
+	"context"
+	"fmt"
 	"time"
 )
 
@@ -25,7 +27,72 @@ type SnapshotInfo struct {
 
 // Datastore describes the interface needed by a storage for snapshot info
 type Datastore interface {
-	StoreSnapshotInfo(*SnapshotInfo) error
-	GetLatestSnapshotInfo(SnapshotResource) (*SnapshotInfo, error)
-	DeleteSnapshotInfo(*SnapshotInfo) error
+	StoreSnapshotInfo(context.Context, *SnapshotInfo) error
+	GetLatestSnapshotInfo(context.Context, SnapshotResource, ...LookupOpt) (*SnapshotInfo, error)
+	// GetSnapshotInfoAt returns the latest snapshot info of the resource
+	// created at or before the given time
+	GetSnapshotInfoAt(context.Context, SnapshotResource, time.Time, ...LookupOpt) (*SnapshotInfo, error)
+	// ListSnapshotInfos returns the snapshot infos of the resource created
+	// within [from, to], ordered from the oldest to the newest
+	ListSnapshotInfos(ctx context.Context, resource SnapshotResource, from, to time.Time) ([]*SnapshotInfo, error)
+	// ListResources returns all resources with snapshot infos
+	ListResources(context.Context) ([]SnapshotResource, error)
+	DeleteSnapshotInfo(context.Context, *SnapshotInfo) error
+}
+
+// Lookup restricts which snapshot infos are considered by the lookups of a
+// Datastore
+type Lookup struct {
+	// Labels that a snapshot info must have with the given values
+	Labels SnapshotLabels
+}
+
+// LookupOpt represents options that can be passed to the lookups of a
+// Datastore
+type LookupOpt func(*Lookup)
+
+// WithLabel only considers snapshot infos having the given label value, e.g.
+// a state label
+func WithLabel(key, value string) LookupOpt {
+	return func(l *Lookup) {
+		if l.Labels == nil {
+			l.Labels = make(SnapshotLabels)
+		}
+		l.Labels[key] = value
+	}
+}
+
+// NewLookup returns the lookup described by the given options
+func NewLookup(opts ...LookupOpt) *Lookup {
+	l := &Lookup{}
+	for _, o := range opts {
+		o(l)
+	}
+	return l
+}
+
+// Matches reports whether the given info is considered by the lookup
+func (l *Lookup) Matches(info *SnapshotInfo) bool {
+	for k, v := range l.Labels {
+		if info.Labels[k] != v {
+			return false
+		}
+	}
+	return true
+}
+
+// NotFoundError is returned by the lookups of a Datastore if no matching
+// snapshot info exists
+type NotFoundError struct {
+	Resource SnapshotResource
+}
+
+func (e *NotFoundError) Error() string {
+	return fmt.Sprintf("no snapshot info found for %s", e.Resource)
+}
+
+// IsNotFound reports whether the given error is a NotFoundError
+func IsNotFound(err error) bool {
+	_, ok := err.(*NotFoundError)
+	return ok
 }
@@ -1,11 +1,15 @@
 package dynamodb
 
 import (
+	"context"
 	"fmt"
+	"net/url"
 	"strconv"
+	"strings"
 	"time"
 
 	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/aws/client"
 	awsdynamodb "github.com/aws/aws-sdk-go/service/dynamodb"
 	"github.com/aws/aws-sdk-go/service/dynamodb/dynamodbattribute"
 	"github.com/prometheus/client_golang/prometheus"
@@ -17,6 +21,10 @@ import (
 const (
 	primaryKey = "snapshot_resource"
 	rangeKey   = "created_at"
+
+	// filteredPageSize is the number of items read per query page when
+	// filtering by labels
+	filteredPageSize = 25
 )
 
 var (
@@ -32,12 +40,31 @@ var (
 		Name: "dynamodb_deletes_total",
 		Help: "Total number of delete items sent to dynamodb",
 	})
+	scansSent = prometheus.NewCounter(prometheus.CounterOpts{
+		Name: "dynamodb_scans_total",
+		Help: "Total number of scans sent to dynamodb",
+	})
 )
 
 func init() {
 	prometheus.MustRegister(putItemsSent)
 	prometheus.MustRegister(queriesSent)
 	prometheus.MustRegister(deletesSent)
+	prometheus.MustRegister(scansSent)
+
+	datastore.Register("dynamodb", open)
+}
+
+// open creates the datastore given by a URL dynamodb://<table>
+func open(u *url.URL, p client.ConfigProvider, cfgs ...*aws.Config) (datastore.Datastore, error) {
+	if u.Host == "" {
+		return nil, fmt.Errorf("no table given in %s", u)
+	}
+	ds, err := New(awsdynamodb.New(p, cfgs...), u.Host)
+	if err != nil {
+		return nil, err
+	}
+	return ds, nil
 }
 
 // DynamoDB represents a datastore that uses dynamodb under the hood
@@ -55,6 +82,21 @@ type item struct {
 	Labels    map[string]string `dynamodbav:"labels"`
 }
 
+func (i *item) info() *datastore.SnapshotInfo {
+	return &datastore.SnapshotInfo{
+		Resource:  datastore.SnapshotResource(i.Resource),
+		ID:        datastore.SnapshotID(i.ID),
+		CreatedAt: time.Unix(i.CreatedAt, 0),
+		Labels:    datastore.SnapshotLabels(i.Labels),
+	}
+}
+
+func unixValue(t time.Time) *awsdynamodb.AttributeValue {
+	return &awsdynamodb.AttributeValue{
+		N: aws.String(strconv.FormatInt(t.Unix(), 10)),
+	}
+}
+
 // New creates a new DynamoDB-based datastore
 func New(client *awsdynamodb.DynamoDB, table string) (*DynamoDB, error) {
 	if client == nil {
@@ -71,7 +113,7 @@ func New(client *awsdynamodb.DynamoDB, table string) (*DynamoDB, error) {
 }
 
 // StoreSnapshotInfo stores the given snapshot info in the datastore
-func (d *DynamoDB) StoreSnapshotInfo(info *datastore.SnapshotInfo) error {
+func (d *DynamoDB) StoreSnapshotInfo(ctx context.Context, info *datastore.SnapshotInfo) error {
 	if info == nil {
 		return fmt.Errorf("info is nil")
 	}
@@ -94,7 +136,7 @@ func (d *DynamoDB) StoreSnapshotInfo(info *datastore.SnapshotInfo) error {
 	}
 
 	logger.Info("trying to put item into dynamodb table...")
-	_, err = d.client.PutItem(&awsdynamodb.PutItemInput{
+	_, err = d.client.PutItemWithContext(ctx, &awsdynamodb.PutItemInput{
 		TableName: aws.String(d.table),
 		Item:      av,
 	})
@@ -107,51 +149,181 @@ func (d *DynamoDB) StoreSnapshotInfo(info *datastore.SnapshotInfo) error {
 }
 
 // GetLatestSnapshotInfo returns the latest snapshot info found in the datastore
-func (d *DynamoDB) GetLatestSnapshotInfo(resource datastore.SnapshotResource) (*datastore.SnapshotInfo, error) {
+func (d *DynamoDB) GetLatestSnapshotInfo(ctx context.Context, resource datastore.SnapshotResource,
+	opts ...datastore.LookupOpt) (*datastore.SnapshotInfo, error) {
+
 	logger := d.logger.WithFields(log.Fields{
 		"resource": string(resource),
 	})
 	logger.Info("Trying to get latest snapshot info...")
-	out, err := d.client.Query(&awsdynamodb.QueryInput{
+	info, err := d.queryLatest(ctx, resource,
+		primaryKey+" = :snapshot_resource",
+		map[string]*awsdynamodb.AttributeValue{
+			":snapshot_resource": {
+				S: aws.String(string(resource)),
+			},
+		},
+		datastore.NewLookup(opts...),
+	)
+	if err != nil {
+		return nil, err
+	}
+	logger.Infof("found latest snapshot info... %+v ", info)
+	return info, nil
+}
+
+// GetSnapshotInfoAt returns the latest snapshot info of the resource created
+// at or before the given time
+func (d *DynamoDB) GetSnapshotInfoAt(ctx context.Context, resource datastore.SnapshotResource, at time.Time,
+	opts ...datastore.LookupOpt) (*datastore.SnapshotInfo, error) {
+
+	logger := d.logger.WithFields(log.Fields{
+		"resource": string(resource),
+		"at":       at,
+	})
+	logger.Info("Trying to get snapshot info...")
+	return d.queryLatest(ctx, resource,
+		primaryKey+" = :snapshot_resource and "+rangeKey+" <= :created_at",
+		map[string]*awsdynamodb.AttributeValue{
+			":snapshot_resource": {
+				S: aws.String(string(resource)),
+			},
+			":created_at": unixValue(at),
+		},
+		datastore.NewLookup(opts...),
+	)
+}
+
+// queryLatest returns the newest item matching the given key condition and
+// lookup. The query runs in descending order and stops at the first match, so
+// it only reads as many items as needed
+func (d *DynamoDB) queryLatest(ctx context.Context, resource datastore.SnapshotResource,
+	keyCondition string, values map[string]*awsdynamodb.AttributeValue,
+	lookup *datastore.Lookup) (*datastore.SnapshotInfo, error) {
+
+	in := &awsdynamodb.QueryInput{
+		TableName:                 aws.String(d.table),
+		KeyConditionExpression:    aws.String(keyCondition),
+		ExpressionAttributeValues: values,
+		ScanIndexForward:          aws.Bool(false),
+		Limit:                     aws.Int64(1),
+	}
+	if len(lookup.Labels) > 0 {
+		// The limit applies before filtering, so read larger pages
+		in.Limit = aws.Int64(filteredPageSize)
+		in.ExpressionAttributeNames = map[string]*string{"#labels": aws.String("labels")}
+		var conds []string
+		i := 0
+		for k, v := range lookup.Labels {
+			name, value := fmt.Sprintf("#l%d", i), fmt.Sprintf(":l%d", i)
+			in.ExpressionAttributeNames[name] = aws.String(k)
+			values[value] = &awsdynamodb.AttributeValue{S: aws.String(v)}
+			conds = append(conds, "#labels."+name+" = "+value)
+			i++
+		}
+		in.FilterExpression = aws.String(strings.Join(conds, " and "))
+	}
+
+	var (
+		result *datastore.SnapshotInfo
+		err    error
+	)
+	if qerr := d.client.QueryPagesWithContext(ctx, in, func(out *awsdynamodb.QueryOutput, last bool) bool {
+		queriesSent.Inc()
+		var items []*item
+		if err = dynamodbattribute.UnmarshalListOfMaps(out.Items, &items); err != nil {
+			return false
+		}
+		if len(items) > 0 {
+			result = items[0].info()
+			return false
+		}
+		// Without a filter the first page decides
+		return len(lookup.Labels) > 0
+	}); qerr != nil {
+		return nil, qerr
+	}
+	if err != nil {
+		return nil, err
+	}
+	if result == nil {
+		return nil, &datastore.NotFoundError{Resource: resource}
+	}
+	return result, nil
+}
+
+// ListSnapshotInfos returns the snapshot infos of the resource created within
+// [from, to], ordered from the oldest to the newest
+func (d *DynamoDB) ListSnapshotInfos(ctx context.Context, resource datastore.SnapshotResource, from, to time.Time) ([]*datastore.SnapshotInfo, error) {
+	var (
+		result []*datastore.SnapshotInfo
+		err    error
+	)
+	if perr := d.client.QueryPagesWithContext(ctx, &awsdynamodb.QueryInput{
 		TableName: aws.String(d.table),
 		KeyConditionExpression: aws.String(
-			primaryKey + " = :snapshot_resource and " + rangeKey + " >= :created_at",
+			primaryKey + " = :snapshot_resource and " + rangeKey + " between :from and :to",
 		),
 		ExpressionAttributeValues: map[string]*awsdynamodb.AttributeValue{
 			":snapshot_resource": {
 				S: aws.String(string(resource)),
 			},
-			":created_at": {
-				N: aws.String(strconv.FormatInt(time.Now().Add(-2*24*time.Hour).Unix(), 10)),
-			},
+			":from": unixValue(from),
+			":to":   unixValue(to),
 		},
-	})
-	queriesSent.Inc()
+	}, func(out *awsdynamodb.QueryOutput, last bool) bool {
+		queriesSent.Inc()
+		var items []*item
+		if err = dynamodbattribute.UnmarshalListOfMaps(out.Items, &items); err != nil {
+			return false
+		}
+		for _, i := range items {
+			result = append(result, i.info())
+		}
+		return true
+	}); perr != nil {
+		return nil, perr
+	}
 	if err != nil {
 		return nil, err
 	}
+	return result, nil
+}
 
-	var items []*item
-	if err := dynamodbattribute.UnmarshalListOfMaps(out.Items, &items); err != nil {
-		return nil, err
+// ListResources returns all resources with snapshot infos
+func (d *DynamoDB) ListResources(ctx context.Context) ([]datastore.SnapshotResource, error) {
+	var (
+		result []datastore.SnapshotResource
+		seen   = make(map[string]bool)
+		err    error
+	)
+	if serr := d.client.ScanPagesWithContext(ctx, &awsdynamodb.ScanInput{
+		TableName:            aws.String(d.table),
+		ProjectionExpression: aws.String(primaryKey),
+	}, func(out *awsdynamodb.ScanOutput, last bool) bool {
+		scansSent.Inc()
+		var items []*item
+		if err = dynamodbattribute.UnmarshalListOfMaps(out.Items, &items); err != nil {
+			return false
+		}
+		for _, i := range items {
+			if !seen[i.Resource] {
+				seen[i.Resource] = true
+				result = append(result, datastore.SnapshotResource(i.Resource))
+			}
+		}
+		return true
+	}); serr != nil {
+		return nil, serr
 	}
-
-	if len(items) <= 0 {
-		return nil, fmt.Errorf("No items found")
+	if err != nil {
+		return nil, err
 	}
-
-	last := items[len(items)-1]
-	logger.Infof("found latest snapshot info... %+v ", last)
-	return &datastore.SnapshotInfo{
-		Resource:  datastore.SnapshotResource(last.Resource),
-		ID:        datastore.SnapshotID(last.ID),
-		CreatedAt: time.Unix(last.CreatedAt, 0),
-		Labels:    datastore.SnapshotLabels(last.Labels),
-	}, nil
+	return result, nil
 }
 
 // DeleteSnapshotInfo deletes the given info from the database
-func (d *DynamoDB) DeleteSnapshotInfo(info *datastore.SnapshotInfo) error {
+func (d *DynamoDB) DeleteSnapshotInfo(ctx context.Context, info *datastore.SnapshotInfo) error {
 	if info == nil {
 		return fmt.Errorf("info is nil")
 	}
@@ -161,7 +333,7 @@ func (d *DynamoDB) DeleteSnapshotInfo(info *datastore.SnapshotInfo) error {
 	})
 	logger.Info("Trying to delete snapshot info...")
 
-	_, err := d.client.DeleteItem(&awsdynamodb.DeleteItemInput{
+	_, err := d.client.DeleteItemWithContext(ctx, &awsdynamodb.DeleteItemInput{
 		TableName: aws.String(d.table),
 		Key: map[string]*awsdynamodb.AttributeValue{
 			"snapshot_resource": &awsdynamodb.AttributeValue{
@@ -1,6 +1,7 @@
 package dynamodb_test
 
 import (
+	"context"
 	"fmt"
 	"os"
 	"testing"
@@ -210,13 +211,13 @@ func Test_StoreSnapshotAndGetLatest(t *testing.T) {
 	for i, tc := range testcases {
 		t.Run(fmt.Sprintf("%d", i), func(t *testing.T) {
 			for _, snap := range tc.snapshots {
-				if err := ddb.StoreSnapshotInfo(snap); err != nil {
+				if err := ddb.StoreSnapshotInfo(context.Background(), snap); err != nil {
 					t.Fatalf("storeSnapshotInfo: %+v", err)
 				}
 				time.Sleep(1 * time.Second)
 			}
 
-			got, err := ddb.GetLatestSnapshotInfo(datastore.SnapshotResource(tc.resource))
+			got, err := ddb.GetLatestSnapshotInfo(context.Background(), datastore.SnapshotResource(tc.resource))
 			if err != nil {
 				t.Fatalf("getLatestSnapshotInfo: %+v", err)
 			}
@@ -227,6 +228,112 @@ func Test_StoreSnapshotAndGetLatest(t *testing.T) {
 	}
 }
 
+func Test_ListAndLookupSnapshotInfos(t *testing.T) {
+
+	if ci := os.Getenv("CI"); ci != "" {
+		t.Skip()
+	}
+
+	now := time.Now().Truncate(time.Second)
+	snapshots := []*datastore.SnapshotInfo{
+		{
+			Resource:  "vol-123abcdefghi",
+			ID:        "snap-abc00000000",
+			CreatedAt: now.Add(-5 * 24 * time.Hour),
+		},
+		{
+			Resource:  "vol-123abcdefghi",
+			ID:        "snap-abc00000001",
+			CreatedAt: now.Add(-3 * 24 * time.Hour),
+		},
+		{
+			Resource:  "vol-123abcdefghi",
+			ID:        "snap-abc00000002",
+			CreatedAt: now.Add(-1 * time.Hour),
+		},
+		{
+			Resource:  "vol-456abdefghi",
+			ID:        "snap-abc00000003",
+			CreatedAt: now.Add(-2 * time.Hour),
+		},
+		{
+			Resource:  "vol-789abdefghi",
+			ID:        "snap-abc00000004",
+			CreatedAt: now.Add(-4 * 24 * time.Hour),
+			Labels:    datastore.SnapshotLabels{"state": "completed"},
+		},
+		{
+			Resource:  "vol-789abdefghi",
+			ID:        "snap-abc00000005",
+			CreatedAt: now.Add(-3 * 24 * time.Hour),
+			Labels:    datastore.SnapshotLabels{"state": "error"},
+		},
+	}
+
+	client := awsdynamodb.New(session.New(aws.NewConfig().WithRegion(region)))
+	testTable, err := createTestTable(client, testTablePrefix+"_list")
+	if err != nil {
+		t.Fatalf("createTestTable: %+v", err)
+	}
+	if err := waitForTable(client, testTable); err != nil {
+		t.Fatalf("waitForTable: %+v", err)
+	}
+	defer deleteTestTable(client, testTable)
+	ddb, err := dynamodb.New(client, testTable)
+	if err != nil {
+		t.Fatalf("new: %+v", err)
+	}
+
+	ctx := context.Background()
+	for _, snap := range snapshots {
+		if err := ddb.StoreSnapshotInfo(ctx, snap); err != nil {
+			t.Fatalf("storeSnapshotInfo: %+v", err)
+		}
+	}
+
+	got, err := ddb.ListSnapshotInfos(ctx, "vol-123abcdefghi", now.Add(-4*24*time.Hour), now)
+	if err != nil {
+		t.Fatalf("listSnapshotInfos: %+v", err)
+	}
+	if want := snapshots[1:3]; !cmp.Equal(want, got) {
+		t.Errorf("listSnapshotInfos unexpected output: %s", cmp.Diff(want, got))
+	}
+
+	at, err := ddb.GetSnapshotInfoAt(ctx, "vol-123abcdefghi", now.Add(-2*time.Hour))
+	if err != nil {
+		t.Fatalf("getSnapshotInfoAt: %+v", err)
+	}
+	if want := snapshots[1]; !cmp.Equal(want, at) {
+		t.Errorf("getSnapshotInfoAt unexpected output: %s", cmp.Diff(want, at))
+	}
+
+	latest, err := ddb.GetLatestSnapshotInfo(ctx, "vol-789abdefghi")
+	if err != nil {
+		t.Fatalf("getLatestSnapshotInfo: %+v", err)
+	}
+	if want := snapshots[5]; !cmp.Equal(want, latest) {
+		t.Errorf("getLatestSnapshotInfo unexpected output: %s", cmp.Diff(want, latest))
+	}
+	latest, err = ddb.GetLatestSnapshotInfo(ctx, "vol-789abdefghi", datastore.WithLabel("state", "completed"))
+	if err != nil {
+		t.Fatalf("getLatestSnapshotInfo: %+v", err)
+	}
+	if want := snapshots[4]; !cmp.Equal(want, latest) {
+		t.Errorf("getLatestSnapshotInfo unexpected output: %s", cmp.Diff(want, latest))
+	}
+	if _, err := ddb.GetLatestSnapshotInfo(ctx, "vol-000000000000"); !datastore.IsNotFound(err) {
+		t.Errorf("getLatestSnapshotInfo: expected not found error, got %+v", err)
+	}
+
+	resources, err := ddb.ListResources(ctx)
+	if err != nil {
+		t.Fatalf("listResources: %+v", err)
+	}
+	if want := 3; len(resources) != want {
+		t.Errorf("listResources: expected %d resources, got %v", want, resources)
+	}
+}
+
 func Test_DeleteSnapshotInfo(t *testing.T) {
 
 	if ci := os.Getenv("CI"); ci != "" {
@@ -343,13 +450,13 @@ func Test_DeleteSnapshotInfo(t *testing.T) {
 	for i, tc := range testcases {
 		t.Run(fmt.Sprintf("%d", i), func(t *testing.T) {
 			for _, snap := range tc.snapshots {
-				if err := ddb.StoreSnapshotInfo(snap); err != nil {
+				if err := ddb.StoreSnapshotInfo(context.Background(), snap); err != nil {
 					t.Fatalf("storeSnapshotInfo: %+v", err)
 				}
 				time.Sleep(1 * time.Second)
 			}
 
-			err := ddb.DeleteSnapshotInfo(tc.toDelete)
+			err := ddb.DeleteSnapshotInfo(context.Background(), tc.toDelete)
 			if err != nil {
 				t.Fatalf("deleteSnapshotInfo: %+v", err)
 			}
@@ -0,0 +1,353 @@
+// Package file implements a datastore that keeps the snapshot infos in a
+// local file, e.g. for single hosts and for testing without AWS
+package file
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/url"
+	"os"
+	"path/filepath"
+	"sort"
+	"syscall"
+	"time"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/aws/client"
+	log "github.com/sirupsen/logrus"
+
+	"github.com/grid-x/aws-auto-snapshot/pkg/datastore"
+)
+
+func init() {
+	datastore.Register("file", open)
+}
+
+// open creates the datastore given by a URL file://<path>, e.g.
+// file:///var/lib/snapshotter/meta.db
+func open(u *url.URL, _ client.ConfigProvider, _ ...*aws.Config) (datastore.Datastore, error) {
+	ds, err := New(u.Host + u.Path)
+	if err != nil {
+		return nil, err
+	}
+	return ds, nil
+}
+
+// File represents a datastore that stores the snapshot infos as JSON lines in
+// a local file. Every change rewrites the file atomically, and concurrent
+// access, also by multiple processes, is serialized by locking a lock file
+// next to it
+type File struct {
+	path string
+
+	logger log.FieldLogger
+}
+
+type record struct {
+	Resource  string            `json:"resource"`
+	ID        string            `json:"id"`
+	CreatedAt time.Time         `json:"createdAt"`
+	Labels    map[string]string `json:"labels,omitempty"`
+}
+
+func (r *record) info() *datastore.SnapshotInfo {
+	return &datastore.SnapshotInfo{
+		Resource:  datastore.SnapshotResource(r.Resource),
+		ID:        datastore.SnapshotID(r.ID),
+		CreatedAt: r.CreatedAt,
+		Labels:    datastore.SnapshotLabels(r.Labels),
+	}
+}
+
+// sameKey reports whether the record has the key of the given info. Like the
+// DynamoDB datastore, records are identified by their resource and creation
+// time in seconds
+func (r *record) sameKey(info *datastore.SnapshotInfo) bool {
+	return r.Resource == string(info.Resource) && r.CreatedAt.Unix() == info.CreatedAt.Unix()
+}
+
+// New creates a new file-based datastore using the file at the given path.
+// The file is created on the first write
+func New(path string) (*File, error) {
+	if path == "" {
+		return nil, fmt.Errorf("path is empty")
+	}
+	if fi, err := os.Stat(filepath.Dir(path)); err != nil {
+		return nil, err
+	} else if !fi.IsDir() {
+		return nil, fmt.Errorf("%s is not a directory", filepath.Dir(path))
+	}
+	return &File{
+		path: path,
+		logger: log.New().WithFields(log.Fields{
+			"component": "datastore",
+			"datastore": "file",
+			"path":      path,
+		}),
+	}, nil
+}
+
+// lock locks the lock file of the datastore, exclusively for writing, and
+// returns a function to unlock it again
+func (f *File) lock(exclusive bool) (func(), error) {
+	lf, err := os.OpenFile(f.path+".lock", os.O_CREATE|os.O_RDWR, 0600)
+	if err != nil {
+		return nil, err
+	}
+	how := syscall.LOCK_SH
+	if exclusive {
+		how = syscall.LOCK_EX
+	}
+	if err := syscall.Flock(int(lf.Fd()), how); err != nil {
+		lf.Close()
+		return nil, fmt.Errorf("cannot lock %s: %+v", lf.Name(), err)
+	}
+	return func() {
+		syscall.Flock(int(lf.Fd()), syscall.LOCK_UN)
+		lf.Close()
+	}, nil
+}
+
+// read returns all records, which must be locked by the caller
+func (f *File) read() ([]*record, error) {
+	in, err := os.Open(f.path)
+	if os.IsNotExist(err) {
+		return nil, nil
+	} else if err != nil {
+		return nil, err
+	}
+	defer in.Close()
+
+	var records []*record
+	dec := json.NewDecoder(in)
+	for {
+		var r record
+		if err := dec.Decode(&r); err == io.EOF {
+			break
+		} else if err != nil {
+			return nil, fmt.Errorf("cannot decode %s: %+v", f.path, err)
+		}
+		records = append(records, &r)
+	}
+	return records, nil
+}
+
+// write atomically replaces the file by the given records, which must be
+// locked exclusively by the caller
+func (f *File) write(records []*record) error {
+	sort.SliceStable(records, func(i, j int) bool {
+		if records[i].Resource != records[j].Resource {
+			return records[i].Resource < records[j].Resource
+		}
+		return records[i].CreatedAt.Before(records[j].CreatedAt)
+	})
+
+	tmp, err := ioutil.TempFile(filepath.Dir(f.path), filepath.Base(f.path)+".tmp")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(tmp.Name())
+
+	enc := json.NewEncoder(tmp)
+	for _, r := range records {
+		if err := enc.Encode(r); err != nil {
+			tmp.Close()
+			return err
+		}
+	}
+	if err := tmp.Sync(); err != nil {
+		tmp.Close()
+		return err
+	}
+	if err := tmp.Close(); err != nil {
+		return err
+	}
+	return os.Rename(tmp.Name(), f.path)
+}
+
+// update applies the given change to the records while holding the lock
+func (f *File) update(ctx context.Context, change func([]*record) []*record) error {
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+	unlock, err := f.lock(true)
+	if err != nil {
+		return err
+	}
+	defer unlock()
+
+	records, err := f.read()
+	if err != nil {
+		return err
+	}
+	return f.write(change(records))
+}
+
+// records returns the records of the given resource ordered from the oldest to
+// the newest
+func (f *File) records(ctx context.Context, resource datastore.SnapshotResource) ([]*record, error) {
+	if err := ctx.Err(); err != nil {
+		return nil, err
+	}
+	unlock, err := f.lock(false)
+	if err != nil {
+		return nil, err
+	}
+	defer unlock()
+
+	records, err := f.read()
+	if err != nil {
+		return nil, err
+	}
+	var result []*record
+	for _, r := range records {
+		if r.Resource == string(resource) {
+			result = append(result, r)
+		}
+	}
+	sort.SliceStable(result, func(i, j int) bool {
+		return result[i].CreatedAt.Before(result[j].CreatedAt)
+	})
+	return result, nil
+}
+
+// StoreSnapshotInfo stores the given snapshot info in the datastore,
+// replacing an info of the same resource created at the same time
+func (f *File) StoreSnapshotInfo(ctx context.Context, info *datastore.SnapshotInfo) error {
+	if info == nil {
+		return fmt.Errorf("info is nil")
+	}
+	logger := f.logger.WithFields(log.Fields{
+		"resource":    string(info.Resource),
+		"snapshot-id": string(info.ID),
+	})
+	logger.Info("trying to store snapshot info...")
+
+	if err := f.update(ctx, func(records []*record) []*record {
+		var result []*record
+		for _, r := range records {
+			if !r.sameKey(info) {
+				result = append(result, r)
+			}
+		}
+		return append(result, &record{
+			Resource:  string(info.Resource),
+			ID:        string(info.ID),
+			CreatedAt: info.CreatedAt,
+			Labels:    (map[string]string)(info.Labels),
+		})
+	}); err != nil {
+		return err
+	}
+	logger.Info("successfully stored snapshot info")
+	return nil
+}
+
+// latest returns the newest snapshot info of the resource created at or
+// before the given time, if any, that matches the lookup
+func (f *File) latest(ctx context.Context, resource datastore.SnapshotResource, at time.Time,
+	lookup *datastore.Lookup) (*datastore.SnapshotInfo, error) {
+
+	records, err := f.records(ctx, resource)
+	if err != nil {
+		return nil, err
+	}
+	for i := len(records) - 1; i >= 0; i-- {
+		if !at.IsZero() && records[i].CreatedAt.After(at) {
+			continue
+		}
+		if info := records[i].info(); lookup.Matches(info) {
+			return info, nil
+		}
+	}
+	return nil, &datastore.NotFoundError{Resource: resource}
+}
+
+// GetLatestSnapshotInfo returns the latest snapshot info found in the datastore
+func (f *File) GetLatestSnapshotInfo(ctx context.Context, resource datastore.SnapshotResource,
+	opts ...datastore.LookupOpt) (*datastore.SnapshotInfo, error) {
+
+	f.logger.WithField("resource", string(resource)).Info("Trying to get latest snapshot info...")
+	return f.latest(ctx, resource, time.Time{}, datastore.NewLookup(opts...))
+}
+
+// GetSnapshotInfoAt returns the latest snapshot info of the resource created
+// at or before the given time
+func (f *File) GetSnapshotInfoAt(ctx context.Context, resource datastore.SnapshotResource, at time.Time,
+	opts ...datastore.LookupOpt) (*datastore.SnapshotInfo, error) {
+
+	f.logger.WithFields(log.Fields{
+		"resource": string(resource),
+		"at":       at,
+	}).Info("Trying to get snapshot info...")
+	return f.latest(ctx, resource, at, datastore.NewLookup(opts...))
+}
+
+// ListSnapshotInfos returns the snapshot infos of the resource created within
+// [from, to], ordered from the oldest to the newest
+func (f *File) ListSnapshotInfos(ctx context.Context, resource datastore.SnapshotResource,
+	from, to time.Time) ([]*datastore.SnapshotInfo, error) {
+
+	records, err := f.records(ctx, resource)
+	if err != nil {
+		return nil, err
+	}
+	var result []*datastore.SnapshotInfo
+	for _, r := range records {
+		if r.CreatedAt.Before(from) || r.CreatedAt.After(to) {
+			continue
+		}
+		result = append(result, r.info())
+	}
+	return result, nil
+}
+
+// ListResources returns all resources with snapshot infos
+func (f *File) ListResources(ctx context.Context) ([]datastore.SnapshotResource, error) {
+	if err := ctx.Err(); err != nil {
+		return nil, err
+	}
+	unlock, err := f.lock(false)
+	if err != nil {
+		return nil, err
+	}
+	defer unlock()
+
+	records, err := f.read()
+	if err != nil {
+		return nil, err
+	}
+	var result []datastore.SnapshotResource
+	seen := make(map[string]bool)
+	for _, r := range records {
+		if !seen[r.Resource] {
+			seen[r.Resource] = true
+			result = append(result, datastore.SnapshotResource(r.Resource))
+		}
+	}
+	return result, nil
+}
+
+// DeleteSnapshotInfo deletes the given info from the datastore
+func (f *File) DeleteSnapshotInfo(ctx context.Context, info *datastore.SnapshotInfo) error {
+	if info == nil {
+		return fmt.Errorf("info is nil")
+	}
+	f.logger.WithFields(log.Fields{
+		"resource":    string(info.Resource),
+		"snapshot-id": string(info.ID),
+	}).Info("Trying to delete snapshot info...")
+
+	return f.update(ctx, func(records []*record) []*record {
+		var result []*record
+		for _, r := range records {
+			if !r.sameKey(info) {
+				result = append(result, r)
+			}
+		}
+		return result
+	})
+}
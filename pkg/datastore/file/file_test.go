@@ -0,0 +1,172 @@
+package file_test
+
+import (
+	"context"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/google/go-cmp/cmp"
+
+	"github.com/grid-x/aws-auto-snapshot/pkg/datastore"
+	"github.com/grid-x/aws-auto-snapshot/pkg/datastore/file"
+)
+
+func newTestFile(t *testing.T) (*file.File, func()) {
+	dir, err := ioutil.TempDir("", "snapshotter")
+	if err != nil {
+		t.Fatalf("tempDir: %+v", err)
+	}
+	f, err := file.New(filepath.Join(dir, "meta.db"))
+	if err != nil {
+		os.RemoveAll(dir)
+		t.Fatalf("new: %+v", err)
+	}
+	return f, func() { os.RemoveAll(dir) }
+}
+
+func Test_StoreAndLookupSnapshotInfos(t *testing.T) {
+	f, cleanup := newTestFile(t)
+	defer cleanup()
+
+	now := time.Now().Truncate(time.Second)
+	snapshots := []*datastore.SnapshotInfo{
+		{
+			Resource:  "vol-123abcdefghi",
+			ID:        "snap-abc00000000",
+			CreatedAt: now.Add(-5 * 24 * time.Hour).UTC(),
+			Labels:    datastore.SnapshotLabels{"state": "completed"},
+		},
+		{
+			Resource:  "vol-123abcdefghi",
+			ID:        "snap-abc00000001",
+			CreatedAt: now.Add(-3 * 24 * time.Hour).UTC(),
+			Labels:    datastore.SnapshotLabels{"state": "error"},
+		},
+		{
+			Resource:  "vol-456abdefghi",
+			ID:        "snap-abc00000002",
+			CreatedAt: now.Add(-1 * time.Hour).UTC(),
+		},
+	}
+
+	ctx := context.Background()
+	for _, snap := range snapshots {
+		if err := f.StoreSnapshotInfo(ctx, snap); err != nil {
+			t.Fatalf("storeSnapshotInfo: %+v", err)
+		}
+	}
+
+	latest, err := f.GetLatestSnapshotInfo(ctx, "vol-123abcdefghi")
+	if err != nil {
+		t.Fatalf("getLatestSnapshotInfo: %+v", err)
+	}
+	if want := snapshots[1]; !cmp.Equal(want, latest) {
+		t.Errorf("getLatestSnapshotInfo unexpected output: %s", cmp.Diff(want, latest))
+	}
+
+	latest, err = f.GetLatestSnapshotInfo(ctx, "vol-123abcdefghi", datastore.WithLabel("state", "completed"))
+	if err != nil {
+		t.Fatalf("getLatestSnapshotInfo: %+v", err)
+	}
+	if want := snapshots[0]; !cmp.Equal(want, latest) {
+		t.Errorf("getLatestSnapshotInfo unexpected output: %s", cmp.Diff(want, latest))
+	}
+
+	at, err := f.GetSnapshotInfoAt(ctx, "vol-123abcdefghi", now.Add(-4*24*time.Hour))
+	if err != nil {
+		t.Fatalf("getSnapshotInfoAt: %+v", err)
+	}
+	if want := snapshots[0]; !cmp.Equal(want, at) {
+		t.Errorf("getSnapshotInfoAt unexpected output: %s", cmp.Diff(want, at))
+	}
+
+	if _, err := f.GetLatestSnapshotInfo(ctx, "vol-000000000000"); !datastore.IsNotFound(err) {
+		t.Errorf("getLatestSnapshotInfo: expected not found error, got %+v", err)
+	}
+
+	list, err := f.ListSnapshotInfos(ctx, "vol-123abcdefghi", now.Add(-4*24*time.Hour), now)
+	if err != nil {
+		t.Fatalf("listSnapshotInfos: %+v", err)
+	}
+	if want := snapshots[1:2]; !cmp.Equal(want, list) {
+		t.Errorf("listSnapshotInfos unexpected output: %s", cmp.Diff(want, list))
+	}
+
+	resources, err := f.ListResources(ctx)
+	if err != nil {
+		t.Fatalf("listResources: %+v", err)
+	}
+	want := []datastore.SnapshotResource{"vol-123abcdefghi", "vol-456abdefghi"}
+	if !cmp.Equal(want, resources) {
+		t.Errorf("listResources unexpected output: %s", cmp.Diff(want, resources))
+	}
+
+	if err := f.DeleteSnapshotInfo(ctx, snapshots[1]); err != nil {
+		t.Fatalf("deleteSnapshotInfo: %+v", err)
+	}
+	latest, err = f.GetLatestSnapshotInfo(ctx, "vol-123abcdefghi")
+	if err != nil {
+		t.Fatalf("getLatestSnapshotInfo: %+v", err)
+	}
+	if want := snapshots[0]; !cmp.Equal(want, latest) {
+		t.Errorf("getLatestSnapshotInfo after delete unexpected output: %s", cmp.Diff(want, latest))
+	}
+}
+
+func Test_ConcurrentStore(t *testing.T) {
+	f, cleanup := newTestFile(t)
+	defer cleanup()
+
+	ctx := context.Background()
+	now := time.Now().Truncate(time.Second)
+	const n = 20
+
+	var wg sync.WaitGroup
+	for i := 0; i < n; i++ {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			if err := f.StoreSnapshotInfo(ctx, &datastore.SnapshotInfo{
+				Resource:  "vol-123abcdefghi",
+				ID:        datastore.SnapshotID(fmt.Sprintf("snap-%d", i)),
+				CreatedAt: now.Add(time.Duration(-i) * time.Hour),
+			}); err != nil {
+				t.Errorf("storeSnapshotInfo: %+v", err)
+			}
+		}(i)
+	}
+	wg.Wait()
+
+	list, err := f.ListSnapshotInfos(ctx, "vol-123abcdefghi", time.Time{}, now)
+	if err != nil {
+		t.Fatalf("listSnapshotInfos: %+v", err)
+	}
+	if len(list) != n {
+		t.Errorf("expected %d snapshot infos, got %d", n, len(list))
+	}
+}
+
+func Test_Open(t *testing.T) {
+	dir, err := ioutil.TempDir("", "snapshotter")
+	if err != nil {
+		t.Fatalf("tempDir: %+v", err)
+	}
+	defer os.RemoveAll(dir)
+
+	ds, err := datastore.Open("file://"+filepath.Join(dir, "meta.db"), nil)
+	if err != nil {
+		t.Fatalf("open: %+v", err)
+	}
+	if _, ok := ds.(*file.File); !ok {
+		t.Errorf("expected a file datastore, got %T", ds)
+	}
+
+	if _, err := datastore.Open("unknown://table", nil); err == nil {
+		t.Error("expected error for unknown scheme, got none")
+	}
+}
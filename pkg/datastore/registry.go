@@ -0,0 +1,72 @@
+package datastore
+
+import (
+	"fmt"
+	"net/url"
+	"sort"
+	"sync"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/aws/client"
+	"github.com/aws/aws-sdk-go/aws/credentials/stscreds"
+)
+
+// Factory creates a datastore given by a URL. AWS based datastores create
+// their clients from the given provider and configs
+type Factory func(u *url.URL, p client.ConfigProvider, cfgs ...*aws.Config) (Datastore, error)
+
+var (
+	factoriesMu sync.RWMutex
+	factories   = make(map[string]Factory)
+)
+
+// Register makes a datastore available under the given URL scheme. It is
+// meant to be called from the init function of the datastore's package and
+// panics if the scheme is already registered
+func Register(scheme string, f Factory) {
+	factoriesMu.Lock()
+	defer factoriesMu.Unlock()
+	if _, ok := factories[scheme]; ok {
+		panic(fmt.Sprintf("datastore: scheme %q registered twice", scheme))
+	}
+	factories[scheme] = f
+}
+
+// Schemes returns the registered URL schemes
+func Schemes() []string {
+	factoriesMu.RLock()
+	defer factoriesMu.RUnlock()
+	var result []string
+	for s := range factories {
+		result = append(result, s)
+	}
+	sort.Strings(result)
+	return result
+}
+
+// Open creates the datastore given by a URL such as dynamodb://table,
+// s3://bucket/prefix or file:///path/to/file. The query parameters role and
+// region set the role to assume and the region for AWS based datastores, e.g.
+// dynamodb://table?role=arn:aws:iam::123456789012:role/snapshotter
+func Open(rawURL string, p client.ConfigProvider, cfgs ...*aws.Config) (Datastore, error) {
+	u, err := url.Parse(rawURL)
+	if err != nil {
+		return nil, fmt.Errorf("invalid datastore URL %q: %+v", rawURL, err)
+	}
+
+	factoriesMu.RLock()
+	f, ok := factories[u.Scheme]
+	factoriesMu.RUnlock()
+	if !ok {
+		return nil, fmt.Errorf("unsupported datastore %q, supported schemes are %v", rawURL, Schemes())
+	}
+
+	q := u.Query()
+	if role := q.Get("role"); role != "" {
+		cfgs = append(cfgs, aws.NewConfig().WithCredentials(stscreds.NewCredentials(p, role)))
+	}
+	if region := q.Get("region"); region != "" {
+		cfgs = append(cfgs, aws.NewConfig().WithRegion(region))
+	}
+	return f(u, p, cfgs...)
+}
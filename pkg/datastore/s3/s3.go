@@ -0,0 +1,366 @@
+// Package s3 implements a datastore that keeps each snapshot info as a JSON
+// object in an S3 bucket
+package s3
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/url"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/aws/client"
+	awss3 "github.com/aws/aws-sdk-go/service/s3"
+	"github.com/prometheus/client_golang/prometheus"
+	log "github.com/sirupsen/logrus"
+
+	"github.com/grid-x/aws-auto-snapshot/pkg/datastore"
+)
+
+var (
+	putObjectRequests = prometheus.NewCounter(prometheus.CounterOpts{
+		Name: "s3_datastore_put_object_requests_total",
+		Help: "Total number of put object requests sent to S3",
+	})
+	getObjectRequests = prometheus.NewCounter(prometheus.CounterOpts{
+		Name: "s3_datastore_get_object_requests_total",
+		Help: "Total number of get object requests sent to S3",
+	})
+	listObjectsRequests = prometheus.NewCounter(prometheus.CounterOpts{
+		Name: "s3_datastore_list_objects_requests_total",
+		Help: "Total number of list objects requests sent to S3",
+	})
+	deleteObjectRequests = prometheus.NewCounter(prometheus.CounterOpts{
+		Name: "s3_datastore_delete_object_requests_total",
+		Help: "Total number of delete object requests sent to S3",
+	})
+)
+
+func init() {
+	prometheus.MustRegister(putObjectRequests)
+	prometheus.MustRegister(getObjectRequests)
+	prometheus.MustRegister(listObjectsRequests)
+	prometheus.MustRegister(deleteObjectRequests)
+
+	datastore.Register("s3", open)
+}
+
+// open creates the datastore given by a URL s3://<bucket>/<prefix>
+func open(u *url.URL, p client.ConfigProvider, cfgs ...*aws.Config) (datastore.Datastore, error) {
+	ds, err := New(awss3.New(p, cfgs...), u.Host, u.Path)
+	if err != nil {
+		return nil, err
+	}
+	return ds, nil
+}
+
+// S3 represents a datastore that stores each snapshot info as an object
+// <prefix>/<resource>/<created_at>-<id>.json, where created_at is the zero
+// padded unix timestamp, so the keys of a resource sort by creation time.
+// Resource and ID are path escaped, so each is a single segment of the key
+type S3 struct {
+	bucket string
+	prefix string
+	client *awss3.S3
+
+	logger log.FieldLogger
+}
+
+type object struct {
+	Resource  string            `json:"resource"`
+	ID        string            `json:"id"`
+	CreatedAt time.Time         `json:"createdAt"`
+	Labels    map[string]string `json:"labels,omitempty"`
+}
+
+// key is the key of a snapshot info object and the creation time and ID
+// encoded in it
+type key struct {
+	name      string
+	createdAt time.Time
+	id        string
+}
+
+// New creates a new S3-based datastore using the given bucket and key prefix
+func New(client *awss3.S3, bucket, prefix string) (*S3, error) {
+	if client == nil {
+		return nil, fmt.Errorf("client is nil")
+	}
+	if bucket == "" {
+		return nil, fmt.Errorf("bucket is empty")
+	}
+	return &S3{
+		bucket: bucket,
+		prefix: strings.Trim(prefix, "/"),
+		client: client,
+		logger: log.New().WithFields(log.Fields{
+			"component": "datastore",
+			"datastore": "s3",
+			"bucket":    bucket,
+		}),
+	}, nil
+}
+
+// rootPrefix is the prefix of the keys of all resources
+func (s *S3) rootPrefix() string {
+	if s.prefix == "" {
+		return ""
+	}
+	return s.prefix + "/"
+}
+
+func (s *S3) resourcePrefix(resource datastore.SnapshotResource) string {
+	return s.rootPrefix() + url.PathEscape(string(resource)) + "/"
+}
+
+func (s *S3) objectKey(info *datastore.SnapshotInfo) string {
+	return s.resourcePrefix(info.Resource) +
+		fmt.Sprintf("%012d-%s.json", info.CreatedAt.Unix(), url.PathEscape(string(info.ID)))
+}
+
+// parseKey returns the key of the given object of a resource with the given
+// key prefix, if it is a snapshot info object
+func parseKey(prefix, name string) (key, bool) {
+	base := strings.TrimSuffix(strings.TrimPrefix(name, prefix), ".json")
+	if base == name || strings.Contains(base, "/") {
+		return key{}, false
+	}
+	i := strings.Index(base, "-")
+	if i < 0 {
+		return key{}, false
+	}
+	sec, err := strconv.ParseInt(base[:i], 10, 64)
+	if err != nil {
+		return key{}, false
+	}
+	id, err := url.PathUnescape(base[i+1:])
+	if err != nil || id == "" {
+		return key{}, false
+	}
+	return key{name: name, createdAt: time.Unix(sec, 0), id: id}, true
+}
+
+// StoreSnapshotInfo stores the given snapshot info in the datastore
+func (s *S3) StoreSnapshotInfo(ctx context.Context, info *datastore.SnapshotInfo) error {
+	if info == nil {
+		return fmt.Errorf("info is nil")
+	}
+
+	body, err := json.Marshal(&object{
+		Resource:  string(info.Resource),
+		ID:        string(info.ID),
+		CreatedAt: info.CreatedAt,
+		Labels:    (map[string]string)(info.Labels),
+	})
+	if err != nil {
+		return err
+	}
+
+	logger := s.logger.WithFields(log.Fields{
+		"resource":    string(info.Resource),
+		"snapshot-id": string(info.ID),
+	})
+	logger.Info("trying to put snapshot info into bucket...")
+	_, err = s.client.PutObjectWithContext(ctx, &awss3.PutObjectInput{
+		Bucket:      aws.String(s.bucket),
+		Key:         aws.String(s.objectKey(info)),
+		Body:        bytes.NewReader(body),
+		ContentType: aws.String("application/json"),
+	})
+	putObjectRequests.Inc()
+	if err != nil {
+		return err
+	}
+	logger.Info("successfully added snapshot info to bucket")
+	return nil
+}
+
+// keys returns the keys of all snapshot infos of the given resource ordered
+// from the oldest to the newest
+func (s *S3) keys(ctx context.Context, resource datastore.SnapshotResource) ([]key, error) {
+	var result []key
+	prefix := s.resourcePrefix(resource)
+	if err := s.client.ListObjectsV2PagesWithContext(ctx, &awss3.ListObjectsV2Input{
+		Bucket: aws.String(s.bucket),
+		Prefix: aws.String(prefix),
+	}, func(out *awss3.ListObjectsV2Output, last bool) bool {
+		listObjectsRequests.Inc()
+		for _, obj := range out.Contents {
+			if k, ok := parseKey(prefix, aws.StringValue(obj.Key)); ok {
+				result = append(result, k)
+			}
+		}
+		return true
+	}); err != nil {
+		return nil, err
+	}
+	sort.SliceStable(result, func(i, j int) bool {
+		if !result[i].createdAt.Equal(result[j].createdAt) {
+			return result[i].createdAt.Before(result[j].createdAt)
+		}
+		return result[i].id < result[j].id
+	})
+	return result, nil
+}
+
+func (s *S3) get(ctx context.Context, k key) (*datastore.SnapshotInfo, error) {
+	out, err := s.client.GetObjectWithContext(ctx, &awss3.GetObjectInput{
+		Bucket: aws.String(s.bucket),
+		Key:    aws.String(k.name),
+	})
+	getObjectRequests.Inc()
+	if err != nil {
+		return nil, err
+	}
+	defer out.Body.Close()
+
+	var obj object
+	if err := json.NewDecoder(out.Body).Decode(&obj); err != nil {
+		return nil, fmt.Errorf("cannot decode %s: %+v", k.name, err)
+	}
+	return &datastore.SnapshotInfo{
+		Resource:  datastore.SnapshotResource(obj.Resource),
+		ID:        datastore.SnapshotID(obj.ID),
+		CreatedAt: obj.CreatedAt,
+		Labels:    datastore.SnapshotLabels(obj.Labels),
+	}, nil
+}
+
+// latest returns the newest snapshot info of the resource created at or
+// before the given time, if any, that matches the lookup
+func (s *S3) latest(ctx context.Context, resource datastore.SnapshotResource, at time.Time,
+	lookup *datastore.Lookup) (*datastore.SnapshotInfo, error) {
+
+	keys, err := s.keys(ctx, resource)
+	if err != nil {
+		return nil, err
+	}
+	var found *datastore.SnapshotInfo
+	for i := len(keys) - 1; i >= 0; i-- {
+		// keys only have a precision of seconds, hence all infos
+		// within the second of the first match are considered
+		if found != nil && keys[i].createdAt.Before(found.CreatedAt.Truncate(time.Second)) {
+			break
+		}
+		if !at.IsZero() && keys[i].createdAt.After(at) {
+			continue
+		}
+		info, err := s.get(ctx, keys[i])
+		if err != nil {
+			return nil, err
+		}
+		if !at.IsZero() && info.CreatedAt.After(at) {
+			continue
+		}
+		if lookup.Matches(info) && (found == nil || info.CreatedAt.After(found.CreatedAt)) {
+			found = info
+		}
+	}
+	if found == nil {
+		return nil, &datastore.NotFoundError{Resource: resource}
+	}
+	return found, nil
+}
+
+// GetLatestSnapshotInfo returns the latest snapshot info found in the datastore
+func (s *S3) GetLatestSnapshotInfo(ctx context.Context, resource datastore.SnapshotResource,
+	opts ...datastore.LookupOpt) (*datastore.SnapshotInfo, error) {
+
+	s.logger.WithField("resource", string(resource)).Info("Trying to get latest snapshot info...")
+	return s.latest(ctx, resource, time.Time{}, datastore.NewLookup(opts...))
+}
+
+// GetSnapshotInfoAt returns the latest snapshot info of the resource created
+// at or before the given time
+func (s *S3) GetSnapshotInfoAt(ctx context.Context, resource datastore.SnapshotResource, at time.Time,
+	opts ...datastore.LookupOpt) (*datastore.SnapshotInfo, error) {
+
+	s.logger.WithFields(log.Fields{
+		"resource": string(resource),
+		"at":       at,
+	}).Info("Trying to get snapshot info...")
+	return s.latest(ctx, resource, at, datastore.NewLookup(opts...))
+}
+
+// ListSnapshotInfos returns the snapshot infos of the resource created within
+// [from, to], ordered from the oldest to the newest
+func (s *S3) ListSnapshotInfos(ctx context.Context, resource datastore.SnapshotResource,
+	from, to time.Time) ([]*datastore.SnapshotInfo, error) {
+
+	keys, err := s.keys(ctx, resource)
+	if err != nil {
+		return nil, err
+	}
+	var result []*datastore.SnapshotInfo
+	for _, k := range keys {
+		// keys only have a precision of seconds, hence the exact
+		// creation time is checked once the info is fetched
+		if k.createdAt.Before(from.Truncate(time.Second)) || k.createdAt.After(to) {
+			continue
+		}
+		info, err := s.get(ctx, k)
+		if err != nil {
+			return nil, err
+		}
+		if info.CreatedAt.Before(from) || info.CreatedAt.After(to) {
+			continue
+		}
+		result = append(result, info)
+	}
+	// The keys of infos created within the same second are ordered by ID
+	sort.SliceStable(result, func(i, j int) bool {
+		return result[i].CreatedAt.Before(result[j].CreatedAt)
+	})
+	return result, nil
+}
+
+// ListResources returns all resources with snapshot infos
+func (s *S3) ListResources(ctx context.Context) ([]datastore.SnapshotResource, error) {
+	prefix := s.rootPrefix()
+
+	var result []datastore.SnapshotResource
+	if err := s.client.ListObjectsV2PagesWithContext(ctx, &awss3.ListObjectsV2Input{
+		Bucket:    aws.String(s.bucket),
+		Prefix:    aws.String(prefix),
+		Delimiter: aws.String("/"),
+	}, func(out *awss3.ListObjectsV2Output, last bool) bool {
+		listObjectsRequests.Inc()
+		for _, p := range out.CommonPrefixes {
+			r := strings.TrimSuffix(strings.TrimPrefix(aws.StringValue(p.Prefix), prefix), "/")
+			resource, err := url.PathUnescape(r)
+			if err != nil {
+				s.logger.Warnf("Skipping invalid resource %q: %+v", r, err)
+				continue
+			}
+			result = append(result, datastore.SnapshotResource(resource))
+		}
+		return true
+	}); err != nil {
+		return nil, err
+	}
+	return result, nil
+}
+
+// DeleteSnapshotInfo deletes the given info from the bucket
+func (s *S3) DeleteSnapshotInfo(ctx context.Context, info *datastore.SnapshotInfo) error {
+	if info == nil {
+		return fmt.Errorf("info is nil")
+	}
+	logger := s.logger.WithFields(log.Fields{
+		"resource":    string(info.Resource),
+		"snapshot-id": string(info.ID),
+	})
+	logger.Info("Trying to delete snapshot info...")
+
+	_, err := s.client.DeleteObjectWithContext(ctx, &awss3.DeleteObjectInput{
+		Bucket: aws.String(s.bucket),
+		Key:    aws.String(s.objectKey(info)),
+	})
+	deleteObjectRequests.Inc()
+	return err
+}
@@ -0,0 +1,388 @@
+package s3_test
+
+import (
+	"context"
+	"encoding/xml"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"sort"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/aws/credentials"
+	"github.com/aws/aws-sdk-go/aws/session"
+	awss3 "github.com/aws/aws-sdk-go/service/s3"
+	"github.com/google/go-cmp/cmp"
+
+	"github.com/grid-x/aws-auto-snapshot/pkg/datastore"
+	"github.com/grid-x/aws-auto-snapshot/pkg/datastore/s3"
+)
+
+const testBucket = "snapshots"
+
+// fakeS3 implements the object operations used by the datastore for a single
+// bucket with path style addressing
+type fakeS3 struct {
+	mu      sync.Mutex
+	objects map[string][]byte
+}
+
+type listResult struct {
+	XMLName        xml.Name `xml:"ListBucketResult"`
+	Name           string
+	Prefix         string
+	KeyCount       int
+	IsTruncated    bool
+	Contents       []listObject
+	CommonPrefixes []listPrefix
+}
+
+type listObject struct {
+	Key string
+}
+
+type listPrefix struct {
+	Prefix string
+}
+
+func (f *fakeS3) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	parts := strings.SplitN(strings.TrimPrefix(r.URL.Path, "/"), "/", 2)
+	if parts[0] != testBucket {
+		http.Error(w, "no such bucket", http.StatusNotFound)
+		return
+	}
+	var key string
+	if len(parts) == 2 {
+		key = parts[1]
+	}
+
+	switch {
+	case r.Method == http.MethodGet && key == "":
+		f.list(w, r.URL.Query().Get("prefix"), r.URL.Query().Get("delimiter"))
+	case r.Method == http.MethodGet:
+		body, ok := f.objects[key]
+		if !ok {
+			w.WriteHeader(http.StatusNotFound)
+			w.Write([]byte(`<Error><Code>NoSuchKey</Code><Message>not found</Message></Error>`))
+			return
+		}
+		w.Write(body)
+	case r.Method == http.MethodPut:
+		body, err := ioutil.ReadAll(r.Body)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+		f.objects[key] = body
+	case r.Method == http.MethodDelete:
+		delete(f.objects, key)
+		w.WriteHeader(http.StatusNoContent)
+	default:
+		http.Error(w, "unsupported", http.StatusMethodNotAllowed)
+	}
+}
+
+func (f *fakeS3) list(w http.ResponseWriter, prefix, delimiter string) {
+	res := listResult{Name: testBucket, Prefix: prefix}
+	seen := map[string]bool{}
+	for _, key := range f.sortedKeys() {
+		if !strings.HasPrefix(key, prefix) {
+			continue
+		}
+		if delimiter != "" {
+			if i := strings.Index(key[len(prefix):], delimiter); i >= 0 {
+				p := key[:len(prefix)+i+len(delimiter)]
+				if !seen[p] {
+					seen[p] = true
+					res.CommonPrefixes = append(res.CommonPrefixes, listPrefix{Prefix: p})
+				}
+				continue
+			}
+		}
+		res.Contents = append(res.Contents, listObject{Key: key})
+	}
+	res.KeyCount = len(res.Contents) + len(res.CommonPrefixes)
+	if err := xml.NewEncoder(w).Encode(&res); err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+	}
+}
+
+func (f *fakeS3) sortedKeys() []string {
+	var keys []string
+	for k := range f.objects {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	return keys
+}
+
+func newTestS3(t *testing.T, prefix string) (*s3.S3, *fakeS3, func()) {
+	fake := &fakeS3{objects: make(map[string][]byte)}
+	srv := httptest.NewServer(fake)
+
+	sess, err := session.NewSession(&aws.Config{
+		Endpoint:         aws.String(srv.URL),
+		Region:           aws.String("eu-central-1"),
+		Credentials:      credentials.NewStaticCredentials("id", "secret", ""),
+		S3ForcePathStyle: aws.Bool(true),
+	})
+	if err != nil {
+		srv.Close()
+		t.Fatalf("newSession: %+v", err)
+	}
+	ds, err := s3.New(awss3.New(sess), testBucket, prefix)
+	if err != nil {
+		srv.Close()
+		t.Fatalf("new: %+v", err)
+	}
+	return ds, fake, srv.Close
+}
+
+func Test_ObjectKeys(t *testing.T) {
+	ds, fake, cleanup := newTestS3(t, "/meta/")
+	defer cleanup()
+
+	ctx := context.Background()
+	created := time.Unix(1520000000, 0).UTC()
+	for _, info := range []*datastore.SnapshotInfo{
+		{Resource: "vol-123abcdefghi", ID: "snap-abc00000000", CreatedAt: created},
+		{Resource: "vol-123abcdefghi", ID: "snap-abc00000001", CreatedAt: created.Add(1500 * time.Millisecond)},
+		{Resource: "db/cluster-1", ID: "cluster-1-auto-snapshot", CreatedAt: created},
+	} {
+		if err := ds.StoreSnapshotInfo(ctx, info); err != nil {
+			t.Fatalf("storeSnapshotInfo: %+v", err)
+		}
+	}
+
+	want := []string{
+		"meta/db%2Fcluster-1/001520000000-cluster-1-auto-snapshot.json",
+		"meta/vol-123abcdefghi/001520000000-snap-abc00000000.json",
+		"meta/vol-123abcdefghi/001520000001-snap-abc00000001.json",
+	}
+	if diff := cmp.Diff(want, fake.sortedKeys()); diff != "" {
+		t.Errorf("unexpected object keys (-want +got):\n%s", diff)
+	}
+
+	resources, err := ds.ListResources(ctx)
+	if err != nil {
+		t.Fatalf("listResources: %+v", err)
+	}
+	wantResources := []datastore.SnapshotResource{"db/cluster-1", "vol-123abcdefghi"}
+	if diff := cmp.Diff(wantResources, resources); diff != "" {
+		t.Errorf("unexpected resources (-want +got):\n%s", diff)
+	}
+
+	info, err := ds.GetLatestSnapshotInfo(ctx, "db/cluster-1")
+	if err != nil {
+		t.Fatalf("getLatestSnapshotInfo: %+v", err)
+	}
+	if info.ID != "cluster-1-auto-snapshot" {
+		t.Errorf("expected cluster-1-auto-snapshot, got %s", info.ID)
+	}
+
+	if err := ds.DeleteSnapshotInfo(ctx, info); err != nil {
+		t.Fatalf("deleteSnapshotInfo: %+v", err)
+	}
+	if _, ok := fake.objects["meta/db%2Fcluster-1/001520000000-cluster-1-auto-snapshot.json"]; ok {
+		t.Errorf("expected snapshot info to be deleted")
+	}
+}
+
+func Test_ParseKeys(t *testing.T) {
+	ds, fake, cleanup := newTestS3(t, "")
+	defer cleanup()
+
+	ctx := context.Background()
+	created := time.Unix(1520000000, 0).UTC()
+	if err := ds.StoreSnapshotInfo(ctx, &datastore.SnapshotInfo{
+		Resource:  "vol-123abcdefghi",
+		ID:        "snap-abc00000000",
+		CreatedAt: created,
+	}); err != nil {
+		t.Fatalf("storeSnapshotInfo: %+v", err)
+	}
+	// Objects that aren't snapshot infos of the resource are ignored
+	for _, key := range []string{
+		"vol-123abcdefghi/notes.txt",
+		"vol-123abcdefghi/latest.json",
+		"vol-123abcdefghi/001520000001.json",
+		"vol-123abcdefghi/001520000001-.json",
+		"vol-123abcdefghi/archive/001520000001-snap-abc00000001.json",
+		"vol-123abcdefghi0/001520000002-snap-abc00000002.json",
+	} {
+		fake.objects[key] = []byte("{}")
+	}
+
+	list, err := ds.ListSnapshotInfos(ctx, "vol-123abcdefghi", time.Time{}, created.Add(time.Hour))
+	if err != nil {
+		t.Fatalf("listSnapshotInfos: %+v", err)
+	}
+	want := []*datastore.SnapshotInfo{
+		{Resource: "vol-123abcdefghi", ID: "snap-abc00000000", CreatedAt: created},
+	}
+	if diff := cmp.Diff(want, list); diff != "" {
+		t.Errorf("unexpected snapshot infos (-want +got):\n%s", diff)
+	}
+}
+
+func Test_Lookups(t *testing.T) {
+	ds, _, cleanup := newTestS3(t, "meta")
+	defer cleanup()
+
+	ctx := context.Background()
+	base := time.Unix(1520000000, 0).UTC()
+	snapshots := []*datastore.SnapshotInfo{
+		{
+			Resource:  "vol-123abcdefghi",
+			ID:        "snap-abc00000000",
+			CreatedAt: base.Add(200 * time.Millisecond),
+			Labels:    datastore.SnapshotLabels{"state": "completed"},
+		},
+		{
+			Resource:  "vol-123abcdefghi",
+			ID:        "snap-abc00000001",
+			CreatedAt: base.Add(1600 * time.Millisecond),
+			Labels:    datastore.SnapshotLabels{"state": "completed"},
+		},
+		{
+			Resource:  "vol-123abcdefghi",
+			ID:        "snap-abc00000002",
+			CreatedAt: base.Add(3400 * time.Millisecond),
+			Labels:    datastore.SnapshotLabels{"state": "error"},
+		},
+	}
+	for _, s := range snapshots {
+		if err := ds.StoreSnapshotInfo(ctx, s); err != nil {
+			t.Fatalf("storeSnapshotInfo: %+v", err)
+		}
+	}
+
+	latest, err := ds.GetLatestSnapshotInfo(ctx, "vol-123abcdefghi")
+	if err != nil {
+		t.Fatalf("getLatestSnapshotInfo: %+v", err)
+	}
+	if diff := cmp.Diff(snapshots[2], latest); diff != "" {
+		t.Errorf("unexpected latest snapshot info (-want +got):\n%s", diff)
+	}
+
+	latest, err = ds.GetLatestSnapshotInfo(ctx, "vol-123abcdefghi", datastore.WithLabel("state", "completed"))
+	if err != nil {
+		t.Fatalf("getLatestSnapshotInfo: %+v", err)
+	}
+	if diff := cmp.Diff(snapshots[1], latest); diff != "" {
+		t.Errorf("unexpected latest completed snapshot info (-want +got):\n%s", diff)
+	}
+
+	atTestcases := []struct {
+		at   time.Time
+		want *datastore.SnapshotInfo
+	}{
+		// Within the second of the key of the second snapshot, but
+		// before it was created
+		{at: base.Add(1300 * time.Millisecond), want: snapshots[0]},
+		{at: base.Add(1600 * time.Millisecond), want: snapshots[1]},
+		{at: base.Add(time.Hour), want: snapshots[2]},
+		{at: base.Add(100 * time.Millisecond)},
+	}
+	for _, tc := range atTestcases {
+		got, err := ds.GetSnapshotInfoAt(ctx, "vol-123abcdefghi", tc.at)
+		if tc.want == nil {
+			if !datastore.IsNotFound(err) {
+				t.Errorf("at %s: expected not found error, got %+v", tc.at, err)
+			}
+			continue
+		}
+		if err != nil {
+			t.Errorf("at %s: unexpected error: %+v", tc.at, err)
+			continue
+		}
+		if diff := cmp.Diff(tc.want, got); diff != "" {
+			t.Errorf("at %s: unexpected snapshot info (-want +got):\n%s", tc.at, diff)
+		}
+	}
+
+	listTestcases := []struct {
+		from, to time.Time
+		want     []*datastore.SnapshotInfo
+	}{
+		{from: time.Time{}, to: base.Add(time.Hour), want: snapshots},
+		// The keys of the first and last snapshot are within the
+		// range, but they were created outside of it
+		{from: base.Add(500 * time.Millisecond), to: base.Add(3100 * time.Millisecond), want: snapshots[1:2]},
+		{from: base.Add(200 * time.Millisecond), to: base.Add(3400 * time.Millisecond), want: snapshots},
+		{from: base.Add(time.Hour), to: base.Add(2 * time.Hour)},
+	}
+	for _, tc := range listTestcases {
+		got, err := ds.ListSnapshotInfos(ctx, "vol-123abcdefghi", tc.from, tc.to)
+		if err != nil {
+			t.Errorf("[%s, %s]: unexpected error: %+v", tc.from, tc.to, err)
+			continue
+		}
+		if diff := cmp.Diff(tc.want, got); diff != "" {
+			t.Errorf("[%s, %s]: unexpected snapshot infos (-want +got):\n%s", tc.from, tc.to, diff)
+		}
+	}
+
+	if _, err := ds.GetLatestSnapshotInfo(ctx, "vol-unknown"); !datastore.IsNotFound(err) {
+		t.Errorf("expected not found error for unknown resource, got %+v", err)
+	}
+}
+
+func Test_SameSecond(t *testing.T) {
+	ds, fake, cleanup := newTestS3(t, "meta")
+	defer cleanup()
+
+	ctx := context.Background()
+	base := time.Unix(1520000000, 0).UTC()
+	// The ID of the newer snapshot sorts first
+	snapshots := []*datastore.SnapshotInfo{
+		{Resource: "vol-123abcdefghi", ID: "snap-b", CreatedAt: base.Add(100 * time.Millisecond)},
+		{Resource: "vol-123abcdefghi", ID: "snap-a", CreatedAt: base.Add(700 * time.Millisecond)},
+	}
+	for _, s := range snapshots {
+		if err := ds.StoreSnapshotInfo(ctx, s); err != nil {
+			t.Fatalf("storeSnapshotInfo: %+v", err)
+		}
+	}
+	if len(fake.objects) != 2 {
+		t.Fatalf("expected 2 objects, got %d", len(fake.objects))
+	}
+
+	list, err := ds.ListSnapshotInfos(ctx, "vol-123abcdefghi", time.Time{}, base.Add(time.Second))
+	if err != nil {
+		t.Fatalf("listSnapshotInfos: %+v", err)
+	}
+	if diff := cmp.Diff(snapshots, list); diff != "" {
+		t.Errorf("unexpected snapshot infos (-want +got):\n%s", diff)
+	}
+
+	latest, err := ds.GetLatestSnapshotInfo(ctx, "vol-123abcdefghi")
+	if err != nil {
+		t.Fatalf("getLatestSnapshotInfo: %+v", err)
+	}
+	if latest.ID != "snap-a" {
+		t.Errorf("expected snap-a, got %s", latest.ID)
+	}
+	at, err := ds.GetSnapshotInfoAt(ctx, "vol-123abcdefghi", base.Add(500*time.Millisecond))
+	if err != nil {
+		t.Fatalf("getSnapshotInfoAt: %+v", err)
+	}
+	if at.ID != "snap-b" {
+		t.Errorf("expected snap-b, got %s", at.ID)
+	}
+
+	if err := ds.DeleteSnapshotInfo(ctx, snapshots[1]); err != nil {
+		t.Fatalf("deleteSnapshotInfo: %+v", err)
+	}
+	want := []string{"meta/vol-123abcdefghi/001520000000-snap-b.json"}
+	if diff := cmp.Diff(want, fake.sortedKeys()); diff != "" {
+		t.Errorf("unexpected object keys after delete (-want +got):\n%s", diff)
+	}
+}
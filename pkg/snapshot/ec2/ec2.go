@@ -5,25 +5,58 @@ import (
 	"fmt"
 	"strconv"
 	"strings"
+	"sync"
 	"time"
 
 	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/aws/request"
 	awsec2 "github.com/aws/aws-sdk-go/service/ec2"
+	"github.com/aws/aws-sdk-go/service/ssm"
 	"github.com/prometheus/client_golang/prometheus"
 	log "github.com/sirupsen/logrus"
 
 	"github.com/grid-x/aws-auto-snapshot/pkg/datastore"
+	"github.com/grid-x/aws-auto-snapshot/pkg/snapshot"
 )
 
 const (
-	defaultBackupTag    = "backup"
-	defaultRetentionTag = "retention"
+	defaultBackupTag          = "backup"
+	defaultRetentionTag       = "retention"
+	defaultRetentionPolicyTag = "retention-policy"
+	defaultMinKeepTag         = "min-keep"
 
 	defaultSnapshotSuffix = "auto-snapshot"
 	defaultDeleteAfterTag = "_DELETE_AFTER"
 
-	defaultRetentionDays = 7 // Default are 7 days retention
-	defaultDescription   = "auto snapshot created by grid-x/aws-auto-snapshot"
+	defaultDescription = "auto snapshot created by grid-x/aws-auto-snapshot"
+
+	defaultCompletionTimeout = time.Hour
+	snapshotPollInterval     = 15 * time.Second
+
+	// failedTag is set on snapshots that ended up in the error state
+	failedTag = "_SNAPSHOT_FAILED"
+	// pendingTag is set on snapshots that were still pending when waiting
+	// for them timed out, so a later run records them
+	pendingTag = "_SNAPSHOT_PENDING"
+
+	// volumeIDTag refers to the source volume, also on copies
+	volumeIDTag = "volume-id"
+
+	sourceSnapshotIDTag = "source-snapshot-id"
+	sourceRegionTag     = "source-region"
+)
+
+// Labels of the snapshot infos stored in the datastore. StateLabel and
+// VolumeSizeLabel describe the snapshot itself, the others refer to the
+// cross-region copy and the vault account copy of a snapshot
+const (
+	StateLabel      = "state"
+	VolumeSizeLabel = "volume-size"
+
+	CopySnapshotIDLabel  = "copy-snapshot-id"
+	CopyRegionLabel      = "copy-region"
+	VaultSnapshotIDLabel = "vault-snapshot-id"
+	VaultAccountLabel    = "vault-account"
 )
 
 var (
@@ -43,10 +76,26 @@ var (
 		Name: "ec2_create_tags_requests_total",
 		Help: "Total number of create tags requests",
 	})
+	deleteTagsRequests = prometheus.NewCounter(prometheus.CounterOpts{
+		Name: "ec2_delete_tags_requests_total",
+		Help: "Total number of delete tags requests",
+	})
 	deleteSnapshotRequests = prometheus.NewCounter(prometheus.CounterOpts{
 		Name: "ec2_delete_snapshot_requests_total",
 		Help: "Total number of delete snapshot requests",
 	})
+	copySnapshotRequests = prometheus.NewCounter(prometheus.CounterOpts{
+		Name: "ec2_copy_snapshot_requests_total",
+		Help: "Total number of copy snapshot requests",
+	})
+	failedSnapshots = prometheus.NewCounter(prometheus.CounterOpts{
+		Name: "ec2_failed_snapshots_total",
+		Help: "Total number of snapshots that ended up in the error state",
+	})
+	modifySnapshotAttributeRequests = prometheus.NewCounter(prometheus.CounterOpts{
+		Name: "ec2_modify_snapshot_attribute_requests_total",
+		Help: "Total number of modify snapshot attribute requests",
+	})
 )
 
 func init() {
@@ -54,7 +103,11 @@ func init() {
 	prometheus.MustRegister(describeSnapshotsRequests)
 	prometheus.MustRegister(createSnapshotRequests)
 	prometheus.MustRegister(createTagsRequests)
+	prometheus.MustRegister(deleteTagsRequests)
 	prometheus.MustRegister(deleteSnapshotRequests)
+	prometheus.MustRegister(copySnapshotRequests)
+	prometheus.MustRegister(modifySnapshotAttributeRequests)
+	prometheus.MustRegister(failedSnapshots)
 }
 
 // SnapshotManager manages the snapshot creation and pruning of EC2 EBS-based
@@ -67,6 +120,42 @@ type SnapshotManager struct {
 	backupTag      string
 	retentionTag   string
 	deleteAfterTag string
+	// retentionPolicyTag holds a grandfather-father-son retention policy,
+	// e.g. 7d,4w,12m, which replaces the retention days if set
+	retentionPolicyTag string
+	// minKeep is the number of newest completed snapshots of a volume that
+	// are never pruned, unless overridden by the minKeepTag of the volume
+	minKeep    int
+	minKeepTag string
+
+	completionTimeout time.Duration
+
+	// ssmClient is set if hooks are run on the instances of volumes with the
+	// hookTag before and after snapshotting them
+	ssmClient           *ssm.SSM
+	hookTag             string
+	hookTimeout         time.Duration
+	preSnapshotCommand  string
+	postSnapshotCommand string
+
+	// copyClient is set if snapshots are copied to a second region
+	copyClient        *awsec2.EC2
+	copyKMSKeyID      string
+	copyRetentionDays int64
+
+	// groupByInstance is set if all volumes of an instance are snapshotted
+	// as a group
+	groupByInstance bool
+
+	// plan is set in dry-run mode, in which snapshots and deletions are
+	// only added to it
+	plan *snapshot.Plan
+
+	// vaultClient is set if snapshots are copied to a vault account
+	vaultClient        *awsec2.EC2
+	vaultAccountID     string
+	vaultKMSKeyID      string
+	vaultRetentionDays int64
 
 	logger log.FieldLogger
 
@@ -83,6 +172,28 @@ func WithRetentionTag(t string) Opt {
 	}
 }
 
+// WithRetentionPolicyTag sets the retention policy tag key
+func WithRetentionPolicyTag(t string) Opt {
+	return func(m *SnapshotManager) {
+		m.retentionPolicyTag = t
+	}
+}
+
+// WithMinKeep sets the number of newest completed snapshots of a volume that
+// are never pruned regardless of their age
+func WithMinKeep(n int) Opt {
+	return func(m *SnapshotManager) {
+		m.minKeep = n
+	}
+}
+
+// WithMinKeepTag sets the tag key to override the min keep number per volume
+func WithMinKeepTag(t string) Opt {
+	return func(m *SnapshotManager) {
+		m.minKeepTag = t
+	}
+}
+
 // WithBackupTag sets the backup tag key
 func WithBackupTag(t string) Opt {
 	return func(m *SnapshotManager) {
@@ -105,8 +216,85 @@ func WithDeleteAfterTag(tag string) Opt {
 	}
 }
 
+// WithLogger sets the logger to use, e.g. to add context to all log entries
+func WithLogger(logger log.FieldLogger) Opt {
+	return func(m *SnapshotManager) {
+		m.logger = logger
+	}
+}
+
+// WithCopyTo enables copying every new snapshot to the region of the given
+// client, e.g. for disaster recovery. The copies are pruned in that region as
+// well
+func WithCopyTo(client *awsec2.EC2) Opt {
+	return func(m *SnapshotManager) {
+		m.copyClient = client
+	}
+}
+
+// WithCopyKMSKeyID sets the KMS key the copies are encrypted with in the
+// destination region
+func WithCopyKMSKeyID(id string) Opt {
+	return func(m *SnapshotManager) {
+		m.copyKMSKeyID = id
+	}
+}
+
+// WithCopyRetentionDays sets the number of days the copies are kept. By
+// default the retention days of the source snapshot are used
+func WithCopyRetentionDays(days int64) Opt {
+	return func(m *SnapshotManager) {
+		m.copyRetentionDays = days
+	}
+}
+
+// WithVault enables copying every new snapshot to the vault account with the
+// given ID, e.g. to protect backups against the deletion of the source
+// account. The snapshot is shared with the vault account and copied there via
+// the given client, which needs credentials of the vault account. The copies
+// are pruned in the vault account as well
+func WithVault(accountID string, client *awsec2.EC2) Opt {
+	return func(m *SnapshotManager) {
+		m.vaultAccountID = accountID
+		m.vaultClient = client
+	}
+}
+
+// WithVaultKMSKeyID sets the KMS key of the vault account the vault copies are
+// encrypted with
+func WithVaultKMSKeyID(id string) Opt {
+	return func(m *SnapshotManager) {
+		m.vaultKMSKeyID = id
+	}
+}
+
+// WithVaultRetentionDays sets the number of days the vault copies are kept.
+// By default the retention days of the source snapshot are used
+func WithVaultRetentionDays(days int64) Opt {
+	return func(m *SnapshotManager) {
+		m.vaultRetentionDays = days
+	}
+}
+
+// WithDryRun makes the SnapshotManager only add the snapshots and deletions it
+// would perform to the given plan instead of performing them
+func WithDryRun(plan *snapshot.Plan) Opt {
+	return func(m *SnapshotManager) {
+		m.plan = plan
+	}
+}
+
+// WithCompletionTimeout sets how long to wait for a snapshot to complete
+// before giving up on recording it
+func WithCompletionTimeout(d time.Duration) Opt {
+	return func(m *SnapshotManager) {
+		m.completionTimeout = d
+	}
+}
+
 // NewSnapshotManager creates a new SnapshotManager given an EC2 client and a
-// set of Opts
+// set of Opts. The datastore may be nil if the SnapshotManager only prunes or
+// runs dry
 func NewSnapshotManager(client *awsec2.EC2, datastore datastore.Datastore, opts ...Opt) *SnapshotManager {
 	smgr := &SnapshotManager{
 		client: client,
@@ -116,22 +304,34 @@ func NewSnapshotManager(client *awsec2.EC2, datastore datastore.Datastore, opts
 		backupTag:      defaultBackupTag,
 		deleteAfterTag: defaultDeleteAfterTag,
 
-		logger: log.New().WithFields(
-			log.Fields{
-				"component": "ec2-snapshot-manager",
-			},
-		),
+		retentionPolicyTag: defaultRetentionPolicyTag,
+		minKeepTag:         defaultMinKeepTag,
+		completionTimeout:  defaultCompletionTimeout,
+		hookTag:            defaultHookTag,
+		hookTimeout:        defaultHookTimeout,
+
+		logger:    log.New(),
 		datastore: datastore,
 	}
 
 	for _, o := range opts {
 		o(smgr)
 	}
+	smgr.logger = smgr.logger.WithFields(
+		log.Fields{
+			"component": "ec2-snapshot-manager",
+		},
+	)
 
 	return smgr
 }
 
 func (smgr *SnapshotManager) fetchVolumes(ctx context.Context) ([]*awsec2.Volume, error) {
+	return fetchVolumes(ctx, smgr.client, smgr.backupTag)
+}
+
+// fetchVolumes returns the volumes that have the given backup tag set
+func fetchVolumes(ctx context.Context, client *awsec2.EC2, backupTag string) ([]*awsec2.Volume, error) {
 	var result []*awsec2.Volume
 	var token *string
 	for {
@@ -145,13 +345,13 @@ func (smgr *SnapshotManager) fetchVolumes(ctx context.Context) ([]*awsec2.Volume
 			{
 				Name: aws.String("tag-key"),
 				Values: []*string{
-					aws.String(smgr.backupTag),
-					aws.String(strings.ToLower(smgr.backupTag)), // we are not case sensitive
+					aws.String(backupTag),
+					aws.String(strings.ToLower(backupTag)), // we are not case sensitive
 				},
 			},
 		})
 
-		resp, err := smgr.client.DescribeVolumesWithContext(ctx, in)
+		resp, err := client.DescribeVolumesWithContext(ctx, in)
 		describeVolumesRequets.Inc()
 		if err != nil {
 			return nil, err
@@ -173,26 +373,36 @@ func (smgr *SnapshotManager) fetchVolumes(ctx context.Context) ([]*awsec2.Volume
 	return result, nil
 }
 
-func (smgr *SnapshotManager) fetchSnapshots(ctx context.Context) ([]*awsec2.Snapshot, error) {
+func (smgr *SnapshotManager) fetchSnapshots(ctx context.Context, client *awsec2.EC2) ([]*awsec2.Snapshot, error) {
+	return fetchTaggedSnapshots(ctx, client, smgr.deleteAfterTag)
+}
+
+// fetchTaggedSnapshots returns the snapshots of the account that have the
+// given tag set
+func fetchTaggedSnapshots(ctx context.Context, client *awsec2.EC2, tag string) ([]*awsec2.Snapshot, error) {
 	var result []*awsec2.Snapshot
 	var token *string
 	for {
-		in := &awsec2.DescribeSnapshotsInput{}
+		// Snapshots shared with the account, e.g. with a vault account, can't
+		// be deleted by it
+		in := &awsec2.DescribeSnapshotsInput{
+			OwnerIds: []*string{aws.String("self")},
+		}
 		if token != nil {
 			in.NextToken = token
 		}
 
-		// Filter so we get only volumes that have the Backup tag set
+		// Filter so we get only snapshots that have the tag set
 		in.SetFilters([]*awsec2.Filter{
 			{
 				Name: aws.String("tag-key"),
 				Values: []*string{
-					aws.String(smgr.deleteAfterTag),
+					aws.String(tag),
 				},
 			},
 		})
 
-		resp, err := smgr.client.DescribeSnapshotsWithContext(ctx, in)
+		resp, err := client.DescribeSnapshotsWithContext(ctx, in)
 		describeSnapshotsRequests.Inc()
 		if err != nil {
 			return nil, err
@@ -214,114 +424,274 @@ func (smgr *SnapshotManager) fetchSnapshots(ctx context.Context) ([]*awsec2.Snap
 	return result, nil
 }
 
+func tagMap(tags []*awsec2.Tag) map[string]string {
+	m := make(map[string]string, len(tags))
+	for _, t := range tags {
+		if t.Key == nil || t.Value == nil {
+			continue
+		}
+		m[*t.Key] = *t.Value
+	}
+	return m
+}
+
+// List returns the snapshots managed by the SnapshotManager, optionally only
+// those of the given volume
+func (smgr *SnapshotManager) List(ctx context.Context, volumeID string) ([]snapshot.Description, error) {
+	snaps, err := smgr.fetchSnapshots(ctx, smgr.client)
+	if err != nil {
+		return nil, err
+	}
+
+	var result []snapshot.Description
+	for _, snap := range snaps {
+		tags := tagMap(snap.Tags)
+		resource := aws.StringValue(snap.VolumeId)
+		if id, ok := tags[volumeIDTag]; ok {
+			resource = id
+		}
+		if volumeID != "" && resource != volumeID {
+			continue
+		}
+
+		d := snapshot.Description{
+			ID:               *snap.SnapshotId,
+			Resource:         resource,
+			CreatedAt:        aws.TimeValue(snap.StartTime),
+			RetentionPolicy:  tags[smgr.retentionPolicyTag],
+			State:            aws.StringValue(snap.State),
+			SizeGiB:          aws.Int64Value(snap.VolumeSize),
+			SourceSnapshotID: tags[sourceSnapshotIDTag],
+		}
+		if deleteAfter, err := time.Parse(time.RFC3339, tags[smgr.deleteAfterTag]); err == nil && d.RetentionPolicy == "" {
+			d.DeleteAfter = &deleteAfter
+		}
+		result = append(result, d)
+	}
+	return result, nil
+}
+
+// pendingSnapshot is a snapshot that was created but is not yet recorded in
+// the datastore
+type pendingSnapshot struct {
+	info *datastore.SnapshotInfo
+	// labels are added to the labels recorded in the datastore
+	labels datastore.SnapshotLabels
+	tags   []*awsec2.Tag
+	days   int64
+	logger log.FieldLogger
+}
+
 // Snapshot creates EBS snapshots for all matching EBS volumes, i.e. all EBS
-// volumes having a Backup tag and optionally a retention tag set
+// volumes having a Backup tag and optionally a retention tag set. Only
+// snapshots that completed are recorded in the datastore. Snapshots of
+// previous runs that completed only after the completion timeout are recorded
+// first
 func (smgr *SnapshotManager) Snapshot(ctx context.Context) error {
+	if smgr.plan == nil {
+		// A failure here must not keep us from creating new snapshots
+		if err := smgr.recordMissing(ctx); err != nil {
+			smgr.logger.Errorf("Couldn't record missing snapshots: %+v", err)
+		}
+	}
+	if smgr.groupByInstance {
+		return smgr.snapshotGroups(ctx)
+	}
 
 	volumes, err := smgr.fetchVolumes(ctx)
 	if err != nil {
 		return err
 	}
 
-	for _, volume := range volumes {
-		// For each volume it should at most take 5 minutes
-		ctx, cancel := context.WithTimeout(ctx, 5*time.Minute)
-		defer cancel()
-
-		snapshotName := fmt.Sprintf("%s-%d-%s",
-			*volume.VolumeId,
-			time.Now().UnixNano(),
-			smgr.suffix,
-		)
-
-		logger := smgr.logger.WithFields(
-			log.Fields{
-				"volume-id":     volume.VolumeId,
-				"snapshot-name": snapshotName,
-			},
-		)
-
-		var days int64
-		for _, tag := range volume.Tags {
-			if tag.Key == nil {
-				continue
-			}
-			if strings.ToLower(*tag.Key) == strings.ToLower(smgr.retentionTag) {
-				if tag.Value == nil {
-					logger.Warnf("Retention tag value is nil")
-					continue
-				}
-				days, err = strconv.ParseInt(*tag.Value, 10, 64)
-				if err != nil {
-					logger.Warnf("Couldn't parse retention days: %+v. Falling back to default value", err)
-					days = defaultRetentionDays // if error occurs fall back to default retention time
-				}
-				break
+	if smgr.plan != nil {
+		for _, volume := range volumes {
+			reason := fmt.Sprintf("%s tag set", smgr.backupTag)
+			if instanceID := smgr.hookInstance(volume); instanceID != "" {
+				reason += fmt.Sprintf(", running hooks on instance %s", instanceID)
 			}
+			smgr.plan.Add(snapshot.Action{
+				Action:   snapshot.ActionSnapshot,
+				Resource: *volume.VolumeId,
+				Reason:   reason,
+			})
 		}
+		return nil
+	}
 
-		if days == 0 {
-			days = defaultRetentionDays
+	// Create all snapshots first, so they progress in parallel while we
+	// wait for them to complete
+	var (
+		pending      []*pendingSnapshot
+		hookFailures int
+	)
+	for _, volume := range volumes {
+		p, err := smgr.snapshotVolume(ctx, volume)
+		if _, ok := err.(*hookError); ok {
+			hookFailures++
 		}
-
-		created := time.Now()
-		deleteAfter := created.Add(time.Duration(days) * 24 * time.Hour)
-
-		logger.Infof("Creating snapshot with name %s", snapshotName)
-		snapshot, err := smgr.client.CreateSnapshotWithContext(
-			ctx,
-			&awsec2.CreateSnapshotInput{
-				VolumeId:    volume.VolumeId,
-				Description: aws.String(defaultDescription),
-			},
-		)
-		createSnapshotRequests.Inc()
-		if err != nil {
-			logger.Error(err)
+		if p == nil {
 			continue
 		}
+		pending = append(pending, p)
+	}
 
-		if snapshot.SnapshotId == nil {
-			logger.Errorf("Snapshot ID is nil.")
-			continue
+	var failed int
+	for i, err := range smgr.recordSnapshots(ctx, pending) {
+		if err != nil {
+			pending[i].logger.Error(err)
+			failed++
 		}
+	}
+	switch {
+	case failed > 0 && hookFailures > 0:
+		return fmt.Errorf("%d of %d snapshots did not complete, hooks of %d volumes failed",
+			failed, len(pending), hookFailures)
+	case failed > 0:
+		return fmt.Errorf("%d of %d snapshots did not complete", failed, len(pending))
+	case hookFailures > 0:
+		return fmt.Errorf("hooks of %d of %d volumes failed", hookFailures, len(volumes))
+	}
+	return nil
+}
 
-		tags := []*awsec2.Tag{
-			{
-				Key:   aws.String("Name"),
-				Value: aws.String(snapshotName),
-			},
-			{
-				Key:   aws.String(smgr.deleteAfterTag),
-				Value: aws.String(deleteAfter.Format(time.RFC3339)),
-			},
-		}
+// createSnapshot creates and tags a snapshot of the given volume, which is
+// optionally a member of a snapshot group. Errors are logged already
+func (smgr *SnapshotManager) createSnapshot(ctx context.Context, volume *awsec2.Volume,
+	member *groupMember) (*pendingSnapshot, error) {
+
+	p, err := smgr.startSnapshot(ctx, volume, member)
+	if err != nil {
+		return nil, err
+	}
+	if err := smgr.tagSnapshot(ctx, p); err != nil {
+		return nil, err
+	}
+	return p, nil
+}
+
+// startSnapshot creates a snapshot of the given volume, which is optionally a
+// member of a snapshot group, without tagging it yet. The tags are returned
+// with the pending snapshot. Errors are logged already
+func (smgr *SnapshotManager) startSnapshot(ctx context.Context, volume *awsec2.Volume,
+	member *groupMember) (*pendingSnapshot, error) {
 
-		for _, t := range volume.Tags {
-			if t.Key != nil && *t.Key == "Name" {
-				tags = append(tags, &awsec2.Tag{
-					Key:   aws.String("volume-name"),
-					Value: t.Value,
-				})
-				break
+	// For each volume it should at most take 5 minutes
+	ctx, cancel := context.WithTimeout(ctx, 5*time.Minute)
+	defer cancel()
+
+	snapshotName := fmt.Sprintf("%s-%d-%s",
+		*volume.VolumeId,
+		time.Now().UnixNano(),
+		smgr.suffix,
+	)
+
+	logger := smgr.logger.WithFields(
+		log.Fields{
+			"volume-id":     volume.VolumeId,
+			"snapshot-name": snapshotName,
+		},
+	)
+
+	// The snapshots of a group are pruned alike, hence their retention is
+	// given by the instance
+	settings := tagMap(volume.Tags)
+	if member != nil {
+		settings = member.instanceTags
+	}
+
+	days, err := snapshot.RetentionDays(settings, smgr.retentionTag)
+	if err != nil {
+		logger.Warnf("Couldn't parse retention days: %+v. Falling back to default value", err)
+	}
+
+	var policy, minKeep string
+	for k, v := range settings {
+		switch strings.ToLower(k) {
+		case strings.ToLower(smgr.retentionPolicyTag):
+			if _, err := snapshot.ParseRetentionPolicy(v); err != nil {
+				logger.Warnf("Ignoring retention policy: %+v", err)
+				continue
 			}
+			policy = v
+		case strings.ToLower(smgr.minKeepTag):
+			minKeep = v
 		}
+	}
 
-		if _, err := smgr.client.CreateTagsWithContext(
-			ctx,
-			&awsec2.CreateTagsInput{
-				Resources: []*string{
-					snapshot.SnapshotId,
-				},
-				Tags: tags,
-			},
-		); err != nil {
-			logger.Error(err)
-			continue
+	created := time.Now()
+	deleteAfter := created.Add(time.Duration(days) * 24 * time.Hour)
+
+	logger.Infof("Creating snapshot with name %s", snapshotName)
+	snapshot, err := smgr.client.CreateSnapshotWithContext(
+		ctx,
+		&awsec2.CreateSnapshotInput{
+			VolumeId:    volume.VolumeId,
+			Description: aws.String(defaultDescription),
+		},
+	)
+	createSnapshotRequests.Inc()
+	if err != nil {
+		logger.Error(err)
+		return nil, err
+	}
+
+	if snapshot.SnapshotId == nil {
+		logger.Errorf("Snapshot ID is nil.")
+		return nil, fmt.Errorf("snapshot ID is nil")
+	}
+	logger = logger.WithField("snapshot-id", *snapshot.SnapshotId)
+
+	tags := []*awsec2.Tag{
+		{
+			Key:   aws.String("Name"),
+			Value: aws.String(snapshotName),
+		},
+		{
+			Key:   aws.String(smgr.deleteAfterTag),
+			Value: aws.String(deleteAfter.Format(time.RFC3339)),
+		},
+		{
+			Key:   aws.String(volumeIDTag),
+			Value: volume.VolumeId,
+		},
+	}
+
+	for _, t := range volume.Tags {
+		if t.Key != nil && *t.Key == "Name" {
+			tags = append(tags, &awsec2.Tag{
+				Key:   aws.String("volume-name"),
+				Value: t.Value,
+			})
+			break
 		}
-		createTagsRequests.Inc()
+	}
 
-		if err := smgr.datastore.StoreSnapshotInfo(&datastore.SnapshotInfo{
+	// The retention policy and min keep number are evaluated at prune
+	// time, when the volume might be gone already
+	if policy != "" {
+		tags = append(tags, &awsec2.Tag{
+			Key:   aws.String(smgr.retentionPolicyTag),
+			Value: aws.String(policy),
+		})
+	}
+	if minKeep != "" {
+		tags = append(tags, &awsec2.Tag{
+			Key:   aws.String(smgr.minKeepTag),
+			Value: aws.String(minKeep),
+		})
+	}
+	if member != nil {
+		tags = append(tags, member.tags()...)
+	}
+
+	// The tags of the volume are recorded, so they can be restored
+	labels := volumeTagLabels(volume.Tags)
+	for k, v := range member.labels() {
+		labels[k] = v
+	}
+
+	return &pendingSnapshot{
+		info: &datastore.SnapshotInfo{
 			Resource: datastore.SnapshotResource(*volume.VolumeId),
 			ID:       datastore.SnapshotID(*snapshot.SnapshotId),
 			// The createdAt timestamp is used as a key for ordering
@@ -329,70 +699,648 @@ func (smgr *SnapshotManager) Snapshot(ctx context.Context) error {
 			// stable. To avoid problems let's truncate it to one
 			// minute
 			CreatedAt: (*snapshot.StartTime).Truncate(time.Minute),
+		},
+		labels: labels,
+		tags:   tags,
+		days:   days,
+		logger: logger,
+	}, nil
+}
+
+// tagSnapshot sets the tags of the given snapshot created by startSnapshot.
+// Errors are logged already
+func (smgr *SnapshotManager) tagSnapshot(ctx context.Context, p *pendingSnapshot) error {
+	ctx, cancel := context.WithTimeout(ctx, 5*time.Minute)
+	defer cancel()
+
+	if _, err := smgr.client.CreateTagsWithContext(
+		ctx,
+		&awsec2.CreateTagsInput{
+			Resources: []*string{
+				aws.String(string(p.info.ID)),
+			},
+			Tags: p.tags,
+		},
+	); err != nil {
+		p.logger.Error(err)
+		return err
+	}
+	createTagsRequests.Inc()
+	return nil
+}
+
+// recordSnapshots records the given snapshots concurrently, so the completion
+// timeout applies to each of them rather than adding up. It returns the error
+// of each snapshot
+func (smgr *SnapshotManager) recordSnapshots(ctx context.Context, pending []*pendingSnapshot) []error {
+	errs := make([]error, len(pending))
+	var wg sync.WaitGroup
+	for i, p := range pending {
+		wg.Add(1)
+		go func(i int, p *pendingSnapshot) {
+			defer wg.Done()
+			errs[i] = smgr.recordSnapshot(ctx, p)
+		}(i, p)
+	}
+	wg.Wait()
+	return errs
+}
+
+// recordSnapshot waits for the given snapshot to complete, copies it as
+// configured and stores it in the datastore. Snapshots that end up in the
+// error state are tagged accordingly and not recorded, snapshots that are
+// still pending are tagged to be recorded by a later run
+func (smgr *SnapshotManager) recordSnapshot(ctx context.Context, p *pendingSnapshot) error {
+	p.logger.Info("Waiting for snapshot to complete")
+	snap, err := smgr.waitForSnapshot(ctx, smgr.client, string(p.info.ID))
+	if err != nil {
+		smgr.markPending(p.logger, string(p.info.ID))
+		return fmt.Errorf("couldn't wait for snapshot to complete: %+v", err)
+	}
+	return smgr.storeSnapshot(ctx, p, snap)
+}
+
+// markPending tags the given snapshot with the pending tag. It gets its own
+// context, so the snapshot is tagged even if the run was canceled
+func (smgr *SnapshotManager) markPending(logger log.FieldLogger, snapshotID string) {
+	ctx, cancel := context.WithTimeout(context.Background(), time.Minute)
+	defer cancel()
+	if _, err := smgr.client.CreateTagsWithContext(ctx, &awsec2.CreateTagsInput{
+		Resources: []*string{aws.String(snapshotID)},
+		Tags: []*awsec2.Tag{
+			{
+				Key:   aws.String(pendingTag),
+				Value: aws.String(time.Now().UTC().Format(time.RFC3339)),
+			},
+		},
+	}); err != nil {
+		logger.Errorf("Couldn't tag pending snapshot, it won't be recorded: %+v", err)
+		return
+	}
+	createTagsRequests.Inc()
+}
+
+// storeSnapshot copies the given snapshot, which is no longer pending, as
+// configured and stores it in the datastore
+func (smgr *SnapshotManager) storeSnapshot(ctx context.Context, p *pendingSnapshot, snap *awsec2.Snapshot) error {
+	state := aws.StringValue(snap.State)
+	if state == awsec2.SnapshotStateError {
+		failedSnapshots.Inc()
+		if _, err := smgr.client.CreateTagsWithContext(ctx, &awsec2.CreateTagsInput{
+			Resources: []*string{snap.SnapshotId},
+			Tags: []*awsec2.Tag{
+				{
+					Key:   aws.String(failedTag),
+					Value: aws.String(aws.StringValue(snap.StateMessage)),
+				},
+			},
 		}); err != nil {
-			logger.Error(err)
+			p.logger.Errorf("Couldn't tag failed snapshot: %+v", err)
+		} else {
+			createTagsRequests.Inc()
+		}
+		return fmt.Errorf("snapshot failed: %s", aws.StringValue(snap.StateMessage))
+	}
+
+	p.info.Labels = datastore.SnapshotLabels{
+		StateLabel:      state,
+		VolumeSizeLabel: strconv.FormatInt(aws.Int64Value(snap.VolumeSize), 10),
+	}
+	for k, v := range p.labels {
+		p.info.Labels[k] = v
+	}
+	if smgr.copyClient != nil || smgr.vaultClient != nil {
+		// The snapshot itself is fine, so it is recorded even if
+		// copying fails
+		for k, v := range smgr.copySnapshot(ctx, p.logger, string(p.info.ID), p.tags, p.days) {
+			p.info.Labels[k] = v
+		}
+	}
+
+	if smgr.datastore == nil {
+		return nil
+	}
+	return smgr.datastore.StoreSnapshotInfo(ctx, p.info)
+}
+
+// recordMissing records the snapshots that were still pending when a previous
+// run gave up waiting for them, as marked by the pending tag, once they are no
+// longer pending. They are copied as configured as well. The group of such a
+// snapshot stays incomplete, as the snapshots of a group have to complete
+// together
+func (smgr *SnapshotManager) recordMissing(ctx context.Context) error {
+	if smgr.datastore == nil {
+		return nil
+	}
+	snaps, err := fetchTaggedSnapshots(ctx, smgr.client, pendingTag)
+	if err != nil {
+		return err
+	}
+
+	var recorded, failed int
+	for _, snap := range snaps {
+		tags := tagMap(snap.Tags)
+		volumeID := aws.StringValue(snap.VolumeId)
+		if id, ok := tags[volumeIDTag]; ok {
+			volumeID = id
+		}
+		logger := smgr.logger.WithFields(log.Fields{
+			"volume-id":   volumeID,
+			"snapshot-id": *snap.SnapshotId,
+		})
+		if aws.StringValue(snap.State) == awsec2.SnapshotStatePending {
+			logger.Info("Snapshot of a previous run is still pending")
 			continue
 		}
+
+		logger.Info("Recording snapshot of a previous run")
+		p := &pendingSnapshot{
+			info: &datastore.SnapshotInfo{
+				Resource:  datastore.SnapshotResource(volumeID),
+				ID:        datastore.SnapshotID(*snap.SnapshotId),
+				CreatedAt: aws.TimeValue(snap.StartTime).Truncate(time.Minute),
+			},
+			labels: smgr.missingLabels(ctx, logger, volumeID, tags),
+			logger: logger,
+		}
+		for _, t := range snap.Tags {
+			if k := aws.StringValue(t.Key); k != pendingTag && !strings.HasPrefix(k, "aws:") {
+				p.tags = append(p.tags, t)
+			}
+		}
+		if deleteAfter, err := time.Parse(time.RFC3339, tags[smgr.deleteAfterTag]); err == nil {
+			p.days = int64(deleteAfter.Sub(aws.TimeValue(snap.StartTime)).Hours()/24 + 0.5)
+		}
+
+		// Snapshots that failed are tagged as such and not recorded,
+		// hence they aren't pending anymore either
+		err := smgr.storeSnapshot(ctx, p, snap)
+		if err != nil {
+			logger.Errorf("Couldn't record snapshot: %+v", err)
+			failed++
+		} else {
+			recorded++
+		}
+		if err == nil || aws.StringValue(snap.State) == awsec2.SnapshotStateError {
+			smgr.unmarkPending(ctx, logger, *snap.SnapshotId)
+		}
+	}
+
+	if recorded > 0 {
+		smgr.logger.Infof("Recorded %d snapshots of previous runs", recorded)
+	}
+	if failed > 0 {
+		return fmt.Errorf("%d snapshots of previous runs couldn't be recorded", failed)
 	}
 	return nil
 }
 
+// unmarkPending removes the pending tag from the given snapshot
+func (smgr *SnapshotManager) unmarkPending(ctx context.Context, logger log.FieldLogger, snapshotID string) {
+	if _, err := smgr.client.DeleteTagsWithContext(ctx, &awsec2.DeleteTagsInput{
+		Resources: []*string{aws.String(snapshotID)},
+		Tags:      []*awsec2.Tag{{Key: aws.String(pendingTag)}},
+	}); err != nil {
+		logger.Errorf("Couldn't remove pending tag: %+v", err)
+		return
+	}
+	deleteTagsRequests.Inc()
+}
+
+// missingLabels returns the labels of a snapshot recorded by recordMissing.
+// The tags of the volume are recorded as they are now, if it still exists
+func (smgr *SnapshotManager) missingLabels(ctx context.Context, logger log.FieldLogger,
+	volumeID string, tags map[string]string) datastore.SnapshotLabels {
+
+	labels := datastore.SnapshotLabels{}
+	out, err := smgr.client.DescribeVolumesWithContext(ctx, &awsec2.DescribeVolumesInput{
+		VolumeIds: []*string{aws.String(volumeID)},
+	})
+	describeVolumesRequets.Inc()
+	if err != nil {
+		logger.Warnf("Couldn't describe volume, recording snapshot without volume tags: %+v", err)
+	} else if len(out.Volumes) == 1 {
+		labels = volumeTagLabels(out.Volumes[0].Tags)
+	}
+
+	if id, ok := tags[groupIDTag]; ok {
+		member := &groupMember{
+			groupID:    id,
+			instanceID: tags[instanceIDTag],
+			device:     tags[deviceTag],
+		}
+		for k, v := range member.labels() {
+			labels[k] = v
+		}
+	}
+	return labels
+}
+
+// waitForSnapshot waits until the given snapshot is no longer pending and
+// returns it, using the given client, i.e. in the region and account of the
+// client
+func (smgr *SnapshotManager) waitForSnapshot(ctx context.Context, client *awsec2.EC2,
+	snapshotID string) (*awsec2.Snapshot, error) {
+
+	waitCtx, cancel := context.WithTimeout(ctx, smgr.completionTimeout)
+	defer cancel()
+
+	in := &awsec2.DescribeSnapshotsInput{
+		SnapshotIds: []*string{aws.String(snapshotID)},
+	}
+	// The waiter gives up early if the snapshot ends up in the error
+	// state, hence the final state is looked up afterwards in any case
+	waitErr := client.WaitUntilSnapshotCompletedWithContext(waitCtx, in,
+		request.WithWaiterDelay(request.ConstantWaiterDelay(snapshotPollInterval)),
+		request.WithWaiterMaxAttempts(int(smgr.completionTimeout/snapshotPollInterval)+1),
+	)
+
+	out, err := client.DescribeSnapshotsWithContext(ctx, in)
+	describeSnapshotsRequests.Inc()
+	if err != nil {
+		return nil, err
+	}
+	if len(out.Snapshots) != 1 {
+		return nil, fmt.Errorf("snapshot %s not found", snapshotID)
+	}
+	snap := out.Snapshots[0]
+	if aws.StringValue(snap.State) == awsec2.SnapshotStatePending {
+		return nil, fmt.Errorf("snapshot still pending: %+v", waitErr)
+	}
+	return snap, nil
+}
+
+// copySnapshot copies the given completed snapshot to the copy region and the
+// vault account as configured. It returns the labels referring to the copies
+// that were created successfully
+func (smgr *SnapshotManager) copySnapshot(ctx context.Context, logger log.FieldLogger,
+	snapshotID string, tags []*awsec2.Tag, days int64) datastore.SnapshotLabels {
+
+	labels := datastore.SnapshotLabels{}
+	if smgr.copyClient != nil {
+		region := aws.StringValue(smgr.copyClient.Config.Region)
+		copyID, err := smgr.copyTo(ctx, smgr.copyClient, snapshotID, tags,
+			retentionOrDefault(smgr.copyRetentionDays, days), smgr.copyKMSKeyID)
+		if err != nil {
+			logger.Errorf("Couldn't copy snapshot to %s: %+v", region, err)
+		} else {
+			logger.Infof("Copied snapshot to %s in %s", copyID, region)
+			labels[CopySnapshotIDLabel] = copyID
+			labels[CopyRegionLabel] = region
+		}
+	}
+
+	if smgr.vaultClient != nil {
+		copyID, err := smgr.copyToVault(ctx, logger, snapshotID, tags,
+			retentionOrDefault(smgr.vaultRetentionDays, days))
+		if err != nil {
+			logger.Errorf("Couldn't copy snapshot to vault account %s: %+v", smgr.vaultAccountID, err)
+		} else {
+			logger.Infof("Copied snapshot to %s in vault account %s", copyID, smgr.vaultAccountID)
+			labels[VaultSnapshotIDLabel] = copyID
+			labels[VaultAccountLabel] = smgr.vaultAccountID
+		}
+	}
+	return labels
+}
+
+func retentionOrDefault(days, def int64) int64 {
+	if days > 0 {
+		return days
+	}
+	return def
+}
+
+// copyToVault shares the given snapshot with the vault account and copies it
+// there, so the copy is owned by the vault account. Once the copy completed,
+// the snapshot isn't shared anymore
+func (smgr *SnapshotManager) copyToVault(ctx context.Context, logger log.FieldLogger,
+	snapshotID string, tags []*awsec2.Tag, days int64) (string, error) {
+
+	if _, err := smgr.client.ModifySnapshotAttributeWithContext(ctx, &awsec2.ModifySnapshotAttributeInput{
+		SnapshotId: aws.String(snapshotID),
+		Attribute:  aws.String(awsec2.SnapshotAttributeNameCreateVolumePermission),
+		CreateVolumePermission: &awsec2.CreateVolumePermissionModifications{
+			Add: []*awsec2.CreateVolumePermission{
+				{UserId: aws.String(smgr.vaultAccountID)},
+			},
+		},
+	}); err != nil {
+		return "", fmt.Errorf("cannot share snapshot: %+v", err)
+	}
+	modifySnapshotAttributeRequests.Inc()
+
+	copyID, err := smgr.copyTo(ctx, smgr.vaultClient, snapshotID, tags, days, smgr.vaultKMSKeyID)
+	if err != nil {
+		smgr.unshare(ctx, logger, snapshotID)
+		return "", err
+	}
+
+	// The copy needs the share until it completed. If waiting fails, the
+	// snapshot stays shared, so the copy isn't broken
+	copySnap, err := smgr.waitForSnapshot(ctx, smgr.vaultClient, copyID)
+	if err != nil {
+		logger.Errorf("Couldn't wait for vault copy %s to complete, snapshot stays shared: %+v", copyID, err)
+		return copyID, nil
+	}
+	if state := aws.StringValue(copySnap.State); state != awsec2.SnapshotStateCompleted {
+		smgr.unshare(ctx, logger, snapshotID)
+		return "", fmt.Errorf("vault copy %s is in state %s: %s", copyID, state,
+			aws.StringValue(copySnap.StateMessage))
+	}
+	smgr.unshare(ctx, logger, snapshotID)
+	return copyID, nil
+}
+
+// unshare revokes the share of the given snapshot with the vault account
+func (smgr *SnapshotManager) unshare(ctx context.Context, logger log.FieldLogger, snapshotID string) {
+	if _, err := smgr.client.ModifySnapshotAttributeWithContext(ctx, &awsec2.ModifySnapshotAttributeInput{
+		SnapshotId: aws.String(snapshotID),
+		Attribute:  aws.String(awsec2.SnapshotAttributeNameCreateVolumePermission),
+		CreateVolumePermission: &awsec2.CreateVolumePermissionModifications{
+			Remove: []*awsec2.CreateVolumePermission{
+				{UserId: aws.String(smgr.vaultAccountID)},
+			},
+		},
+	}); err != nil {
+		logger.Errorf("Couldn't revoke share with vault account %s: %+v", smgr.vaultAccountID, err)
+		return
+	}
+	modifySnapshotAttributeRequests.Inc()
+}
+
+// copyTo copies the given snapshot using the given client, i.e. into the
+// region and account of the client. The copy is tagged like the source
+// snapshot, but with its own delete after date. It returns the ID of the copy
+func (smgr *SnapshotManager) copyTo(ctx context.Context, client *awsec2.EC2,
+	snapshotID string, tags []*awsec2.Tag, days int64, kmsKeyID string) (string, error) {
+
+	in := &awsec2.CopySnapshotInput{
+		SourceRegion:     smgr.client.Config.Region,
+		SourceSnapshotId: aws.String(snapshotID),
+		Description:      aws.String(defaultDescription),
+	}
+	if kmsKeyID != "" {
+		in.Encrypted = aws.Bool(true)
+		in.KmsKeyId = aws.String(kmsKeyID)
+	}
+	out, err := client.CopySnapshotWithContext(ctx, in)
+	copySnapshotRequests.Inc()
+	if err != nil {
+		return "", err
+	}
+	if out.SnapshotId == nil {
+		return "", fmt.Errorf("copy snapshot ID is nil")
+	}
+
+	deleteAfter := time.Now().Add(time.Duration(days) * 24 * time.Hour)
+	copyTags := []*awsec2.Tag{
+		{
+			Key:   aws.String(smgr.deleteAfterTag),
+			Value: aws.String(deleteAfter.Format(time.RFC3339)),
+		},
+		{
+			Key:   aws.String(smgr.retentionTag),
+			Value: aws.String(fmt.Sprintf("%d", days)),
+		},
+		{
+			Key:   aws.String(sourceSnapshotIDTag),
+			Value: aws.String(snapshotID),
+		},
+		{
+			Key:   aws.String(sourceRegionTag),
+			Value: smgr.client.Config.Region,
+		},
+	}
+	// Copies have their own retention, hence the retention policy of the
+	// source is not applied to them
+	for _, t := range tags {
+		if k := aws.StringValue(t.Key); k != smgr.deleteAfterTag && k != smgr.retentionPolicyTag {
+			copyTags = append(copyTags, t)
+		}
+	}
+	if _, err := client.CreateTagsWithContext(ctx, &awsec2.CreateTagsInput{
+		Resources: []*string{out.SnapshotId},
+		Tags:      copyTags,
+	}); err != nil {
+		return "", err
+	}
+	createTagsRequests.Inc()
+
+	return *out.SnapshotId, nil
+}
+
 // Prune deletes all matching EBS snapshots, i.e. snapshots with a delete after
-// tag that is set to a date in the past
+// tag that is set to a date in the past. If snapshots are copied to a second
+// region, the copies are pruned there as well. Vault copies are never pruned
+// from the source account, so a compromised source account can't delete them.
+// They are pruned by a job running in the vault account instead
 func (smgr *SnapshotManager) Prune(ctx context.Context) error {
+	for _, client := range []*awsec2.EC2{smgr.client, smgr.copyClient} {
+		if client == nil {
+			continue
+		}
+		if err := smgr.prune(ctx, client); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// prune deletes the matching EBS snapshots using the given client, volume by
+// volume
+func (smgr *SnapshotManager) prune(ctx context.Context, client *awsec2.EC2) error {
 
-	snaps, err := smgr.fetchSnapshots(ctx)
+	snaps, err := smgr.fetchSnapshots(ctx, client)
 	if err != nil {
 		return err
 	}
+
+	// Copies don't refer to the source volume, hence the volume is
+	// looked up by tag if possible
+	byVolume := make(map[string][]*awsec2.Snapshot)
+	for _, snap := range snaps {
+		volumeID := aws.StringValue(snap.VolumeId)
+		if id, ok := tagMap(snap.Tags)[volumeIDTag]; ok {
+			volumeID = id
+		}
+		byVolume[volumeID] = append(byVolume[volumeID], snap)
+	}
+
+	for volumeID, volumeSnaps := range byVolume {
+		smgr.pruneVolume(ctx, client, volumeID, volumeSnaps)
+	}
+
+	return nil
+}
+
+// pruneVolume deletes the given snapshots of a volume. If the newest snapshot
+// has a retention policy tag, the policy decides over all completed snapshots
+// with such a tag. All other snapshots are deleted by their delete after
+// date. The newest completed snapshots are never deleted, see minKeepOf
+func (smgr *SnapshotManager) pruneVolume(ctx context.Context, client *awsec2.EC2,
+	volumeID string, snaps []*awsec2.Snapshot) {
+
+	logger := smgr.logger.WithFields(log.Fields{
+		"volume-id": volumeID,
+	})
+
+	var (
+		completed   []*awsec2.Snapshot
+		completedAt []time.Time
+		newest      *awsec2.Snapshot
+	)
 	for _, snap := range snaps {
-		smgr.logger.Infof("Processing snapshot %s", *snap.SnapshotId)
-		for _, tag := range snap.Tags {
-			if tag.Key == nil {
+		if aws.StringValue(snap.State) != awsec2.SnapshotStateCompleted {
+			continue
+		}
+		completed = append(completed, snap)
+		completedAt = append(completedAt, aws.TimeValue(snap.StartTime))
+		if newest == nil || snap.StartTime.After(*newest.StartTime) {
+			newest = snap
+		}
+	}
+
+	protected := make(map[string]bool)
+	// byPolicy holds whether to keep the snapshots governed by the
+	// retention policy
+	byPolicy := make(map[string]bool)
+	var policy string
+	if newest != nil {
+		policy = smgr.evaluateRetention(logger, newest, completed, completedAt, protected, byPolicy)
+	}
+
+	for _, snap := range snaps {
+		logger.Infof("Processing snapshot %s", *snap.SnapshotId)
+		// add context to the logger
+		snapLogger := logger.WithFields(log.Fields{
+			"snapshotID": *snap.SnapshotId,
+		})
+
+		if protected[*snap.SnapshotId] {
+			snapLogger.Info("Snapshot kept as one of the newest snapshots of the volume")
+			continue
+		}
+
+		if keep, ok := byPolicy[*snap.SnapshotId]; ok {
+			if keep {
+				snapLogger.Info("Snapshot kept by retention policy")
 				continue
 			}
-			if *tag.Key == smgr.deleteAfterTag {
-				// add context to the logger
-				logger := smgr.logger.WithFields(log.Fields{
-					"snapshotID": *snap.SnapshotId,
-				})
-				if tag.Value == nil {
-					logger.Errorf("Delete after tag value is nil")
-					continue
-				}
-
-				deleteAfter, err := time.Parse(time.RFC3339, *tag.Value)
-				if err != nil {
-					logger.Error("Couldn't parse tag value for : %+v", err)
-					break
-				}
-				if time.Now().Before(deleteAfter) {
-					logger.Info("Snapshot not yet scheduled for deletion")
-					break
-				}
-				if _, err := smgr.client.DeleteSnapshotWithContext(ctx, &awsec2.DeleteSnapshotInput{
-					SnapshotId: snap.SnapshotId,
-				}); err != nil {
-					logger.Error("Couldn't delete snapshot: %+v", err)
-					break
-				}
-				deleteSnapshotRequests.Inc()
-				logger.Info("Successfully deleted snapshot")
-				if err := smgr.datastore.DeleteSnapshotInfo(&datastore.SnapshotInfo{
-					Resource: datastore.SnapshotResource(*snap.VolumeId),
-					ID:       datastore.SnapshotID(*snap.SnapshotId),
-					// The createdAt timestamp is used as a key for ordering
-					// in the datatstore. Hence we need to ensure it is
-					// stable. To avoid problems it was truncated to one
-					// minute during creation above
-					CreatedAt: (*snap.StartTime).Truncate(time.Minute),
-				}); err != nil {
-					smgr.logger.Error(err)
-				}
-				break
+			smgr.deleteSnapshot(ctx, client, snapLogger, volumeID, snap,
+				fmt.Sprintf("not kept by retention policy %s", policy))
+			continue
+		}
+
+		deleteAfter, err := time.Parse(time.RFC3339, tagMap(snap.Tags)[smgr.deleteAfterTag])
+		if err != nil {
+			snapLogger.Errorf("Couldn't parse tag value for : %+v", err)
+			continue
+		}
+		if time.Now().Before(deleteAfter) {
+			snapLogger.Info("Snapshot not yet scheduled for deletion")
+			continue
+		}
+		smgr.deleteSnapshot(ctx, client, snapLogger, volumeID, snap,
+			fmt.Sprintf("expired on %s", deleteAfter.Format(time.RFC3339)))
+	}
+}
+
+// evaluateRetention marks the completed snapshots of a volume that are
+// protected as the newest ones and decides over the snapshots governed by the
+// retention policy set on the newest snapshot. It returns that policy
+func (smgr *SnapshotManager) evaluateRetention(logger log.FieldLogger, newest *awsec2.Snapshot,
+	completed []*awsec2.Snapshot, completedAt []time.Time, protected, byPolicy map[string]bool) string {
+
+	for i, keep := range snapshot.KeepNewest(completedAt, smgr.minKeepOf(logger, newest)) {
+		protected[*completed[i].SnapshotId] = keep
+	}
+
+	if spec, ok := tagMap(newest.Tags)[smgr.retentionPolicyTag]; ok {
+		var (
+			policySnaps []*awsec2.Snapshot
+			policyAt    []time.Time
+		)
+		for _, snap := range completed {
+			if _, ok := tagMap(snap.Tags)[smgr.retentionPolicyTag]; ok {
+				policySnaps = append(policySnaps, snap)
+				policyAt = append(policyAt, aws.TimeValue(snap.StartTime))
 			}
 		}
+
+		policy, err := snapshot.ParseRetentionPolicy(spec)
+		if err != nil {
+			// Rather keep all snapshots than deleting the wrong ones
+			logger.Errorf("Couldn't parse retention policy, keeping snapshots: %+v", err)
+			for _, snap := range policySnaps {
+				byPolicy[*snap.SnapshotId] = true
+			}
+		} else {
+			logger.Infof("Pruning %d snapshots with retention policy %s", len(policySnaps), policy)
+			for i, keep := range policy.Keep(policyAt) {
+				byPolicy[*policySnaps[i].SnapshotId] = keep
+			}
+		}
+		return spec
 	}
+	return ""
+}
 
-	return nil
+// minKeepOf returns the number of newest snapshots of a volume that must not
+// be pruned, as given by the min keep tag of the given snapshot or else the
+// default of the SnapshotManager
+func (smgr *SnapshotManager) minKeepOf(logger log.FieldLogger, snap *awsec2.Snapshot) int {
+	v, ok := tagMap(snap.Tags)[smgr.minKeepTag]
+	if !ok {
+		return smgr.minKeep
+	}
+	n, err := strconv.Atoi(v)
+	if err != nil || n < 0 {
+		logger.Warnf("Couldn't parse min keep tag value %q. Falling back to default value", v)
+		return smgr.minKeep
+	}
+	return n
+}
+
+// deleteSnapshot deletes the given snapshot of the given volume using the
+// given client and its snapshot info. The snapshot infos in the datastore
+// refer to the source snapshots, hence they are not deleted when deleting a
+// copy. In dry-run mode the deletion is only added to the plan
+func (smgr *SnapshotManager) deleteSnapshot(ctx context.Context, client *awsec2.EC2,
+	logger log.FieldLogger, volumeID string, snap *awsec2.Snapshot, reason string) {
+
+	if smgr.plan != nil {
+		smgr.plan.Add(snapshot.Action{
+			Action:   snapshot.ActionDelete,
+			Resource: volumeID,
+			Snapshot: *snap.SnapshotId,
+			Reason:   reason,
+		})
+		return
+	}
+
+	if _, err := client.DeleteSnapshotWithContext(ctx, &awsec2.DeleteSnapshotInput{
+		SnapshotId: snap.SnapshotId,
+	}); err != nil {
+		logger.Errorf("Couldn't delete snapshot: %+v", err)
+		return
+	}
+	deleteSnapshotRequests.Inc()
+	logger.Info("Successfully deleted snapshot")
+	// Prune-only jobs, e.g. in a vault account, may run without datastore
+	if _, ok := tagMap(snap.Tags)[sourceSnapshotIDTag]; ok || smgr.datastore == nil {
+		return
+	}
+	if err := smgr.datastore.DeleteSnapshotInfo(ctx, &datastore.SnapshotInfo{
+		Resource: datastore.SnapshotResource(*snap.VolumeId),
+		ID:       datastore.SnapshotID(*snap.SnapshotId),
+		// The createdAt timestamp is used as a key for ordering
+		// in the datatstore. Hence we need to ensure it is
+		// stable. To avoid problems it was truncated to one
+		// minute during creation above
+		CreatedAt: (*snap.StartTime).Truncate(time.Minute),
+	}); err != nil {
+		logger.Error(err)
+	}
+	smgr.forgetGroup(ctx, logger, snap)
 }
@@ -0,0 +1,462 @@
+package ec2
+
+import (
+	"context"
+	"fmt"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/aws/aws-sdk-go/aws"
+	awsec2 "github.com/aws/aws-sdk-go/service/ec2"
+	"github.com/prometheus/client_golang/prometheus"
+	log "github.com/sirupsen/logrus"
+
+	"github.com/grid-x/aws-auto-snapshot/pkg/datastore"
+	"github.com/grid-x/aws-auto-snapshot/pkg/snapshot"
+)
+
+const (
+	// groupIDTag, instanceIDTag and deviceTag are set on the snapshots of
+	// a group
+	groupIDTag    = "snapshot-group-id"
+	instanceIDTag = "instance-id"
+	deviceTag     = "device"
+
+	// groupStateIncomplete is the state of groups of which not all
+	// snapshots completed
+	groupStateIncomplete = "incomplete"
+)
+
+// Labels of the snapshot infos of groups. The snapshots of a group are
+// recorded with the GroupIDLabel, InstanceIDLabel and DeviceLabel. The group
+// itself is recorded as resource of the instance with the group ID as
+// snapshot ID, its StateLabel and one label per volume, consisting of the
+// GroupMemberLabelPrefix and the device name, holding the snapshot ID
+const (
+	GroupIDLabel    = "group-id"
+	InstanceIDLabel = "instance-id"
+	DeviceLabel     = "device"
+
+	GroupMemberLabelPrefix = "member:"
+)
+
+var describeInstancesRequests = prometheus.NewCounter(prometheus.CounterOpts{
+	Name: "ec2_describe_instances_requests_total",
+	Help: "Total number of describe instances requests",
+})
+
+func init() {
+	prometheus.MustRegister(describeInstancesRequests)
+}
+
+// WithInstanceGroups makes the SnapshotManager select instances instead of
+// volumes by the backup tag and snapshot all EBS volumes attached to an
+// instance as one group. The snapshots of a group are created right after
+// each other, within one run of the hooks if enabled, and pruned alike, as
+// their retention is given by the tags of the instance.
+//
+// EC2 only offers crash-consistent multi-volume snapshots via CreateSnapshots,
+// which the vendored SDK lacks. Hence without hooks freezing the file systems,
+// a group is not crash-consistent across its volumes, as each snapshot has its
+// own point in time
+func WithInstanceGroups() Opt {
+	return func(m *SnapshotManager) {
+		m.groupByInstance = true
+	}
+}
+
+// groupMember refers to the group a volume is snapshotted in
+type groupMember struct {
+	groupID      string
+	instanceID   string
+	device       string
+	instanceTags map[string]string
+}
+
+func (m *groupMember) tags() []*awsec2.Tag {
+	return []*awsec2.Tag{
+		{Key: aws.String(groupIDTag), Value: aws.String(m.groupID)},
+		{Key: aws.String(instanceIDTag), Value: aws.String(m.instanceID)},
+		{Key: aws.String(deviceTag), Value: aws.String(m.device)},
+	}
+}
+
+func (m *groupMember) labels() datastore.SnapshotLabels {
+	if m == nil {
+		return nil
+	}
+	return datastore.SnapshotLabels{
+		GroupIDLabel:    m.groupID,
+		InstanceIDLabel: m.instanceID,
+		DeviceLabel:     m.device,
+	}
+}
+
+// pendingGroup is a group of snapshots that were created but are not yet
+// recorded in the datastore
+type pendingGroup struct {
+	info    *datastore.SnapshotInfo
+	members []*pendingSnapshot
+	// volumes is the number of volumes of the instance, which is more than
+	// the number of members if creating a snapshot failed
+	volumes int
+	logger  log.FieldLogger
+}
+
+// groupID returns the ID of the group of the given instance created at the
+// given time. It encodes both, so the group can be looked up by its ID
+func groupID(instanceID string, createdAt time.Time) string {
+	return fmt.Sprintf("%s-%d", instanceID, createdAt.Unix())
+}
+
+// parseGroupID returns the instance and creation time encoded in a group ID
+func parseGroupID(id string) (string, time.Time, error) {
+	i := strings.LastIndex(id, "-")
+	if i <= 0 {
+		return "", time.Time{}, fmt.Errorf("invalid group ID %q", id)
+	}
+	ts, err := strconv.ParseInt(id[i+1:], 10, 64)
+	if err != nil {
+		return "", time.Time{}, fmt.Errorf("invalid group ID %q", id)
+	}
+	return id[:i], time.Unix(ts, 0), nil
+}
+
+// ebsDevices returns the EBS volumes attached to the given instance by device
+// name
+func ebsDevices(instance *awsec2.Instance) map[string]string {
+	devices := make(map[string]string)
+	for _, m := range instance.BlockDeviceMappings {
+		if m.Ebs == nil || m.Ebs.VolumeId == nil || m.DeviceName == nil {
+			continue
+		}
+		devices[*m.DeviceName] = *m.Ebs.VolumeId
+	}
+	return devices
+}
+
+func sortedKeys(m map[string]string) []string {
+	keys := make([]string, 0, len(m))
+	for k := range m {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	return keys
+}
+
+func (smgr *SnapshotManager) fetchInstances(ctx context.Context) ([]*awsec2.Instance, error) {
+	var result []*awsec2.Instance
+	if err := smgr.client.DescribeInstancesPagesWithContext(ctx, &awsec2.DescribeInstancesInput{
+		Filters: []*awsec2.Filter{
+			{
+				Name: aws.String("tag-key"),
+				Values: []*string{
+					aws.String(smgr.backupTag),
+					aws.String(strings.ToLower(smgr.backupTag)), // we are not case sensitive
+				},
+			},
+			{
+				Name: aws.String("instance-state-name"),
+				Values: []*string{
+					aws.String(awsec2.InstanceStateNameRunning),
+					aws.String(awsec2.InstanceStateNameStopping),
+					aws.String(awsec2.InstanceStateNameStopped),
+				},
+			},
+		},
+	}, func(out *awsec2.DescribeInstancesOutput, last bool) bool {
+		describeInstancesRequests.Inc()
+		for _, r := range out.Reservations {
+			for _, instance := range r.Instances {
+				if instance.InstanceId == nil {
+					//skip
+					continue
+				}
+				result = append(result, instance)
+			}
+		}
+		return true
+	}); err != nil {
+		return nil, err
+	}
+	return result, nil
+}
+
+// snapshotGroups creates one snapshot group per matching instance. Only
+// snapshots that completed are recorded in the datastore, the group is
+// recorded in any case, but marked as incomplete if not all of its snapshots
+// completed
+func (smgr *SnapshotManager) snapshotGroups(ctx context.Context) error {
+	instances, err := smgr.fetchInstances(ctx)
+	if err != nil {
+		return err
+	}
+
+	if smgr.plan != nil {
+		for _, instance := range instances {
+			devices := ebsDevices(instance)
+			for _, device := range sortedKeys(devices) {
+				smgr.plan.Add(snapshot.Action{
+					Action:   snapshot.ActionSnapshot,
+					Resource: devices[device],
+					Reason: fmt.Sprintf("%s tag set on instance %s, device %s",
+						smgr.backupTag, *instance.InstanceId, device),
+				})
+			}
+		}
+		return nil
+	}
+
+	// Create all groups first, so their snapshots progress in parallel
+	// while we wait for them to complete
+	var (
+		pending      []*pendingGroup
+		failed       int
+		hookFailures int
+	)
+	for _, instance := range instances {
+		g, err := smgr.createGroup(ctx, instance)
+		if _, ok := err.(*hookError); ok {
+			hookFailures++
+		}
+		if g == nil {
+			if err != nil {
+				failed++
+			}
+			continue
+		}
+		pending = append(pending, g)
+	}
+
+	// The groups are recorded concurrently, so the completion timeout
+	// applies to each of them rather than adding up
+	complete := make([]bool, len(pending))
+	var wg sync.WaitGroup
+	for i, g := range pending {
+		wg.Add(1)
+		go func(i int, g *pendingGroup) {
+			defer wg.Done()
+			complete[i] = smgr.recordGroup(ctx, g)
+		}(i, g)
+	}
+	wg.Wait()
+	for _, c := range complete {
+		if !c {
+			failed++
+		}
+	}
+	switch {
+	case failed > 0 && hookFailures > 0:
+		return fmt.Errorf("%d of %d snapshot groups are incomplete, hooks of %d instances failed",
+			failed, len(instances), hookFailures)
+	case failed > 0:
+		return fmt.Errorf("%d of %d snapshot groups are incomplete", failed, len(instances))
+	case hookFailures > 0:
+		return fmt.Errorf("hooks of %d of %d instances failed", hookFailures, len(instances))
+	}
+	return nil
+}
+
+// createGroup creates the snapshots of all EBS volumes of the given instance,
+// running the hooks around them if the instance or any of its volumes has the
+// hook tag. A group is returned if any snapshot was created, even if others
+// or the hooks failed. Errors are logged already
+func (smgr *SnapshotManager) createGroup(ctx context.Context, instance *awsec2.Instance) (*pendingGroup, error) {
+	instanceID := *instance.InstanceId
+	logger := smgr.logger.WithField("instance-id", instanceID)
+
+	devices := ebsDevices(instance)
+	if len(devices) == 0 {
+		logger.Warn("Instance has no EBS volumes")
+		return nil, nil
+	}
+
+	var ids []*string
+	for _, id := range devices {
+		ids = append(ids, aws.String(id))
+	}
+	out, err := smgr.client.DescribeVolumesWithContext(ctx, &awsec2.DescribeVolumesInput{
+		VolumeIds: ids,
+	})
+	describeVolumesRequets.Inc()
+	if err != nil {
+		logger.Errorf("Couldn't describe volumes: %+v", err)
+		return nil, err
+	}
+	volumes := make(map[string]*awsec2.Volume, len(out.Volumes))
+	hooks := smgr.hasHookTag(instance.Tags)
+	for _, v := range out.Volumes {
+		volumes[aws.StringValue(v.VolumeId)] = v
+		hooks = hooks || smgr.hasHookTag(v.Tags)
+	}
+
+	created := time.Now()
+	id := groupID(instanceID, created)
+	logger = logger.WithField("group-id", id)
+	g := &pendingGroup{
+		info: &datastore.SnapshotInfo{
+			Resource:  datastore.SnapshotResource(instanceID),
+			ID:        datastore.SnapshotID(id),
+			CreatedAt: time.Unix(created.Unix(), 0),
+		},
+		volumes: len(devices),
+		logger:  logger,
+	}
+
+	instanceTags := tagMap(instance.Tags)
+	snapshotAll := func() error {
+		logger.Infof("Creating snapshot group of %d volumes", len(devices))
+		for _, device := range sortedKeys(devices) {
+			volume := volumes[devices[device]]
+			if volume == nil {
+				err := fmt.Errorf("volume %s of device %s not found", devices[device], device)
+				logger.Error(err)
+				return err
+			}
+			p, err := smgr.startSnapshot(ctx, volume, &groupMember{
+				groupID:      id,
+				instanceID:   instanceID,
+				device:       device,
+				instanceTags: instanceTags,
+			})
+			if err != nil {
+				return err
+			}
+			g.members = append(g.members, p)
+		}
+		return nil
+	}
+
+	if hooks {
+		err = smgr.runWithHooks(ctx, logger, instanceID, snapshotAll)
+	} else {
+		err = snapshotAll()
+	}
+
+	// The snapshots are tagged only after all of them were created, so
+	// their points in time are as close as possible
+	var members []*pendingSnapshot
+	for _, p := range g.members {
+		if tagErr := smgr.tagSnapshot(ctx, p); tagErr != nil {
+			if err == nil {
+				err = tagErr
+			}
+			continue
+		}
+		members = append(members, p)
+	}
+	g.members = members
+
+	if len(g.members) == 0 {
+		return nil, err
+	}
+	return g, err
+}
+
+// recordGroup records the snapshots of the given group and the group itself.
+// It returns whether all snapshots of the group completed
+func (smgr *SnapshotManager) recordGroup(ctx context.Context, g *pendingGroup) bool {
+	complete := len(g.members) == g.volumes
+	labels := datastore.SnapshotLabels{}
+	for i, err := range smgr.recordSnapshots(ctx, g.members) {
+		p := g.members[i]
+		if err != nil {
+			p.logger.Error(err)
+			complete = false
+			continue
+		}
+		labels[GroupMemberLabelPrefix+p.labels[DeviceLabel]] = string(p.info.ID)
+	}
+
+	labels[StateLabel] = awsec2.SnapshotStateCompleted
+	if !complete {
+		labels[StateLabel] = groupStateIncomplete
+	}
+	g.info.Labels = labels
+	if smgr.datastore == nil {
+		return complete
+	}
+	if err := smgr.datastore.StoreSnapshotInfo(ctx, g.info); err != nil {
+		g.logger.Errorf("Couldn't record snapshot group: %+v", err)
+		return false
+	}
+	if !complete {
+		g.logger.Errorf("Snapshot group is incomplete")
+	}
+	return complete
+}
+
+// forgetGroup deletes the snapshot info of the group of the given snapshot,
+// if any, as the group can't be restored as a whole anymore
+func (smgr *SnapshotManager) forgetGroup(ctx context.Context, logger log.FieldLogger, snap *awsec2.Snapshot) {
+	tags := tagMap(snap.Tags)
+	id, ok := tags[groupIDTag]
+	if !ok {
+		return
+	}
+	instanceID, createdAt, err := parseGroupID(id)
+	if err != nil {
+		logger.Error(err)
+		return
+	}
+	if err := smgr.datastore.DeleteSnapshotInfo(ctx, &datastore.SnapshotInfo{
+		Resource:  datastore.SnapshotResource(instanceID),
+		ID:        datastore.SnapshotID(id),
+		CreatedAt: createdAt,
+	}); err != nil {
+		logger.Errorf("Couldn't delete snapshot group info: %+v", err)
+	}
+}
+
+// Group is a recorded group of snapshots of all EBS volumes of an instance
+type Group struct {
+	ID         string
+	InstanceID string
+	CreatedAt  time.Time
+	State      string
+	// Snapshots holds the snapshot IDs by device name
+	Snapshots map[string]string
+}
+
+// Complete returns whether all snapshots of the group completed
+func (g *Group) Complete() bool {
+	return g.State == awsec2.SnapshotStateCompleted
+}
+
+// Devices returns the device names of the group in order
+func (g *Group) Devices() []string {
+	return sortedKeys(g.Snapshots)
+}
+
+// LookupGroup returns the snapshot group with the given ID recorded in the
+// given datastore
+func LookupGroup(ctx context.Context, ds datastore.Datastore, id string) (*Group, error) {
+	instanceID, createdAt, err := parseGroupID(id)
+	if err != nil {
+		return nil, err
+	}
+	info, err := ds.GetSnapshotInfoAt(ctx, datastore.SnapshotResource(instanceID), createdAt)
+	if err != nil {
+		return nil, err
+	}
+	if string(info.ID) != id {
+		return nil, &datastore.NotFoundError{Resource: datastore.SnapshotResource(instanceID)}
+	}
+
+	g := &Group{
+		ID:         id,
+		InstanceID: instanceID,
+		CreatedAt:  info.CreatedAt,
+		State:      info.Labels[StateLabel],
+		Snapshots:  make(map[string]string),
+	}
+	for k, v := range info.Labels {
+		if strings.HasPrefix(k, GroupMemberLabelPrefix) {
+			g.Snapshots[strings.TrimPrefix(k, GroupMemberLabelPrefix)] = v
+		}
+	}
+	return g, nil
+}
@@ -0,0 +1,240 @@
+package ec2
+
+import (
+	"context"
+	"fmt"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/aws/awserr"
+	awsec2 "github.com/aws/aws-sdk-go/service/ec2"
+	"github.com/aws/aws-sdk-go/service/ssm"
+	"github.com/prometheus/client_golang/prometheus"
+	log "github.com/sirupsen/logrus"
+)
+
+const (
+	defaultHookTag     = "snapshot-hook"
+	defaultHookTimeout = 5 * time.Minute
+	hookPollInterval   = 2 * time.Second
+
+	// hookDocument is the SSM document used to run the hook commands
+	hookDocument = "AWS-RunShellScript"
+
+	preSnapshotHook  = "pre-snapshot"
+	postSnapshotHook = "post-snapshot"
+)
+
+var (
+	sendCommandRequests = prometheus.NewCounter(prometheus.CounterOpts{
+		Name: "ssm_send_command_requests_total",
+		Help: "Total number of send command requests",
+	})
+	getCommandInvocationRequests = prometheus.NewCounter(prometheus.CounterOpts{
+		Name: "ssm_get_command_invocation_requests_total",
+		Help: "Total number of get command invocation requests",
+	})
+	failedHooks = prometheus.NewCounter(prometheus.CounterOpts{
+		Name: "ec2_failed_snapshot_hooks_total",
+		Help: "Total number of pre and post snapshot hooks that failed",
+	})
+)
+
+func init() {
+	prometheus.MustRegister(sendCommandRequests)
+	prometheus.MustRegister(getCommandInvocationRequests)
+	prometheus.MustRegister(failedHooks)
+}
+
+// WithHooks makes the SnapshotManager run the given commands via SSM Run
+// Command on the instance a volume is attached to right before and after
+// snapshotting it, if the volume has the hook tag, e.g. to freeze and unfreeze
+// its file system for application-consistent snapshots. The post-snapshot
+// command always runs, even if the pre-snapshot command or the snapshot
+// failed
+func WithHooks(client *ssm.SSM, preSnapshotCommand, postSnapshotCommand string) Opt {
+	return func(m *SnapshotManager) {
+		m.ssmClient = client
+		m.preSnapshotCommand = preSnapshotCommand
+		m.postSnapshotCommand = postSnapshotCommand
+	}
+}
+
+// WithHookTag sets the tag key that enables the hooks for a volume
+func WithHookTag(t string) Opt {
+	return func(m *SnapshotManager) {
+		m.hookTag = t
+	}
+}
+
+// WithHookTimeout sets how long each hook command may run
+func WithHookTimeout(d time.Duration) Opt {
+	return func(m *SnapshotManager) {
+		m.hookTimeout = d
+	}
+}
+
+// hookError is returned if a hook of a volume failed
+type hookError struct {
+	hook       string
+	instanceID string
+	err        error
+}
+
+func (e *hookError) Error() string {
+	return fmt.Sprintf("%s hook on instance %s failed: %+v", e.hook, e.instanceID, e.err)
+}
+
+// hasHookTag reports whether hooks are configured and the given tags enable
+// them
+func (smgr *SnapshotManager) hasHookTag(tags []*awsec2.Tag) bool {
+	if smgr.ssmClient == nil {
+		return false
+	}
+	for k := range tagMap(tags) {
+		if strings.ToLower(k) == strings.ToLower(smgr.hookTag) {
+			return true
+		}
+	}
+	return false
+}
+
+// hookInstance returns the instance to run the hooks of the given volume on,
+// or an empty ID if the volume has no hooks. Volumes that aren't attached
+// don't need hooks, as nothing writes to them
+func (smgr *SnapshotManager) hookInstance(volume *awsec2.Volume) string {
+	if !smgr.hasHookTag(volume.Tags) {
+		return ""
+	}
+	for _, a := range volume.Attachments {
+		if aws.StringValue(a.State) == awsec2.VolumeAttachmentStateAttached {
+			return aws.StringValue(a.InstanceId)
+		}
+	}
+	return ""
+}
+
+// snapshotVolume creates a snapshot of the given volume, running the hooks
+// around it if the volume has any. A snapshot is returned if it was created,
+// even if the post-snapshot hook failed. Errors are logged already
+func (smgr *SnapshotManager) snapshotVolume(ctx context.Context, volume *awsec2.Volume) (*pendingSnapshot, error) {
+	instanceID := smgr.hookInstance(volume)
+	if instanceID == "" {
+		return smgr.createSnapshot(ctx, volume, nil)
+	}
+	logger := smgr.logger.WithFields(log.Fields{
+		"volume-id":   volume.VolumeId,
+		"instance-id": instanceID,
+	})
+
+	var p *pendingSnapshot
+	err := smgr.runWithHooks(ctx, logger, instanceID, func() error {
+		var err error
+		p, err = smgr.createSnapshot(ctx, volume, nil)
+		return err
+	})
+	return p, err
+}
+
+// runWithHooks runs the pre-snapshot hook on the given instance, the given
+// snapshot func if the hook succeeded and the post-snapshot hook in any case.
+// It returns the first error
+func (smgr *SnapshotManager) runWithHooks(ctx context.Context, logger log.FieldLogger,
+	instanceID string, snapshot func() error) error {
+
+	err := smgr.runHook(ctx, logger, instanceID, preSnapshotHook, smgr.preSnapshotCommand)
+	if err == nil {
+		err = snapshot()
+	}
+
+	// The post-snapshot hook gets its own context, so e.g. a file system is
+	// unfrozen even if the job was canceled in the meantime
+	postCtx, cancel := context.WithTimeout(context.Background(), smgr.hookTimeout)
+	defer cancel()
+	if postErr := smgr.runHook(postCtx, logger, instanceID, postSnapshotHook, smgr.postSnapshotCommand); postErr != nil && err == nil {
+		err = postErr
+	}
+	return err
+}
+
+// runHook runs the given command on the instance and waits for it to finish.
+// Failures are logged and returned as hookError
+func (smgr *SnapshotManager) runHook(ctx context.Context, logger log.FieldLogger,
+	instanceID, hook, command string) error {
+
+	if command == "" {
+		return nil
+	}
+	logger = logger.WithField("hook", hook)
+	logger.Infof("Running %s hook", hook)
+	if err := smgr.runCommand(ctx, logger, instanceID, command); err != nil {
+		failedHooks.Inc()
+		err := &hookError{hook: hook, instanceID: instanceID, err: err}
+		logger.Error(err)
+		return err
+	}
+	logger.Infof("Finished %s hook", hook)
+	return nil
+}
+
+// runCommand runs the command on the instance via SSM Run Command and waits
+// for it to succeed
+func (smgr *SnapshotManager) runCommand(ctx context.Context, logger log.FieldLogger,
+	instanceID, command string) error {
+
+	ctx, cancel := context.WithTimeout(ctx, smgr.hookTimeout)
+	defer cancel()
+
+	out, err := smgr.ssmClient.SendCommandWithContext(ctx, &ssm.SendCommandInput{
+		DocumentName: aws.String(hookDocument),
+		InstanceIds:  []*string{aws.String(instanceID)},
+		Comment:      aws.String("snapshot hook run by grid-x/aws-auto-snapshot"),
+		Parameters: map[string][]*string{
+			"commands":         {aws.String(command)},
+			"executionTimeout": {aws.String(strconv.Itoa(int(smgr.hookTimeout / time.Second)))},
+		},
+	})
+	sendCommandRequests.Inc()
+	if err != nil {
+		return err
+	}
+	if out.Command == nil || out.Command.CommandId == nil {
+		return fmt.Errorf("command ID is nil")
+	}
+	commandID := out.Command.CommandId
+	logger.Debugf("Sent command %s", *commandID)
+
+	for {
+		select {
+		case <-ctx.Done():
+			return fmt.Errorf("command %s did not finish within %s", *commandID, smgr.hookTimeout)
+		case <-time.After(hookPollInterval):
+		}
+
+		inv, err := smgr.ssmClient.GetCommandInvocationWithContext(ctx, &ssm.GetCommandInvocationInput{
+			CommandId:  commandID,
+			InstanceId: aws.String(instanceID),
+		})
+		getCommandInvocationRequests.Inc()
+		if aerr, ok := err.(awserr.Error); ok && aerr.Code() == ssm.ErrCodeInvocationDoesNotExist {
+			// The invocation shows up with a delay
+			continue
+		} else if err != nil {
+			return err
+		}
+
+		switch status := aws.StringValue(inv.Status); status {
+		case ssm.CommandInvocationStatusPending,
+			ssm.CommandInvocationStatusInProgress,
+			ssm.CommandInvocationStatusDelayed:
+			continue
+		case ssm.CommandInvocationStatusSuccess:
+			return nil
+		default:
+			return fmt.Errorf("command %s ended with status %s: %s", *commandID, status,
+				strings.TrimSpace(aws.StringValue(inv.StandardErrorContent)))
+		}
+	}
+}
@@ -2,11 +2,70 @@ package ec2
 
 import (
 	"context"
+	"fmt"
+	"strings"
+	"time"
 
 	"github.com/aws/aws-sdk-go/aws"
 	awsec2 "github.com/aws/aws-sdk-go/service/ec2"
+	log "github.com/sirupsen/logrus"
+
+	"github.com/grid-x/aws-auto-snapshot/pkg/datastore"
+)
+
+const (
+	// restoredFromSnapshotTag and restoredAtTag are set on restored volumes
+	restoredFromSnapshotTag = "restored-from-snapshot"
+	restoredAtTag           = "restored-at"
+
+	// VolumeTagLabelPrefix prefixes the labels holding the tags of the
+	// volume a snapshot was created of
+	VolumeTagLabelPrefix = "tag:"
 )
 
+// snapshotOnlyTags are the tags set on snapshots that don't refer to the
+// source volume, hence aren't copied to restored volumes
+var snapshotOnlyTags = map[string]bool{
+	"Name":                  true,
+	"volume-name":           true,
+	defaultDeleteAfterTag:   true,
+	failedTag:               true,
+	pendingTag:              true,
+	volumeIDTag:             true,
+	sourceSnapshotIDTag:     true,
+	sourceRegionTag:         true,
+	groupIDTag:              true,
+	instanceIDTag:           true,
+	deviceTag:               true,
+	restoredFromSnapshotTag: true,
+	restoredAtTag:           true,
+}
+
+// VolumeTags returns the tags of the source volume recorded in the given
+// labels of a snapshot info
+func VolumeTags(labels datastore.SnapshotLabels) map[string]string {
+	tags := make(map[string]string)
+	for k, v := range labels {
+		if strings.HasPrefix(k, VolumeTagLabelPrefix) {
+			tags[strings.TrimPrefix(k, VolumeTagLabelPrefix)] = v
+		}
+	}
+	return tags
+}
+
+// volumeTagLabels returns the labels recording the given volume tags. Tags
+// reserved by AWS can't be set on restored volumes, hence they are skipped
+func volumeTagLabels(tags []*awsec2.Tag) datastore.SnapshotLabels {
+	labels := datastore.SnapshotLabels{}
+	for k, v := range tagMap(tags) {
+		if strings.HasPrefix(k, "aws:") {
+			continue
+		}
+		labels[VolumeTagLabelPrefix+k] = v
+	}
+	return labels
+}
+
 // RestoreManager manages a restore operation from an EBS snapshot
 type RestoreManager struct {
 	client *awsec2.EC2
@@ -17,6 +76,20 @@ type RestoreManager struct {
 	encrypted  bool
 	kmsKeyID   *string
 	volumeType *string
+
+	// instanceID is set if the volume is attached to the instance at the
+	// device once it is available
+	instanceID     string
+	device         string
+	stopInstance   bool
+	detachExisting bool
+
+	// sourceTags are the tags of the source volume, which are derived from
+	// the snapshot tags if not set. tags are added to them
+	sourceTags map[string]string
+	tags       map[string]string
+
+	logger log.FieldLogger
 }
 
 // RestoreOption is an option passed to the RestoreManager
@@ -61,6 +134,58 @@ func RestoreWithKMSKeyID(id string) RestoreOption {
 	}
 }
 
+// RestoreWithAttachment makes the RestoreManager wait for the restored volume
+// to become available and attach it to the given instance at the given
+// device, e.g. /dev/sdf
+func RestoreWithAttachment(instanceID, device string) RestoreOption {
+	return func(mgr *RestoreManager) {
+		mgr.instanceID = instanceID
+		mgr.device = device
+	}
+}
+
+// RestoreWithStopInstance sets whether the instance the volume is attached to
+// is stopped while attaching it and started again afterwards, e.g. to replace
+// its root volume
+func RestoreWithStopInstance(stop bool) RestoreOption {
+	return func(mgr *RestoreManager) {
+		mgr.stopInstance = stop
+	}
+}
+
+// RestoreWithDetachExisting sets whether a volume attached to the instance at
+// the device is detached to make room for the restored volume. The detached
+// volume is kept
+func RestoreWithDetachExisting(detach bool) RestoreOption {
+	return func(mgr *RestoreManager) {
+		mgr.detachExisting = detach
+	}
+}
+
+// RestoreWithSourceTags sets the tags of the volume the snapshot was created
+// of, e.g. as recorded in the datastore, which are copied to the restored
+// volume. By default they are derived from the tags of the snapshot
+func RestoreWithSourceTags(tags map[string]string) RestoreOption {
+	return func(mgr *RestoreManager) {
+		mgr.sourceTags = tags
+	}
+}
+
+// RestoreWithTags sets additional tags of the restored volume, which override
+// the tags of the source volume
+func RestoreWithTags(tags map[string]string) RestoreOption {
+	return func(mgr *RestoreManager) {
+		mgr.tags = tags
+	}
+}
+
+// RestoreWithLogger sets the logger to use
+func RestoreWithLogger(logger log.FieldLogger) RestoreOption {
+	return func(mgr *RestoreManager) {
+		mgr.logger = logger
+	}
+}
+
 // NewRestoreManager creates a new RestoreManager with the given settings
 func NewRestoreManager(client *awsec2.EC2, snapshotID, az string, opts ...RestoreOption) *RestoreManager {
 	mgr := &RestoreManager{
@@ -68,6 +193,7 @@ func NewRestoreManager(client *awsec2.EC2, snapshotID, az string, opts ...Restor
 		snapshotID: snapshotID,
 		az:         az,
 		encrypted:  false,
+		logger:     log.New(),
 	}
 
 	for _, opt := range opts {
@@ -77,11 +203,33 @@ func NewRestoreManager(client *awsec2.EC2, snapshotID, az string, opts ...Restor
 	return mgr
 }
 
-// Run will perform the actual request and restore the volume
+// Run will perform the actual request and restore the volume. If attaching
+// the volume fails, the error refers to the volume, which is kept
 func (mgr *RestoreManager) Run(ctx context.Context) (string, error) {
+	var existing string
+	if mgr.instanceID != "" {
+		// Check the instance first, so no volume is created in vain
+		var err error
+		if existing, err = mgr.checkInstance(ctx); err != nil {
+			return "", err
+		}
+	}
+
+	tags, err := mgr.volumeTags(ctx)
+	if err != nil {
+		return "", err
+	}
+
+	// The volume is tagged on creation, so it is never left untagged
 	input := &awsec2.CreateVolumeInput{
 		AvailabilityZone: aws.String(mgr.az),
 		SnapshotId:       aws.String(mgr.snapshotID),
+		TagSpecifications: []*awsec2.TagSpecification{
+			{
+				ResourceType: aws.String(awsec2.ResourceTypeVolume),
+				Tags:         tags,
+			},
+		},
 	}
 
 	if mgr.size != nil && *mgr.size > 0 {
@@ -106,5 +254,212 @@ func (mgr *RestoreManager) Run(ctx context.Context) (string, error) {
 	if err != nil {
 		return "", err
 	}
+	if mgr.instanceID == "" {
+		return *out.VolumeId, nil
+	}
+
+	if err := mgr.attach(ctx, *out.VolumeId, existing); err != nil {
+		return *out.VolumeId, fmt.Errorf("cannot attach volume %s to instance %s: %+v",
+			*out.VolumeId, mgr.instanceID, err)
+	}
 	return *out.VolumeId, nil
 }
+
+// volumeTags returns the tags of the restored volume, i.e. the tags of the
+// source volume, the additional tags and the tags referring to the restore
+func (mgr *RestoreManager) volumeTags(ctx context.Context) ([]*awsec2.Tag, error) {
+	m := make(map[string]string)
+	if mgr.sourceTags != nil {
+		for k, v := range mgr.sourceTags {
+			m[k] = v
+		}
+	} else {
+		out, err := mgr.client.DescribeSnapshotsWithContext(ctx, &awsec2.DescribeSnapshotsInput{
+			SnapshotIds: []*string{aws.String(mgr.snapshotID)},
+		})
+		describeSnapshotsRequests.Inc()
+		if err != nil {
+			return nil, err
+		}
+		if len(out.Snapshots) != 1 {
+			return nil, fmt.Errorf("snapshot %s not found", mgr.snapshotID)
+		}
+		snapTags := tagMap(out.Snapshots[0].Tags)
+		for k, v := range snapTags {
+			if !snapshotOnlyTags[k] && !strings.HasPrefix(k, "aws:") {
+				m[k] = v
+			}
+		}
+		if name, ok := snapTags["volume-name"]; ok {
+			m["Name"] = name
+		}
+	}
+	for k, v := range mgr.tags {
+		m[k] = v
+	}
+	m[restoredFromSnapshotTag] = mgr.snapshotID
+	m[restoredAtTag] = time.Now().UTC().Format(time.RFC3339)
+
+	tags := make([]*awsec2.Tag, 0, len(m))
+	for _, k := range sortedKeys(m) {
+		tags = append(tags, &awsec2.Tag{Key: aws.String(k), Value: aws.String(m[k])})
+	}
+	return tags, nil
+}
+
+// checkInstance checks whether the volume can be attached to the instance and
+// returns the volume attached at the device, if any
+func (mgr *RestoreManager) checkInstance(ctx context.Context) (string, error) {
+	out, err := mgr.client.DescribeInstancesWithContext(ctx, &awsec2.DescribeInstancesInput{
+		InstanceIds: []*string{aws.String(mgr.instanceID)},
+	})
+	describeInstancesRequests.Inc()
+	if err != nil {
+		return "", err
+	}
+	if len(out.Reservations) != 1 || len(out.Reservations[0].Instances) != 1 {
+		return "", fmt.Errorf("instance %s not found", mgr.instanceID)
+	}
+	instance := out.Reservations[0].Instances[0]
+
+	var az string
+	if instance.Placement != nil {
+		az = aws.StringValue(instance.Placement.AvailabilityZone)
+	}
+	if az != mgr.az {
+		return "", fmt.Errorf("instance %s is in AZ %s, not in %s", mgr.instanceID, az, mgr.az)
+	}
+	existing := ebsDevices(instance)[mgr.device]
+	if existing != "" && !mgr.detachExisting {
+		return "", fmt.Errorf("volume %s is attached to instance %s at %s already",
+			existing, mgr.instanceID, mgr.device)
+	}
+	return existing, nil
+}
+
+// attach waits for the given volume to become available and attaches it to
+// the instance, stopping the instance and detaching the existing volume as
+// configured. If attaching fails after the instance was stopped, the instance
+// is started again
+func (mgr *RestoreManager) attach(ctx context.Context, volumeID, existing string) (err error) {
+	logger := mgr.logger.WithFields(log.Fields{
+		"volume-id":   volumeID,
+		"instance-id": mgr.instanceID,
+		"device":      mgr.device,
+	})
+
+	logger.Info("Waiting for volume to become available")
+	if err := mgr.client.WaitUntilVolumeAvailableWithContext(ctx, &awsec2.DescribeVolumesInput{
+		VolumeIds: []*string{aws.String(volumeID)},
+	}); err != nil {
+		return err
+	}
+
+	var (
+		stopped  bool
+		detached string
+	)
+	defer func() {
+		if err == nil {
+			return
+		}
+		if stopped {
+			// The instance gets its own context, so it is started
+			// even if the restore was canceled in the meantime
+			startCtx, cancel := context.WithTimeout(context.Background(), 10*time.Minute)
+			defer cancel()
+			if startErr := mgr.startInstance(startCtx, logger); startErr != nil {
+				logger.Errorf("Couldn't start instance again: %+v", startErr)
+			}
+			err = fmt.Errorf("%+v, instance %s is %s", err, mgr.instanceID, mgr.instanceState(startCtx))
+		}
+		if detached != "" {
+			err = fmt.Errorf("%+v, volume %s was detached from %s", err, detached, mgr.device)
+		}
+	}()
+
+	if mgr.stopInstance {
+		logger.Info("Stopping instance")
+		if _, err := mgr.client.StopInstancesWithContext(ctx, &awsec2.StopInstancesInput{
+			InstanceIds: []*string{aws.String(mgr.instanceID)},
+		}); err != nil {
+			return err
+		}
+		stopped = true
+		if err := mgr.client.WaitUntilInstanceStoppedWithContext(ctx, &awsec2.DescribeInstancesInput{
+			InstanceIds: []*string{aws.String(mgr.instanceID)},
+		}); err != nil {
+			return err
+		}
+	}
+
+	if existing != "" {
+		logger.Infof("Detaching volume %s", existing)
+		if _, err := mgr.client.DetachVolumeWithContext(ctx, &awsec2.DetachVolumeInput{
+			InstanceId: aws.String(mgr.instanceID),
+			VolumeId:   aws.String(existing),
+			Device:     aws.String(mgr.device),
+		}); err != nil {
+			return err
+		}
+		detached = existing
+		if err := mgr.client.WaitUntilVolumeAvailableWithContext(ctx, &awsec2.DescribeVolumesInput{
+			VolumeIds: []*string{aws.String(existing)},
+		}); err != nil {
+			return err
+		}
+	}
+
+	logger.Info("Attaching volume")
+	if _, err := mgr.client.AttachVolumeWithContext(ctx, &awsec2.AttachVolumeInput{
+		InstanceId: aws.String(mgr.instanceID),
+		VolumeId:   aws.String(volumeID),
+		Device:     aws.String(mgr.device),
+	}); err != nil {
+		return err
+	}
+	if err := mgr.client.WaitUntilVolumeInUseWithContext(ctx, &awsec2.DescribeVolumesInput{
+		VolumeIds: []*string{aws.String(volumeID)},
+	}); err != nil {
+		return err
+	}
+
+	if stopped {
+		if err := mgr.startInstance(ctx, logger); err != nil {
+			return err
+		}
+		stopped = false
+	}
+	logger.Info("Attached volume")
+	return nil
+}
+
+// startInstance starts the instance and waits for it to be running
+func (mgr *RestoreManager) startInstance(ctx context.Context, logger log.FieldLogger) error {
+	logger.Info("Starting instance")
+	if _, err := mgr.client.StartInstancesWithContext(ctx, &awsec2.StartInstancesInput{
+		InstanceIds: []*string{aws.String(mgr.instanceID)},
+	}); err != nil {
+		return err
+	}
+	return mgr.client.WaitUntilInstanceRunningWithContext(ctx, &awsec2.DescribeInstancesInput{
+		InstanceIds: []*string{aws.String(mgr.instanceID)},
+	})
+}
+
+// instanceState returns the state of the instance, or "unknown" if it can't be
+// described
+func (mgr *RestoreManager) instanceState(ctx context.Context) string {
+	out, err := mgr.client.DescribeInstancesWithContext(ctx, &awsec2.DescribeInstancesInput{
+		InstanceIds: []*string{aws.String(mgr.instanceID)},
+	})
+	describeInstancesRequests.Inc()
+	if err != nil || len(out.Reservations) != 1 || len(out.Reservations[0].Instances) != 1 {
+		return "unknown"
+	}
+	instance := out.Reservations[0].Instances[0]
+	if instance.State == nil {
+		return "unknown"
+	}
+	return aws.StringValue(instance.State.Name)
+}
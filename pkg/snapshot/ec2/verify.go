@@ -0,0 +1,369 @@
+package ec2
+
+import (
+	"context"
+	"fmt"
+	"math/rand"
+	"strconv"
+	"time"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/aws/awserr"
+	"github.com/aws/aws-sdk-go/aws/request"
+	awsec2 "github.com/aws/aws-sdk-go/service/ec2"
+	"github.com/prometheus/client_golang/prometheus"
+	log "github.com/sirupsen/logrus"
+
+	"github.com/grid-x/aws-auto-snapshot/pkg/datastore"
+)
+
+const (
+	defaultVerifyTimeout = 10 * time.Minute
+	volumePollInterval   = 5 * time.Second
+	deleteVolumeAttempts = 5
+
+	// errCodeVolumeNotFound is returned for volumes that don't exist
+	errCodeVolumeNotFound = "InvalidVolume.NotFound"
+
+	// restoreDrillTag is set on the volumes restored by restore drills
+	restoreDrillTag = "restore-drill"
+)
+
+// Labels recording the last restore drill of a snapshot in the datastore
+const (
+	VerifiedAtLabel       = "verified-at"
+	VerifyResultLabel     = "verify-result"
+	VerifyDurationLabel   = "verify-duration-seconds"
+	VerifyResultSucceeded = "succeeded"
+	VerifyResultFailed    = "failed"
+)
+
+var (
+	restoreDrills = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Name: "ec2_restore_drills_total",
+		Help: "Total number of restore drills by result",
+	}, []string{"result"})
+	restoreDrillDuration = prometheus.NewHistogram(prometheus.HistogramOpts{
+		Name:    "ec2_restore_drill_duration_seconds",
+		Help:    "Time it took restored volumes of successful restore drills to become available",
+		Buckets: prometheus.ExponentialBuckets(5, 2, 8),
+	})
+	deleteVolumeRequests = prometheus.NewCounter(prometheus.CounterOpts{
+		Name: "ec2_delete_volume_requests_total",
+		Help: "Total number of delete volume requests",
+	})
+)
+
+func init() {
+	prometheus.MustRegister(restoreDrills)
+	prometheus.MustRegister(restoreDrillDuration)
+	prometheus.MustRegister(deleteVolumeRequests)
+}
+
+// VerifyManager verifies that EBS snapshots are usable by restoring them in
+// restore drills
+type VerifyManager struct {
+	client    *awsec2.EC2
+	datastore datastore.Datastore
+
+	az         string
+	backupTag  string
+	sampleRate float64
+	timeout    time.Duration
+	random     *rand.Rand
+
+	logger log.FieldLogger
+}
+
+// VerifyOption is an option passed to the VerifyManager
+type VerifyOption func(*VerifyManager)
+
+// VerifyWithBackupTag sets the backup tag key of the volumes to verify
+func VerifyWithBackupTag(t string) VerifyOption {
+	return func(mgr *VerifyManager) {
+		mgr.backupTag = t
+	}
+}
+
+// VerifyWithSampleRate sets the share of the volumes, between 0 and 1, whose
+// snapshots are verified in a run, e.g. to limit cost
+func VerifyWithSampleRate(rate float64) VerifyOption {
+	return func(mgr *VerifyManager) {
+		mgr.sampleRate = rate
+	}
+}
+
+// VerifyWithTimeout sets how long to wait for a restored volume to become
+// available
+func VerifyWithTimeout(d time.Duration) VerifyOption {
+	return func(mgr *VerifyManager) {
+		mgr.timeout = d
+	}
+}
+
+// VerifyWithLogger sets the logger to use
+func VerifyWithLogger(logger log.FieldLogger) VerifyOption {
+	return func(mgr *VerifyManager) {
+		mgr.logger = logger
+	}
+}
+
+// NewVerifyManager creates a new VerifyManager restoring the snapshots
+// recorded in the given datastore into the given scratch AZ
+func NewVerifyManager(client *awsec2.EC2, datastore datastore.Datastore, az string, opts ...VerifyOption) *VerifyManager {
+	mgr := &VerifyManager{
+		client:    client,
+		datastore: datastore,
+		az:        az,
+
+		backupTag:  defaultBackupTag,
+		sampleRate: 1,
+		timeout:    defaultVerifyTimeout,
+		random:     rand.New(rand.NewSource(time.Now().UnixNano())),
+
+		logger: log.New(),
+	}
+
+	for _, opt := range opts {
+		opt(mgr)
+	}
+	mgr.logger = mgr.logger.WithFields(log.Fields{
+		"component": "ec2-verify-manager",
+	})
+
+	return mgr
+}
+
+// DrillResult is the result of the restore drill of a snapshot
+type DrillResult struct {
+	Resource   string `json:"resource"`
+	SnapshotID string `json:"snapshotID"`
+	Succeeded  bool   `json:"succeeded"`
+	// Seconds is the time it took the restored volume to become available
+	Seconds float64 `json:"seconds"`
+	Error   string  `json:"error,omitempty"`
+}
+
+// Run restores the latest completed snapshot of a sample of the volumes with
+// the backup tag, waits for the restored volume to become available and
+// deletes it again. The results are recorded in the datastore. Volumes left
+// behind by earlier drills are deleted first. It returns an error if any drill
+// failed
+func (mgr *VerifyManager) Run(ctx context.Context) ([]*DrillResult, error) {
+	mgr.sweep(ctx)
+
+	volumes, err := fetchVolumes(ctx, mgr.client, mgr.backupTag)
+	if err != nil {
+		return nil, err
+	}
+
+	var (
+		results []*DrillResult
+		failed  int
+	)
+	for _, volume := range volumes {
+		logger := mgr.logger.WithField("volume-id", *volume.VolumeId)
+		if mgr.random.Float64() >= mgr.sampleRate {
+			logger.Debug("Volume not sampled")
+			continue
+		}
+
+		info, err := mgr.datastore.GetLatestSnapshotInfo(ctx, datastore.SnapshotResource(*volume.VolumeId),
+			datastore.WithLabel(StateLabel, awsec2.SnapshotStateCompleted))
+		if datastore.IsNotFound(err) {
+			logger.Warn("No completed snapshot recorded, skipping volume")
+			continue
+		} else if err != nil {
+			logger.Errorf("Couldn't get snapshot info: %+v", err)
+			failed++
+			continue
+		}
+
+		result := mgr.drill(ctx, logger.WithField("snapshot-id", string(info.ID)), info)
+		if !result.Succeeded {
+			failed++
+		}
+		results = append(results, result)
+	}
+
+	if failed > 0 {
+		return results, fmt.Errorf("%d restore drills failed", failed)
+	}
+	return results, nil
+}
+
+// drill restores the snapshot of the given info, waits for the volume to
+// become available, deletes it and records the result
+func (mgr *VerifyManager) drill(ctx context.Context, logger log.FieldLogger, info *datastore.SnapshotInfo) *DrillResult {
+	result := &DrillResult{
+		Resource:   string(info.Resource),
+		SnapshotID: string(info.ID),
+	}
+
+	logger.Infof("Restoring snapshot into %s", mgr.az)
+	start := time.Now()
+	err := mgr.restore(ctx, logger, string(info.ID))
+	duration := time.Since(start)
+	result.Seconds = duration.Seconds()
+
+	if err != nil {
+		logger.Errorf("Restore drill failed: %+v", err)
+		result.Error = err.Error()
+		restoreDrills.WithLabelValues(VerifyResultFailed).Inc()
+	} else {
+		logger.Infof("Restore drill succeeded after %s", duration)
+		result.Succeeded = true
+		restoreDrills.WithLabelValues(VerifyResultSucceeded).Inc()
+		restoreDrillDuration.Observe(result.Seconds)
+	}
+
+	if info.Labels == nil {
+		info.Labels = datastore.SnapshotLabels{}
+	}
+	info.Labels[VerifiedAtLabel] = start.UTC().Format(time.RFC3339)
+	info.Labels[VerifyResultLabel] = VerifyResultFailed
+	if result.Succeeded {
+		info.Labels[VerifyResultLabel] = VerifyResultSucceeded
+	}
+	info.Labels[VerifyDurationLabel] = strconv.FormatInt(int64(duration/time.Second), 10)
+	if err := mgr.datastore.StoreSnapshotInfo(ctx, info); err != nil {
+		logger.Errorf("Couldn't record restore drill: %+v", err)
+	}
+	return result
+}
+
+// restore restores the given snapshot, waits for the volume to become
+// available and deletes it in any case
+func (mgr *VerifyManager) restore(ctx context.Context, logger log.FieldLogger, snapshotID string) error {
+	// The drill volume must not be backed up, hence the tags of the
+	// source volume aren't copied
+	volumeID, err := NewRestoreManager(mgr.client, snapshotID, mgr.az,
+		RestoreWithSourceTags(map[string]string{}),
+		RestoreWithTags(map[string]string{
+			"Name":          fmt.Sprintf("restore drill of %s", snapshotID),
+			restoreDrillTag: "true",
+		}),
+		RestoreWithLogger(logger),
+	).Run(ctx)
+	if err != nil {
+		return err
+	}
+	logger = logger.WithField("test-volume-id", volumeID)
+
+	// The test volume gets its own context, so it is deleted even if the
+	// run was canceled in the meantime
+	defer func() {
+		deleteCtx, cancel := context.WithTimeout(context.Background(), mgr.timeout+5*time.Minute)
+		defer cancel()
+		if err := mgr.deleteVolume(deleteCtx, logger, volumeID); err != nil {
+			logger.Errorf("Couldn't delete test volume: %+v", err)
+			return
+		}
+		logger.Info("Deleted test volume")
+	}()
+
+	// The waiter gives up after 40 attempts by default, hence it is
+	// configured to wait as long as the timeout
+	waitCtx, cancel := context.WithTimeout(ctx, mgr.timeout)
+	defer cancel()
+	in := &awsec2.DescribeVolumesInput{
+		VolumeIds: []*string{aws.String(volumeID)},
+	}
+	return mgr.client.WaitUntilVolumeAvailableWithContext(waitCtx, in,
+		request.WithWaiterDelay(request.ConstantWaiterDelay(volumePollInterval)),
+		request.WithWaiterMaxAttempts(int(mgr.timeout/volumePollInterval)+1),
+	)
+}
+
+// deleteVolume waits until the given volume isn't creating anymore, as only
+// then it can be deleted, and deletes it, retrying failed attempts. A volume
+// that doesn't exist counts as deleted
+func (mgr *VerifyManager) deleteVolume(ctx context.Context, logger log.FieldLogger, volumeID string) error {
+	in := &awsec2.DescribeVolumesInput{
+		VolumeIds: []*string{aws.String(volumeID)},
+	}
+	for {
+		out, err := mgr.client.DescribeVolumesWithContext(ctx, in)
+		describeVolumesRequets.Inc()
+		if isVolumeNotFound(err) {
+			return nil
+		} else if err != nil {
+			return err
+		}
+		if len(out.Volumes) != 1 || aws.StringValue(out.Volumes[0].State) != awsec2.VolumeStateCreating {
+			break
+		}
+		logger.Debug("Waiting for test volume to be created before deleting it")
+		select {
+		case <-ctx.Done():
+			return fmt.Errorf("volume %s is still creating: %+v", volumeID, ctx.Err())
+		case <-time.After(volumePollInterval):
+		}
+	}
+
+	var err error
+	for attempt := 1; attempt <= deleteVolumeAttempts; attempt++ {
+		_, err = mgr.client.DeleteVolumeWithContext(ctx, &awsec2.DeleteVolumeInput{
+			VolumeId: aws.String(volumeID),
+		})
+		deleteVolumeRequests.Inc()
+		if err == nil || isVolumeNotFound(err) {
+			return nil
+		}
+		logger.Warnf("Couldn't delete test volume in attempt %d of %d: %+v", attempt, deleteVolumeAttempts, err)
+		select {
+		case <-ctx.Done():
+			return err
+		case <-time.After(volumePollInterval):
+		}
+	}
+	return err
+}
+
+// sweep deletes the volumes left behind by earlier restore drills, e.g.
+// because a run was killed. Volumes younger than the timeout may belong to a
+// drill running concurrently, hence they are kept. Errors are logged only
+func (mgr *VerifyManager) sweep(ctx context.Context) {
+	var volumes []*awsec2.Volume
+	var token *string
+	for {
+		in := &awsec2.DescribeVolumesInput{
+			Filters: []*awsec2.Filter{
+				{
+					Name:   aws.String("tag-key"),
+					Values: []*string{aws.String(restoreDrillTag)},
+				},
+			},
+			NextToken: token,
+		}
+		resp, err := mgr.client.DescribeVolumesWithContext(ctx, in)
+		describeVolumesRequets.Inc()
+		if err != nil {
+			mgr.logger.Errorf("Couldn't describe test volumes of earlier drills: %+v", err)
+			return
+		}
+		volumes = append(volumes, resp.Volumes...)
+
+		if resp.NextToken == nil {
+			break
+		}
+		token = resp.NextToken
+	}
+
+	cutoff := time.Now().Add(-mgr.timeout)
+	for _, volume := range volumes {
+		if volume.VolumeId == nil || aws.TimeValue(volume.CreateTime).After(cutoff) {
+			continue
+		}
+		logger := mgr.logger.WithField("test-volume-id", *volume.VolumeId)
+		logger.Info("Deleting test volume of an earlier drill")
+		if err := mgr.deleteVolume(ctx, logger, *volume.VolumeId); err != nil {
+			logger.Errorf("Couldn't delete test volume: %+v", err)
+		}
+	}
+}
+
+func isVolumeNotFound(err error) bool {
+	aerr, ok := err.(awserr.Error)
+	return ok && aerr.Code() == errCodeVolumeNotFound
+}
@@ -0,0 +1,227 @@
+package lightsail
+
+import (
+	"context"
+	"strings"
+	"time"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/service/lightsail"
+	"github.com/prometheus/client_golang/prometheus"
+	log "github.com/sirupsen/logrus"
+
+	"github.com/grid-x/aws-auto-snapshot/pkg/snapshot"
+)
+
+var (
+	createDiskSnapshotRequest = prometheus.NewCounter(prometheus.CounterOpts{
+		Name: "lightsail_create_disk_snapshot_requests_total",
+		Help: "Total number of create disk snapshot requests",
+	})
+	getDiskSnapshotRequest = prometheus.NewCounter(prometheus.CounterOpts{
+		Name: "lightsail_get_disk_snapshot_requests_total",
+		Help: "Total number of get disk snapshot requests",
+	})
+	deleteDiskSnapshotRequest = prometheus.NewCounter(prometheus.CounterOpts{
+		Name: "lightsail_delete_disk_snapshot_requests_total",
+		Help: "Total number of delete disk snapshot requests",
+	})
+)
+
+func init() {
+	prometheus.MustRegister(createDiskSnapshotRequest)
+	prometheus.MustRegister(getDiskSnapshotRequest)
+	prometheus.MustRegister(deleteDiskSnapshotRequest)
+}
+
+// DiskSnapshotManager manages the snapshots of a single lightsail block
+// storage disk
+type DiskSnapshotManager struct {
+	client *lightsail.Lightsail
+	disk   string // disk name
+
+	options
+
+	logger log.FieldLogger
+}
+
+// NewDiskSnapshotManager creates a new DiskSnapshotManager for a disk given a
+// lightsail client and a set of Opts
+func NewDiskSnapshotManager(client *lightsail.Lightsail, disk string, opts ...Opt) *DiskSnapshotManager {
+	smgr := &DiskSnapshotManager{
+		client:  client,
+		disk:    disk,
+		options: defaultOptions(),
+	}
+
+	for _, o := range opts {
+		o(&smgr.options)
+	}
+	smgr.logger = smgr.baseLogger.WithFields(
+		log.Fields{
+			"component": "disk-snapshot-manager",
+			"disk":      disk,
+		})
+
+	return smgr
+}
+
+// fetchDiskSnapshots returns all snapshots of the given disk, or of all disks
+// if none is given, that have been created by this tool, i.e. that have the
+// given suffix
+func fetchDiskSnapshots(ctx context.Context, client *lightsail.Lightsail,
+	disk, suffix string) ([]*lightsail.DiskSnapshot, error) {
+
+	var snapshots []*lightsail.DiskSnapshot
+	var token *string
+
+	for {
+		in := &lightsail.GetDiskSnapshotsInput{}
+		if token != nil {
+			in.PageToken = token
+		}
+		resp, err := client.GetDiskSnapshotsWithContext(ctx, in)
+		if err != nil {
+			return nil, err
+		}
+		getDiskSnapshotRequest.Inc()
+
+		for _, snapshot := range resp.DiskSnapshots {
+
+			// Only use snapshots from the given disk
+			if snapshot.FromDiskName == nil ||
+				(disk != "" && *snapshot.FromDiskName != disk) {
+				continue
+			}
+			// Filter out snapshots not created by this tool
+			if snapshot.Name == nil || !strings.HasSuffix(*snapshot.Name, suffix) {
+				continue
+			}
+
+			snapshots = append(snapshots, snapshot)
+		}
+		if resp.NextPageToken == nil {
+			break
+		}
+		token = resp.NextPageToken
+	}
+
+	return snapshots, nil
+}
+
+// ListDiskSnapshots returns the disk snapshots managed by this tool,
+// optionally only those of the given disk. The delete after dates are derived
+// from the retention given via the Opts
+func ListDiskSnapshots(ctx context.Context, client *lightsail.Lightsail,
+	disk string, opts ...Opt) ([]snapshot.Description, error) {
+
+	o := defaultOptions()
+	for _, opt := range opts {
+		opt(&o)
+	}
+
+	snapshots, err := fetchDiskSnapshots(ctx, client, disk, o.suffix)
+	if err != nil {
+		return nil, err
+	}
+
+	var result []snapshot.Description
+	for _, snap := range snapshots {
+		result = append(result, o.describe(*snap.Name, aws.StringValue(snap.FromDiskName),
+			snap.CreatedAt, aws.StringValue(snap.State), aws.Int64Value(snap.SizeInGb)))
+	}
+	return result, nil
+}
+
+// Snapshot creates a snapshot for the Lightsail disk this DiskSnapshotManager
+// belongs to
+func (smgr *DiskSnapshotManager) Snapshot(ctx context.Context) error {
+	ctx, cancel := context.WithTimeout(ctx, 10*time.Second)
+	defer cancel()
+
+	created := time.Now()
+	snapshotName := smgr.snapshotName(smgr.disk, created)
+	if smgr.plan != nil {
+		smgr.plan.Add(snapshot.Action{
+			Action:   snapshot.ActionSnapshot,
+			Resource: smgr.disk,
+			Snapshot: snapshotName,
+		})
+		return nil
+	}
+	smgr.logger.Infof("Creating disk snapshot with name %s", snapshotName)
+	_, err := smgr.client.CreateDiskSnapshotWithContext(
+		ctx,
+		&lightsail.CreateDiskSnapshotInput{
+			DiskName:         aws.String(smgr.disk),
+			DiskSnapshotName: aws.String(snapshotName),
+		},
+	)
+	createDiskSnapshotRequest.Inc()
+	if err != nil {
+		return err
+	}
+	smgr.record(ctx, smgr.logger, smgr.disk, snapshotName, created)
+	return nil
+}
+
+// Prune deletes old snapshots of the lightsail disk belonging to the
+// DiskSnapshotManager
+func (smgr *DiskSnapshotManager) Prune(ctx context.Context) error {
+	ctx, cancel := context.WithTimeout(ctx, 10*time.Second)
+	defer cancel()
+
+	snapshots, err := fetchDiskSnapshots(ctx, smgr.client, smgr.disk, smgr.suffix)
+	if err != nil {
+		return err
+	}
+
+	var (
+		candidates         []*lightsail.DiskSnapshot
+		createdAt          []time.Time
+		available, pending []bool
+	)
+	for _, snapshot := range snapshots {
+		if snapshot.CreatedAt == nil {
+			//skip
+			continue
+		}
+		candidates = append(candidates, snapshot)
+		createdAt = append(createdAt, *snapshot.CreatedAt)
+		state := aws.StringValue(snapshot.State)
+		available = append(available, state == lightsail.DiskSnapshotStateCompleted)
+		pending = append(pending, state == lightsail.DiskSnapshotStatePending)
+	}
+
+	del := smgr.toDelete(createdAt, available, pending)
+	for i, snap := range candidates {
+		if del[i] == "" {
+			// Snapshot is still to be retained
+			smgr.logger.Debugf("Disk snapshot %s not old enough", *snap.Name)
+			continue
+		}
+		if smgr.plan != nil {
+			smgr.plan.Add(snapshot.Action{
+				Action:   snapshot.ActionDelete,
+				Resource: smgr.disk,
+				Snapshot: *snap.Name,
+				Reason:   del[i],
+			})
+			continue
+		}
+		smgr.logger.Infof("Deleting disk snapshot %s", *snap.Name)
+		_, err := smgr.client.DeleteDiskSnapshotWithContext(
+			ctx,
+			&lightsail.DeleteDiskSnapshotInput{
+				DiskSnapshotName: snap.Name,
+			})
+		if err != nil {
+			smgr.logger.Error(err)
+		} else {
+			smgr.forget(ctx, smgr.logger, smgr.disk, *snap.Name)
+		}
+		deleteDiskSnapshotRequest.Inc()
+	}
+
+	return nil
+}
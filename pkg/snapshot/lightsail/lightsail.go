@@ -3,6 +3,7 @@ package lightsail
 import (
 	"context"
 	"fmt"
+	"strconv"
 	"strings"
 	"time"
 
@@ -10,6 +11,9 @@ import (
 	"github.com/aws/aws-sdk-go/service/lightsail"
 	"github.com/prometheus/client_golang/prometheus"
 	log "github.com/sirupsen/logrus"
+
+	"github.com/grid-x/aws-auto-snapshot/pkg/datastore"
+	"github.com/grid-x/aws-auto-snapshot/pkg/snapshot"
 )
 
 const (
@@ -39,32 +43,207 @@ func init() {
 	prometheus.MustRegister(deleteInstanceSnapshotRequest)
 }
 
-// SnapshotManager manages the snapshots of a single lightsail instance
-type SnapshotManager struct {
-	client   *lightsail.Lightsail
-	instance string // instance name
-
+// options are the settings shared by the SnapshotManager and the
+// DiskSnapshotManager
+type options struct {
 	retention time.Duration // retention time
 	suffix    string        // snapshot suffix
 
-	logger log.FieldLogger
+	// policy replaces the retention time if set
+	policy snapshot.RetentionPolicy
+	// minKeep is the number of newest available snapshots that are never
+	// pruned
+	minKeep int
+
+	// plan is set in dry-run mode, in which snapshots and deletions are
+	// only added to it
+	plan *snapshot.Plan
+
+	// datastore optionally records the created snapshots
+	datastore datastore.Datastore
+
+	baseLogger log.FieldLogger
 }
 
-// Opt represents Options that can be passed to the SnapshotManager
-type Opt func(*SnapshotManager)
+func defaultOptions() options {
+	return options{
+		retention:  defaultRetention,
+		suffix:     defaultSnapshotSuffix,
+		baseLogger: log.New(),
+	}
+}
+
+// Opt represents Options that can be passed to the SnapshotManager and the
+// DiskSnapshotManager
+type Opt func(*options)
 
 // WithRetention set the retention duration
 func WithRetention(r time.Duration) Opt {
-	return func(m *SnapshotManager) {
-		m.retention = r
+	return func(o *options) {
+		o.retention = r
+	}
+}
+
+// WithRetentionPolicy sets a grandfather-father-son retention policy that is
+// used instead of the retention duration
+func WithRetentionPolicy(p snapshot.RetentionPolicy) Opt {
+	return func(o *options) {
+		o.policy = p
+	}
+}
+
+// WithMinKeep sets the number of newest available snapshots that are never
+// pruned regardless of their age
+func WithMinKeep(n int) Opt {
+	return func(o *options) {
+		o.minKeep = n
+	}
+}
+
+// WithDryRun makes the managers only add the snapshots and deletions they
+// would perform to the given plan instead of performing them
+func WithDryRun(plan *snapshot.Plan) Opt {
+	return func(o *options) {
+		o.plan = plan
+	}
+}
+
+// WithDatastore records the created snapshots in the given datastore and
+// deletes their infos again when they are pruned
+func WithDatastore(ds datastore.Datastore) Opt {
+	return func(o *options) {
+		o.datastore = ds
 	}
 }
 
 // WithSnapshotSuffix sets the suffix of the automated snapshots
 func WithSnapshotSuffix(suf string) Opt {
-	return func(m *SnapshotManager) {
-		m.suffix = suf
+	return func(o *options) {
+		o.suffix = suf
+	}
+}
+
+// WithLogger sets the logger to use, e.g. to add context to all log entries
+func WithLogger(logger log.FieldLogger) Opt {
+	return func(o *options) {
+		o.baseLogger = logger
+	}
+}
+
+// toDelete returns why each of the snapshots with the given creation times is
+// to be deleted, or an empty reason if it is kept. If a retention policy is
+// set, it decides over all available snapshots, i.e. excluding pending and
+// failed ones. Otherwise, and for failed snapshots, all snapshots older than
+// the retention duration are deleted. The newest minKeep available snapshots
+// are never deleted
+func (o *options) toDelete(createdAt []time.Time, available, pending []bool) []string {
+	del := make([]string, len(createdAt))
+	var availableAt []time.Time
+	for i, t := range createdAt {
+		if available[i] {
+			availableAt = append(availableAt, t)
+		}
+	}
+	protected := snapshot.KeepNewest(availableAt, o.minKeep)
+	var keep []bool
+	if !o.policy.IsZero() {
+		keep = o.policy.Keep(availableAt)
+	}
+
+	var j int
+	for i, t := range createdAt {
+		switch {
+		case pending[i]:
+			// never delete snapshots that are still being created
+		case available[i]:
+			switch {
+			case protected[j]:
+				// keep the newest snapshots regardless of their age
+			case keep != nil:
+				if !keep[j] {
+					del[i] = fmt.Sprintf("not kept by retention policy %s", o.policy)
+				}
+			default:
+				del[i] = o.expired(t)
+			}
+			j++
+		default:
+			del[i] = o.expired(t)
+		}
+	}
+	return del
+}
+
+// expired returns why a snapshot created at the given time is to be deleted
+// by the retention duration, or an empty reason if it is kept
+func (o *options) expired(createdAt time.Time) string {
+	if createdAt.After(time.Now().Add(-o.retention)) {
+		return ""
+	}
+	return fmt.Sprintf("older than %s", o.retention)
+}
+
+// snapshotName returns the name of a snapshot of the given resource created at
+// the given time
+func (o *options) snapshotName(resource string, createdAt time.Time) string {
+	return fmt.Sprintf("%s-%d-%s", resource, createdAt.UnixNano(), o.suffix)
+}
+
+// createdAt returns the creation time encoded in the name of a snapshot
+// created by this tool, which, unlike the creation time reported by
+// Lightsail, matches the one recorded in the datastore
+func (o *options) createdAt(name string) (time.Time, error) {
+	s := strings.TrimSuffix(name, "-"+o.suffix)
+	ns, err := strconv.ParseInt(s[strings.LastIndex(s, "-")+1:], 10, 64)
+	if err != nil {
+		return time.Time{}, fmt.Errorf("no creation time in snapshot name %s", name)
 	}
+	return time.Unix(0, ns), nil
+}
+
+// record stores the info of a created snapshot in the datastore, if any
+func (o *options) record(ctx context.Context, logger log.FieldLogger,
+	resource, name string, createdAt time.Time) {
+
+	if o.datastore == nil {
+		return
+	}
+	if err := o.datastore.StoreSnapshotInfo(ctx, &datastore.SnapshotInfo{
+		Resource:  datastore.SnapshotResource(resource),
+		ID:        datastore.SnapshotID(name),
+		CreatedAt: createdAt,
+	}); err != nil {
+		logger.Errorf("Couldn't record snapshot %s: %+v", name, err)
+	}
+}
+
+// forget deletes the info of a deleted snapshot from the datastore, if any
+func (o *options) forget(ctx context.Context, logger log.FieldLogger, resource, name string) {
+	if o.datastore == nil {
+		return
+	}
+	createdAt, err := o.createdAt(name)
+	if err != nil {
+		logger.Error(err)
+		return
+	}
+	if err := o.datastore.DeleteSnapshotInfo(ctx, &datastore.SnapshotInfo{
+		Resource:  datastore.SnapshotResource(resource),
+		ID:        datastore.SnapshotID(name),
+		CreatedAt: createdAt,
+	}); err != nil {
+		logger.Errorf("Couldn't delete info of snapshot %s: %+v", name, err)
+	}
+}
+
+// SnapshotManager manages the snapshots of a single lightsail instance
+type SnapshotManager struct {
+	client   *lightsail.Lightsail
+	instance string // instance name
+
+	options
+
+	logger log.FieldLogger
 }
 
 // NewSnapshotManager creates a new SnapshotManager for an instance  given an
@@ -73,53 +252,26 @@ func NewSnapshotManager(client *lightsail.Lightsail, instance string, opts ...Op
 	smgr := &SnapshotManager{
 		client:   client,
 		instance: instance,
-
-		retention: defaultRetention,
-		suffix:    defaultSnapshotSuffix,
-
-		logger: log.New().WithFields(
-			log.Fields{
-				"component": "snapshot-manager",
-				"instance":  instance,
-			}),
+		options:  defaultOptions(),
 	}
 
 	for _, o := range opts {
-		o(smgr)
+		o(&smgr.options)
 	}
+	smgr.logger = smgr.baseLogger.WithFields(
+		log.Fields{
+			"component": "snapshot-manager",
+			"instance":  instance,
+		})
 
 	return smgr
 }
 
-// Snapshot creates a snapshots for the Lightsail instance this SnapshotManager
-// belongs to
-func (smgr *SnapshotManager) Snapshot(ctx context.Context) error {
-	ctx, cancel := context.WithTimeout(ctx, 10*time.Second)
-	defer cancel()
-
-	snapshotName := fmt.Sprintf("%s-%d-%s",
-		smgr.instance,
-		time.Now().UnixNano(),
-		smgr.suffix,
-	)
-	smgr.logger.Infof("Creating snapshot with name %s", snapshotName)
-	// TODO: Check for errors in response
-	_, err := smgr.client.CreateInstanceSnapshotWithContext(
-		ctx,
-		&lightsail.CreateInstanceSnapshotInput{
-			InstanceName:         aws.String(smgr.instance),
-			InstanceSnapshotName: aws.String(snapshotName),
-		},
-	)
-	createInstanceSnapshotRequest.Inc()
-	return err
-}
-
-// Prune deletes old snapshots of the lightsail instance belonging to the
-// SnapshotManager
-func (smgr *SnapshotManager) Prune(ctx context.Context) error {
-	ctx, cancel := context.WithTimeout(ctx, 10*time.Second)
-	defer cancel()
+// fetchInstanceSnapshots returns all snapshots of the given instance, or of
+// all instances if none is given, that have been created by this tool, i.e.
+// that have the given suffix
+func fetchInstanceSnapshots(ctx context.Context, client *lightsail.Lightsail,
+	instance, suffix string) ([]*lightsail.InstanceSnapshot, error) {
 
 	var snapshots []*lightsail.InstanceSnapshot
 	var token *string
@@ -129,21 +281,21 @@ func (smgr *SnapshotManager) Prune(ctx context.Context) error {
 		if token != nil {
 			in.PageToken = token
 		}
-		resp, err := smgr.client.GetInstanceSnapshotsWithContext(ctx, in)
+		resp, err := client.GetInstanceSnapshotsWithContext(ctx, in)
 		if err != nil {
-			return err
+			return nil, err
 		}
 		getInstanceSnapshotRequest.Inc()
 
 		for _, snapshot := range resp.InstanceSnapshots {
 
-			// Only use snapshots from the current instance
+			// Only use snapshots from the given instance
 			if snapshot.FromInstanceName == nil ||
-				*snapshot.FromInstanceName != smgr.instance {
+				(instance != "" && *snapshot.FromInstanceName != instance) {
 				continue
 			}
 			// Filter out snapshots not created by this tool
-			if !strings.HasSuffix(*snapshot.Name, smgr.suffix) {
+			if snapshot.Name == nil || !strings.HasSuffix(*snapshot.Name, suffix) {
 				continue
 			}
 
@@ -155,25 +307,142 @@ func (smgr *SnapshotManager) Prune(ctx context.Context) error {
 		token = resp.NextPageToken
 	}
 
+	return snapshots, nil
+}
+
+// ListInstanceSnapshots returns the instance snapshots managed by this tool,
+// optionally only those of the given instance. The delete after dates are
+// derived from the retention given via the Opts
+func ListInstanceSnapshots(ctx context.Context, client *lightsail.Lightsail,
+	instance string, opts ...Opt) ([]snapshot.Description, error) {
+
+	o := defaultOptions()
+	for _, opt := range opts {
+		opt(&o)
+	}
+
+	snapshots, err := fetchInstanceSnapshots(ctx, client, instance, o.suffix)
+	if err != nil {
+		return nil, err
+	}
+
+	var result []snapshot.Description
+	for _, snap := range snapshots {
+		result = append(result, o.describe(*snap.Name, aws.StringValue(snap.FromInstanceName),
+			snap.CreatedAt, aws.StringValue(snap.State), aws.Int64Value(snap.SizeInGb)))
+	}
+	return result, nil
+}
+
+// describe creates the description of a snapshot given its properties
+func (o *options) describe(name, resource string, createdAt *time.Time,
+	state string, size int64) snapshot.Description {
+
+	d := snapshot.Description{
+		ID:       name,
+		Resource: resource,
+		State:    state,
+		SizeGiB:  size,
+	}
+	if createdAt != nil {
+		d.CreatedAt = *createdAt
+	}
+	if !o.policy.IsZero() {
+		d.RetentionPolicy = o.policy.String()
+	} else if createdAt != nil {
+		deleteAfter := createdAt.Add(o.retention)
+		d.DeleteAfter = &deleteAfter
+	}
+	return d
+}
+
+// Snapshot creates a snapshots for the Lightsail instance this SnapshotManager
+// belongs to
+func (smgr *SnapshotManager) Snapshot(ctx context.Context) error {
+	ctx, cancel := context.WithTimeout(ctx, 10*time.Second)
+	defer cancel()
+
+	created := time.Now()
+	snapshotName := smgr.snapshotName(smgr.instance, created)
+	if smgr.plan != nil {
+		smgr.plan.Add(snapshot.Action{
+			Action:   snapshot.ActionSnapshot,
+			Resource: smgr.instance,
+			Snapshot: snapshotName,
+		})
+		return nil
+	}
+	smgr.logger.Infof("Creating snapshot with name %s", snapshotName)
+	// TODO: Check for errors in response
+	_, err := smgr.client.CreateInstanceSnapshotWithContext(
+		ctx,
+		&lightsail.CreateInstanceSnapshotInput{
+			InstanceName:         aws.String(smgr.instance),
+			InstanceSnapshotName: aws.String(snapshotName),
+		},
+	)
+	createInstanceSnapshotRequest.Inc()
+	if err != nil {
+		return err
+	}
+	smgr.record(ctx, smgr.logger, smgr.instance, snapshotName, created)
+	return nil
+}
+
+// Prune deletes old snapshots of the lightsail instance belonging to the
+// SnapshotManager
+func (smgr *SnapshotManager) Prune(ctx context.Context) error {
+	ctx, cancel := context.WithTimeout(ctx, 10*time.Second)
+	defer cancel()
+
+	snapshots, err := fetchInstanceSnapshots(ctx, smgr.client, smgr.instance, smgr.suffix)
+	if err != nil {
+		return err
+	}
+
+	var (
+		candidates         []*lightsail.InstanceSnapshot
+		createdAt          []time.Time
+		available, pending []bool
+	)
 	for _, snapshot := range snapshots {
 		if snapshot.CreatedAt == nil {
 			//skip
 			continue
 		}
+		candidates = append(candidates, snapshot)
+		createdAt = append(createdAt, *snapshot.CreatedAt)
+		state := aws.StringValue(snapshot.State)
+		available = append(available, state == lightsail.InstanceSnapshotStateAvailable)
+		pending = append(pending, state == lightsail.InstanceSnapshotStatePending)
+	}
 
-		if snapshot.CreatedAt.After(time.Now().Add(-smgr.retention)) {
-			// Snapshot is not yet old enough
-			smgr.logger.Debugf("Snapshot %s not old enough", *snapshot.Name)
+	del := smgr.toDelete(createdAt, available, pending)
+	for i, snap := range candidates {
+		if del[i] == "" {
+			// Snapshot is still to be retained
+			smgr.logger.Debugf("Snapshot %s not old enough", *snap.Name)
+			continue
+		}
+		if smgr.plan != nil {
+			smgr.plan.Add(snapshot.Action{
+				Action:   snapshot.ActionDelete,
+				Resource: smgr.instance,
+				Snapshot: *snap.Name,
+				Reason:   del[i],
+			})
 			continue
 		}
-		smgr.logger.Infof("Deleting snapshot %s", *snapshot.Name)
+		smgr.logger.Infof("Deleting snapshot %s", *snap.Name)
 		_, err := smgr.client.DeleteInstanceSnapshotWithContext(
 			ctx,
 			&lightsail.DeleteInstanceSnapshotInput{
-				InstanceSnapshotName: snapshot.Name,
+				InstanceSnapshotName: snap.Name,
 			})
 		if err != nil {
 			smgr.logger.Error(err)
+		} else {
+			smgr.forget(ctx, smgr.logger, smgr.instance, *snap.Name)
 		}
 		deleteInstanceSnapshotRequest.Inc()
 	}
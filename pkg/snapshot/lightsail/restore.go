@@ -0,0 +1,192 @@
+package lightsail
+
+import (
+	"context"
+	"fmt"
+	"time"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/service/lightsail"
+	log "github.com/sirupsen/logrus"
+)
+
+const (
+	instanceStateRunning = "running"
+
+	defaultRestoreTimeout = 15 * time.Minute
+	restorePollInterval   = 10 * time.Second
+)
+
+// RestoreManager manages a restore operation of a lightsail instance from an
+// instance snapshot
+type RestoreManager struct {
+	client *lightsail.Lightsail
+
+	instanceName string // name of the instance to create
+	az           string
+	bundleID     string
+
+	snapshotName string // explicit snapshot to restore from
+	fromInstance string // instance to restore the latest snapshot from
+	suffix       string
+	keyPairName  *string
+	timeout      time.Duration
+
+	logger log.FieldLogger
+}
+
+// RestoreOption is an option passed to the RestoreManager
+type RestoreOption func(*RestoreManager)
+
+// RestoreFromSnapshot sets the name of the instance snapshot to restore from
+func RestoreFromSnapshot(name string) RestoreOption {
+	return func(mgr *RestoreManager) {
+		mgr.snapshotName = name
+	}
+}
+
+// RestoreFromInstance restores from the latest automated snapshot of the given
+// instance
+func RestoreFromInstance(instance string) RestoreOption {
+	return func(mgr *RestoreManager) {
+		mgr.fromInstance = instance
+	}
+}
+
+// RestoreWithSnapshotSuffix sets the suffix of the automated snapshots taken
+// into account when restoring from an instance
+func RestoreWithSnapshotSuffix(suf string) RestoreOption {
+	return func(mgr *RestoreManager) {
+		mgr.suffix = suf
+	}
+}
+
+// RestoreWithKeyPairName sets the name of the key pair to use for the new
+// instance
+func RestoreWithKeyPairName(name string) RestoreOption {
+	return func(mgr *RestoreManager) {
+		mgr.keyPairName = new(string)
+		*mgr.keyPairName = name
+	}
+}
+
+// RestoreWithTimeout sets how long to wait for the new instance to be running
+func RestoreWithTimeout(d time.Duration) RestoreOption {
+	return func(mgr *RestoreManager) {
+		mgr.timeout = d
+	}
+}
+
+// NewRestoreManager creates a new RestoreManager with the given settings
+func NewRestoreManager(client *lightsail.Lightsail, instanceName, az, bundleID string, opts ...RestoreOption) *RestoreManager {
+	mgr := &RestoreManager{
+		client:       client,
+		instanceName: instanceName,
+		az:           az,
+		bundleID:     bundleID,
+
+		suffix:  defaultSnapshotSuffix,
+		timeout: defaultRestoreTimeout,
+
+		logger: log.New().WithFields(
+			log.Fields{
+				"component": "restore-manager",
+				"instance":  instanceName,
+			}),
+	}
+
+	for _, opt := range opts {
+		opt(mgr)
+	}
+
+	return mgr
+}
+
+// latestSnapshot returns the name of the newest available automated snapshot
+// of the instance to restore from
+func (mgr *RestoreManager) latestSnapshot(ctx context.Context) (string, error) {
+	snapshots, err := fetchInstanceSnapshots(ctx, mgr.client, mgr.fromInstance, mgr.suffix)
+	if err != nil {
+		return "", err
+	}
+
+	var latest *lightsail.InstanceSnapshot
+	for _, snapshot := range snapshots {
+		if snapshot.CreatedAt == nil || snapshot.State == nil ||
+			*snapshot.State != lightsail.InstanceSnapshotStateAvailable {
+			continue
+		}
+		if latest == nil || snapshot.CreatedAt.After(*latest.CreatedAt) {
+			latest = snapshot
+		}
+	}
+	if latest == nil {
+		return "", fmt.Errorf("no available snapshot found for instance %s", mgr.fromInstance)
+	}
+	return *latest.Name, nil
+}
+
+// Run will perform the actual request and restore the instance. It blocks
+// until the new instance is running
+func (mgr *RestoreManager) Run(ctx context.Context) (*lightsail.Instance, error) {
+	snapshotName := mgr.snapshotName
+	if snapshotName == "" {
+		if mgr.fromInstance == "" {
+			return nil, fmt.Errorf("need either snapshot name or instance to restore from")
+		}
+		var err error
+		snapshotName, err = mgr.latestSnapshot(ctx)
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	input := &lightsail.CreateInstancesFromSnapshotInput{
+		AvailabilityZone:     aws.String(mgr.az),
+		BundleId:             aws.String(mgr.bundleID),
+		InstanceNames:        []*string{aws.String(mgr.instanceName)},
+		InstanceSnapshotName: aws.String(snapshotName),
+	}
+	if mgr.keyPairName != nil && *mgr.keyPairName != "" {
+		input.KeyPairName = aws.String(*mgr.keyPairName)
+	}
+
+	mgr.logger.Infof("Creating instance from snapshot %s", snapshotName)
+	if _, err := mgr.client.CreateInstancesFromSnapshotWithContext(ctx, input); err != nil {
+		return nil, err
+	}
+
+	return mgr.waitUntilRunning(ctx)
+}
+
+// waitUntilRunning polls the instance until it is running. Lightsail doesn't
+// provide waiters, hence we need to do this ourselves
+func (mgr *RestoreManager) waitUntilRunning(ctx context.Context) (*lightsail.Instance, error) {
+	ctx, cancel := context.WithTimeout(ctx, mgr.timeout)
+	defer cancel()
+
+	ticker := time.NewTicker(restorePollInterval)
+	defer ticker.Stop()
+
+	for {
+		out, err := mgr.client.GetInstanceWithContext(ctx, &lightsail.GetInstanceInput{
+			InstanceName: aws.String(mgr.instanceName),
+		})
+		if err != nil {
+			return nil, err
+		}
+		if out.Instance != nil && out.Instance.State != nil && out.Instance.State.Name != nil {
+			state := *out.Instance.State.Name
+			if state == instanceStateRunning {
+				return out.Instance, nil
+			}
+			mgr.logger.Debugf("Instance is %s, waiting", state)
+		}
+
+		select {
+		case <-ctx.Done():
+			return nil, fmt.Errorf("waiting for instance %s to be running: %+v", mgr.instanceName, ctx.Err())
+		case <-ticker.C:
+		}
+	}
+}
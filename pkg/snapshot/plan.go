@@ -0,0 +1,40 @@
+package snapshot
+
+import (
+	"sync"
+)
+
+// The kinds of planned actions
+const (
+	ActionSnapshot = "snapshot"
+	ActionDelete   = "delete"
+)
+
+// Action is a snapshot or deletion a snapshot manager would perform
+type Action struct {
+	Action   string `json:"action"`
+	Resource string `json:"resource"`
+	Snapshot string `json:"snapshot,omitempty"`
+	Reason   string `json:"reason,omitempty"`
+}
+
+// Plan collects the actions of a dry run instead of performing them. It is
+// safe for concurrent use
+type Plan struct {
+	mu      sync.Mutex
+	actions []Action
+}
+
+// Add adds the given action to the plan
+func (p *Plan) Add(a Action) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	p.actions = append(p.actions, a)
+}
+
+// Actions returns the actions planned so far
+func (p *Plan) Actions() []Action {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	return append([]Action(nil), p.actions...)
+}
@@ -0,0 +1,289 @@
+package rds
+
+import (
+	"context"
+	"fmt"
+	"strings"
+	"time"
+
+	"github.com/aws/aws-sdk-go/aws"
+	awsrds "github.com/aws/aws-sdk-go/service/rds"
+	"github.com/prometheus/client_golang/prometheus"
+	log "github.com/sirupsen/logrus"
+
+	"github.com/grid-x/aws-auto-snapshot/pkg/datastore"
+	"github.com/grid-x/aws-auto-snapshot/pkg/snapshot"
+)
+
+var (
+	describeDBClustersRequests = prometheus.NewCounter(prometheus.CounterOpts{
+		Name: "rds_describe_db_clusters_requests_total",
+		Help: "Total number of describe DB clusters requests",
+	})
+	describeDBClusterSnapshotsRequests = prometheus.NewCounter(prometheus.CounterOpts{
+		Name: "rds_describe_db_cluster_snapshots_requests_total",
+		Help: "Total number of describe DB cluster snapshots requests",
+	})
+	createDBClusterSnapshotRequests = prometheus.NewCounter(prometheus.CounterOpts{
+		Name: "rds_create_db_cluster_snapshot_requests_total",
+		Help: "Total number of create DB cluster snapshot requests",
+	})
+	deleteDBClusterSnapshotRequests = prometheus.NewCounter(prometheus.CounterOpts{
+		Name: "rds_delete_db_cluster_snapshot_requests_total",
+		Help: "Total number of delete DB cluster snapshot requests",
+	})
+)
+
+func init() {
+	prometheus.MustRegister(describeDBClustersRequests)
+	prometheus.MustRegister(describeDBClusterSnapshotsRequests)
+	prometheus.MustRegister(createDBClusterSnapshotRequests)
+	prometheus.MustRegister(deleteDBClusterSnapshotRequests)
+}
+
+// ClusterSnapshotManager manages the snapshot creation and pruning of RDS DB
+// cluster snapshots, e.g. of Aurora clusters
+type ClusterSnapshotManager struct {
+	client *awsrds.RDS
+
+	options
+
+	logger log.FieldLogger
+
+	datastore datastore.Datastore
+}
+
+// NewClusterSnapshotManager creates a new ClusterSnapshotManager given an RDS
+// client and a set of Opts
+func NewClusterSnapshotManager(client *awsrds.RDS, datastore datastore.Datastore, opts ...Opt) *ClusterSnapshotManager {
+	smgr := &ClusterSnapshotManager{
+		client:    client,
+		options:   defaultOptions(),
+		datastore: datastore,
+	}
+
+	for _, o := range opts {
+		o(&smgr.options)
+	}
+	smgr.logger = smgr.baseLogger.WithFields(
+		log.Fields{
+			"component": "rds-cluster-snapshot-manager",
+		},
+	)
+
+	return smgr
+}
+
+type taggedCluster struct {
+	cluster *awsrds.DBCluster
+	tags    map[string]string
+}
+
+// fetchClusters returns all DB clusters that have the backup tag set
+func (smgr *ClusterSnapshotManager) fetchClusters(ctx context.Context) ([]*taggedCluster, error) {
+	var result []*taggedCluster
+	var marker *string
+	for {
+		in := &awsrds.DescribeDBClustersInput{}
+		if marker != nil {
+			in.Marker = marker
+		}
+
+		resp, err := smgr.client.DescribeDBClustersWithContext(ctx, in)
+		describeDBClustersRequests.Inc()
+		if err != nil {
+			return nil, err
+		}
+		for _, cluster := range resp.DBClusters {
+			if cluster.DBClusterIdentifier == nil || cluster.DBClusterArn == nil {
+				//skip
+				continue
+			}
+			tags, err := listTags(ctx, smgr.client, cluster.DBClusterArn)
+			if err != nil {
+				return nil, err
+			}
+			if !snapshot.HasTag(tags, smgr.backupTag) {
+				continue
+			}
+			result = append(result, &taggedCluster{
+				cluster: cluster,
+				tags:    tags,
+			})
+		}
+
+		if resp.Marker == nil {
+			break
+		}
+		marker = resp.Marker
+	}
+
+	return result, nil
+}
+
+func (smgr *ClusterSnapshotManager) fetchSnapshots(ctx context.Context) ([]*awsrds.DBClusterSnapshot, error) {
+	var result []*awsrds.DBClusterSnapshot
+	var marker *string
+	for {
+		in := &awsrds.DescribeDBClusterSnapshotsInput{
+			SnapshotType: aws.String("manual"),
+		}
+		if marker != nil {
+			in.Marker = marker
+		}
+
+		resp, err := smgr.client.DescribeDBClusterSnapshotsWithContext(ctx, in)
+		describeDBClusterSnapshotsRequests.Inc()
+		if err != nil {
+			return nil, err
+		}
+		for _, snap := range resp.DBClusterSnapshots {
+			if snap.DBClusterSnapshotIdentifier == nil || snap.DBClusterSnapshotArn == nil {
+				//skip
+				continue
+			}
+			// Filter out snapshots not created by this tool
+			if !strings.HasSuffix(*snap.DBClusterSnapshotIdentifier, smgr.suffix) {
+				continue
+			}
+			result = append(result, snap)
+		}
+
+		if resp.Marker == nil {
+			break
+		}
+		marker = resp.Marker
+	}
+
+	return result, nil
+}
+
+// Snapshot creates DB cluster snapshots for all matching RDS DB clusters, i.e.
+// all DB clusters having a Backup tag and optionally a retention tag set
+func (smgr *ClusterSnapshotManager) Snapshot(ctx context.Context) error {
+
+	clusters, err := smgr.fetchClusters(ctx)
+	if err != nil {
+		return err
+	}
+
+	for _, tc := range clusters {
+		clusterID := *tc.cluster.DBClusterIdentifier
+		snapshotName := fmt.Sprintf("%s-%d-%s",
+			clusterID,
+			time.Now().UnixNano(),
+			smgr.suffix,
+		)
+
+		logger := smgr.logger.WithFields(
+			log.Fields{
+				"db-cluster":    clusterID,
+				"snapshot-name": snapshotName,
+			},
+		)
+
+		// See SnapshotManager.Snapshot on why we keep track of the
+		// creation time ourselves
+		created := time.Now().Truncate(time.Minute)
+
+		logger.Infof("Creating DB cluster snapshot with name %s", snapshotName)
+		if err := smgr.createSnapshot(ctx, tc.cluster, snapshotName,
+			smgr.snapshotTags(logger, created, tc.tags)); err != nil {
+			logger.Error(err)
+			continue
+		}
+
+		if err := smgr.datastore.StoreSnapshotInfo(ctx, &datastore.SnapshotInfo{
+			Resource:  datastore.SnapshotResource(clusterID),
+			ID:        datastore.SnapshotID(snapshotName),
+			CreatedAt: created,
+		}); err != nil {
+			logger.Error(err)
+			continue
+		}
+	}
+	return nil
+}
+
+func (smgr *ClusterSnapshotManager) createSnapshot(ctx context.Context, cluster *awsrds.DBCluster, name string, tags []*awsrds.Tag) error {
+	// For each cluster it should at most take 5 minutes
+	ctx, cancel := context.WithTimeout(ctx, 5*time.Minute)
+	defer cancel()
+
+	_, err := smgr.client.CreateDBClusterSnapshotWithContext(
+		ctx,
+		&awsrds.CreateDBClusterSnapshotInput{
+			DBClusterIdentifier:         cluster.DBClusterIdentifier,
+			DBClusterSnapshotIdentifier: aws.String(name),
+			Tags:                        tags,
+		},
+	)
+	createDBClusterSnapshotRequests.Inc()
+	return err
+}
+
+// Prune deletes all matching DB cluster snapshots, i.e. snapshots created by
+// this tool with a delete after tag that is set to a date in the past
+func (smgr *ClusterSnapshotManager) Prune(ctx context.Context) error {
+
+	snaps, err := smgr.fetchSnapshots(ctx)
+	if err != nil {
+		return err
+	}
+	for _, snap := range snaps {
+		logger := smgr.logger.WithFields(log.Fields{
+			"snapshot-name": *snap.DBClusterSnapshotIdentifier,
+		})
+		logger.Info("Processing DB cluster snapshot")
+
+		if snap.Status != nil && *snap.Status != "available" {
+			// Snapshots can only be deleted once they are available
+			logger.Infof("DB cluster snapshot is %s, skipping", *snap.Status)
+			continue
+		}
+
+		tags, err := listTags(ctx, smgr.client, snap.DBClusterSnapshotArn)
+		if err != nil {
+			logger.Error(err)
+			continue
+		}
+		expired, err := smgr.expired(tags)
+		if err != nil {
+			logger.Error(err)
+			continue
+		}
+		if !expired {
+			logger.Info("DB cluster snapshot not yet scheduled for deletion")
+			continue
+		}
+
+		if _, err := smgr.client.DeleteDBClusterSnapshotWithContext(ctx, &awsrds.DeleteDBClusterSnapshotInput{
+			DBClusterSnapshotIdentifier: snap.DBClusterSnapshotIdentifier,
+		}); err != nil {
+			logger.Errorf("Couldn't delete DB cluster snapshot: %+v", err)
+			continue
+		}
+		deleteDBClusterSnapshotRequests.Inc()
+		logger.Info("Successfully deleted DB cluster snapshot")
+
+		resource := aws.StringValue(snap.DBClusterIdentifier)
+		if resource == "" {
+			logger.Warn("DB cluster snapshot has no DB cluster identifier, keeping snapshot info")
+			continue
+		}
+		created, err := smgr.createdAt(tags)
+		if err != nil {
+			logger.Warnf("Couldn't parse created at tag, keeping snapshot info: %+v", err)
+			continue
+		}
+		if err := smgr.datastore.DeleteSnapshotInfo(ctx, &datastore.SnapshotInfo{
+			Resource:  datastore.SnapshotResource(resource),
+			ID:        datastore.SnapshotID(*snap.DBClusterSnapshotIdentifier),
+			CreatedAt: created,
+		}); err != nil {
+			logger.Error(err)
+		}
+	}
+
+	return nil
+}
@@ -0,0 +1,32 @@
+package rds
+
+import "time"
+
+// SnapshotTags returns the tags set on a new snapshot by a manager with the
+// given Opts, exported for the tests
+func SnapshotTags(created time.Time, resourceTags map[string]string, opts ...Opt) map[string]string {
+	o := newTestOptions(opts)
+	return tagMap(o.snapshotTags(o.baseLogger, created, resourceTags))
+}
+
+// Expired checks whether a manager with the given Opts considers a snapshot
+// with the given tags expired, exported for the tests
+func Expired(tags map[string]string, opts ...Opt) (bool, error) {
+	o := newTestOptions(opts)
+	return o.expired(tags)
+}
+
+// CreatedAt returns the creation time a manager with the given Opts reads
+// from the given snapshot tags, exported for the tests
+func CreatedAt(tags map[string]string, opts ...Opt) (time.Time, error) {
+	o := newTestOptions(opts)
+	return o.createdAt(tags)
+}
+
+func newTestOptions(opts []Opt) *options {
+	o := defaultOptions()
+	for _, opt := range opts {
+		opt(&o)
+	}
+	return &o
+}
@@ -0,0 +1,438 @@
+package rds
+
+import (
+	"context"
+	"fmt"
+	"strings"
+	"time"
+
+	"github.com/aws/aws-sdk-go/aws"
+	awsrds "github.com/aws/aws-sdk-go/service/rds"
+	"github.com/prometheus/client_golang/prometheus"
+	log "github.com/sirupsen/logrus"
+
+	"github.com/grid-x/aws-auto-snapshot/pkg/datastore"
+	"github.com/grid-x/aws-auto-snapshot/pkg/snapshot"
+)
+
+const (
+	defaultBackupTag    = "backup"
+	defaultRetentionTag = "retention"
+
+	defaultSnapshotSuffix = "auto-snapshot"
+	defaultDeleteAfterTag = "_DELETE_AFTER"
+	defaultCreatedAtTag   = "_CREATED_AT"
+)
+
+var (
+	describeDBInstancesRequests = prometheus.NewCounter(prometheus.CounterOpts{
+		Name: "rds_describe_db_instances_requests_total",
+		Help: "Total number of describe DB instances requests",
+	})
+	describeDBSnapshotsRequests = prometheus.NewCounter(prometheus.CounterOpts{
+		Name: "rds_describe_db_snapshots_requests_total",
+		Help: "Total number of describe DB snapshots requests",
+	})
+	listTagsForResourceRequests = prometheus.NewCounter(prometheus.CounterOpts{
+		Name: "rds_list_tags_for_resource_requests_total",
+		Help: "Total number of list tags for resource requests",
+	})
+	createDBSnapshotRequests = prometheus.NewCounter(prometheus.CounterOpts{
+		Name: "rds_create_db_snapshot_requests_total",
+		Help: "Total number of create DB snapshot requests",
+	})
+	deleteDBSnapshotRequests = prometheus.NewCounter(prometheus.CounterOpts{
+		Name: "rds_delete_db_snapshot_requests_total",
+		Help: "Total number of delete DB snapshot requests",
+	})
+)
+
+func init() {
+	prometheus.MustRegister(describeDBInstancesRequests)
+	prometheus.MustRegister(describeDBSnapshotsRequests)
+	prometheus.MustRegister(listTagsForResourceRequests)
+	prometheus.MustRegister(createDBSnapshotRequests)
+	prometheus.MustRegister(deleteDBSnapshotRequests)
+}
+
+// options are the settings shared by the SnapshotManager and the
+// ClusterSnapshotManager
+type options struct {
+	suffix         string // snapshot suffix
+	backupTag      string
+	retentionTag   string
+	deleteAfterTag string
+	createdAtTag   string
+
+	baseLogger log.FieldLogger
+}
+
+func defaultOptions() options {
+	return options{
+		suffix:         defaultSnapshotSuffix,
+		retentionTag:   defaultRetentionTag,
+		backupTag:      defaultBackupTag,
+		deleteAfterTag: defaultDeleteAfterTag,
+		createdAtTag:   defaultCreatedAtTag,
+		baseLogger:     log.New(),
+	}
+}
+
+// Opt is the type for Options of the SnapshotManager and the
+// ClusterSnapshotManager
+type Opt func(*options)
+
+// WithRetentionTag sets the retention tag key
+func WithRetentionTag(t string) Opt {
+	return func(o *options) {
+		o.retentionTag = t
+	}
+}
+
+// WithBackupTag sets the backup tag key
+func WithBackupTag(t string) Opt {
+	return func(o *options) {
+		o.backupTag = t
+	}
+}
+
+// WithSnapshotSuffix sets the automated snapshot suffix
+func WithSnapshotSuffix(suf string) Opt {
+	return func(o *options) {
+		o.suffix = suf
+	}
+}
+
+// WithDeleteAfterTag sets the tag key to be used for indication the deletion
+// date
+func WithDeleteAfterTag(tag string) Opt {
+	return func(o *options) {
+		o.deleteAfterTag = tag
+	}
+}
+
+// snapshotTags returns the tags to set on a new snapshot created at the given
+// time of a resource with the given tags
+func (o *options) snapshotTags(logger log.FieldLogger, created time.Time, resourceTags map[string]string) []*awsrds.Tag {
+	days, err := snapshot.RetentionDays(resourceTags, o.retentionTag)
+	if err != nil {
+		logger.Warnf("Couldn't parse retention days: %+v. Falling back to default value", err)
+	}
+	deleteAfter := created.Add(time.Duration(days) * 24 * time.Hour)
+
+	return []*awsrds.Tag{
+		{
+			Key:   aws.String(o.deleteAfterTag),
+			Value: aws.String(deleteAfter.Format(time.RFC3339)),
+		},
+		{
+			Key:   aws.String(o.createdAtTag),
+			Value: aws.String(created.Format(time.RFC3339)),
+		},
+	}
+}
+
+// expired checks whether the delete after tag in the given snapshot tags is
+// set to a date in the past
+func (o *options) expired(tags map[string]string) (bool, error) {
+	value, ok := tags[o.deleteAfterTag]
+	if !ok {
+		return false, fmt.Errorf("snapshot has no %s tag", o.deleteAfterTag)
+	}
+	deleteAfter, err := time.Parse(time.RFC3339, value)
+	if err != nil {
+		return false, fmt.Errorf("couldn't parse %s tag: %+v", o.deleteAfterTag, err)
+	}
+	return !time.Now().Before(deleteAfter), nil
+}
+
+// createdAt returns the creation time recorded in the given snapshot tags
+func (o *options) createdAt(tags map[string]string) (time.Time, error) {
+	return time.Parse(time.RFC3339, tags[o.createdAtTag])
+}
+
+// WithLogger sets the logger to use, e.g. to add context to all log entries
+func WithLogger(logger log.FieldLogger) Opt {
+	return func(o *options) {
+		o.baseLogger = logger
+	}
+}
+
+// SnapshotManager manages the snapshot creation and pruning of RDS DB instance
+// snapshots
+type SnapshotManager struct {
+	client *awsrds.RDS
+
+	options
+
+	logger log.FieldLogger
+
+	datastore datastore.Datastore
+}
+
+// NewSnapshotManager creates a new SnapshotManager given an RDS client and a
+// set of Opts
+func NewSnapshotManager(client *awsrds.RDS, datastore datastore.Datastore, opts ...Opt) *SnapshotManager {
+	smgr := &SnapshotManager{
+		client:    client,
+		options:   defaultOptions(),
+		datastore: datastore,
+	}
+
+	for _, o := range opts {
+		o(&smgr.options)
+	}
+	smgr.logger = smgr.baseLogger.WithFields(
+		log.Fields{
+			"component": "rds-snapshot-manager",
+		},
+	)
+
+	return smgr
+}
+
+func tagMap(tags []*awsrds.Tag) map[string]string {
+	m := make(map[string]string, len(tags))
+	for _, t := range tags {
+		if t.Key == nil || t.Value == nil {
+			continue
+		}
+		m[*t.Key] = *t.Value
+	}
+	return m
+}
+
+// listTags returns the tags of the RDS resource with the given ARN
+func listTags(ctx context.Context, client *awsrds.RDS, arn *string) (map[string]string, error) {
+	resp, err := client.ListTagsForResourceWithContext(ctx, &awsrds.ListTagsForResourceInput{
+		ResourceName: arn,
+	})
+	listTagsForResourceRequests.Inc()
+	if err != nil {
+		return nil, err
+	}
+	return tagMap(resp.TagList), nil
+}
+
+type taggedInstance struct {
+	instance *awsrds.DBInstance
+	tags     map[string]string
+}
+
+// fetchInstances returns all DB instances that have the backup tag set.
+// Instances that are part of a DB cluster are skipped as they can only be
+// snapshotted on cluster level
+func (smgr *SnapshotManager) fetchInstances(ctx context.Context) ([]*taggedInstance, error) {
+	var result []*taggedInstance
+	var marker *string
+	for {
+		in := &awsrds.DescribeDBInstancesInput{}
+		if marker != nil {
+			in.Marker = marker
+		}
+
+		resp, err := smgr.client.DescribeDBInstancesWithContext(ctx, in)
+		describeDBInstancesRequests.Inc()
+		if err != nil {
+			return nil, err
+		}
+		for _, instance := range resp.DBInstances {
+			if instance.DBInstanceIdentifier == nil || instance.DBInstanceArn == nil {
+				//skip
+				continue
+			}
+			if instance.DBClusterIdentifier != nil {
+				continue
+			}
+			// DescribeDBInstances doesn't support filtering by tags,
+			// hence we have to look them up for every instance
+			tags, err := listTags(ctx, smgr.client, instance.DBInstanceArn)
+			if err != nil {
+				return nil, err
+			}
+			if !snapshot.HasTag(tags, smgr.backupTag) {
+				continue
+			}
+			result = append(result, &taggedInstance{
+				instance: instance,
+				tags:     tags,
+			})
+		}
+
+		if resp.Marker == nil {
+			break
+		}
+		marker = resp.Marker
+	}
+
+	return result, nil
+}
+
+func (smgr *SnapshotManager) fetchSnapshots(ctx context.Context) ([]*awsrds.DBSnapshot, error) {
+	var result []*awsrds.DBSnapshot
+	var marker *string
+	for {
+		in := &awsrds.DescribeDBSnapshotsInput{
+			SnapshotType: aws.String("manual"),
+		}
+		if marker != nil {
+			in.Marker = marker
+		}
+
+		resp, err := smgr.client.DescribeDBSnapshotsWithContext(ctx, in)
+		describeDBSnapshotsRequests.Inc()
+		if err != nil {
+			return nil, err
+		}
+		for _, snap := range resp.DBSnapshots {
+			if snap.DBSnapshotIdentifier == nil || snap.DBSnapshotArn == nil {
+				//skip
+				continue
+			}
+			// Filter out snapshots not created by this tool
+			if !strings.HasSuffix(*snap.DBSnapshotIdentifier, smgr.suffix) {
+				continue
+			}
+			result = append(result, snap)
+		}
+
+		if resp.Marker == nil {
+			break
+		}
+		marker = resp.Marker
+	}
+
+	return result, nil
+}
+
+// Snapshot creates DB snapshots for all matching RDS DB instances, i.e. all
+// DB instances having a Backup tag and optionally a retention tag set
+func (smgr *SnapshotManager) Snapshot(ctx context.Context) error {
+
+	instances, err := smgr.fetchInstances(ctx)
+	if err != nil {
+		return err
+	}
+
+	for _, ti := range instances {
+		instanceID := *ti.instance.DBInstanceIdentifier
+		snapshotName := fmt.Sprintf("%s-%d-%s",
+			instanceID,
+			time.Now().UnixNano(),
+			smgr.suffix,
+		)
+
+		logger := smgr.logger.WithFields(
+			log.Fields{
+				"db-instance":   instanceID,
+				"snapshot-name": snapshotName,
+			},
+		)
+
+		// The createdAt timestamp is used as a key for ordering in the
+		// datastore and the snapshot create time is only known once
+		// the snapshot is available. Hence we keep track of it in a
+		// tag and truncate it to one minute to keep it stable
+		created := time.Now().Truncate(time.Minute)
+
+		logger.Infof("Creating DB snapshot with name %s", snapshotName)
+		if err := smgr.createSnapshot(ctx, ti.instance, snapshotName,
+			smgr.snapshotTags(logger, created, ti.tags)); err != nil {
+			logger.Error(err)
+			continue
+		}
+
+		if err := smgr.datastore.StoreSnapshotInfo(ctx, &datastore.SnapshotInfo{
+			Resource:  datastore.SnapshotResource(instanceID),
+			ID:        datastore.SnapshotID(snapshotName),
+			CreatedAt: created,
+		}); err != nil {
+			logger.Error(err)
+			continue
+		}
+	}
+	return nil
+}
+
+func (smgr *SnapshotManager) createSnapshot(ctx context.Context, instance *awsrds.DBInstance, name string, tags []*awsrds.Tag) error {
+	// For each instance it should at most take 5 minutes
+	ctx, cancel := context.WithTimeout(ctx, 5*time.Minute)
+	defer cancel()
+
+	_, err := smgr.client.CreateDBSnapshotWithContext(
+		ctx,
+		&awsrds.CreateDBSnapshotInput{
+			DBInstanceIdentifier: instance.DBInstanceIdentifier,
+			DBSnapshotIdentifier: aws.String(name),
+			Tags:                 tags,
+		},
+	)
+	createDBSnapshotRequests.Inc()
+	return err
+}
+
+// Prune deletes all matching DB snapshots, i.e. snapshots created by this tool
+// with a delete after tag that is set to a date in the past
+func (smgr *SnapshotManager) Prune(ctx context.Context) error {
+
+	snaps, err := smgr.fetchSnapshots(ctx)
+	if err != nil {
+		return err
+	}
+	for _, snap := range snaps {
+		logger := smgr.logger.WithFields(log.Fields{
+			"snapshot-name": *snap.DBSnapshotIdentifier,
+		})
+		logger.Info("Processing DB snapshot")
+
+		if snap.Status != nil && *snap.Status != "available" {
+			// Snapshots can only be deleted once they are available
+			logger.Infof("DB snapshot is %s, skipping", *snap.Status)
+			continue
+		}
+
+		tags, err := listTags(ctx, smgr.client, snap.DBSnapshotArn)
+		if err != nil {
+			logger.Error(err)
+			continue
+		}
+		expired, err := smgr.expired(tags)
+		if err != nil {
+			logger.Error(err)
+			continue
+		}
+		if !expired {
+			logger.Info("DB snapshot not yet scheduled for deletion")
+			continue
+		}
+
+		if _, err := smgr.client.DeleteDBSnapshotWithContext(ctx, &awsrds.DeleteDBSnapshotInput{
+			DBSnapshotIdentifier: snap.DBSnapshotIdentifier,
+		}); err != nil {
+			logger.Errorf("Couldn't delete DB snapshot: %+v", err)
+			continue
+		}
+		deleteDBSnapshotRequests.Inc()
+		logger.Info("Successfully deleted DB snapshot")
+
+		resource := aws.StringValue(snap.DBInstanceIdentifier)
+		if resource == "" {
+			logger.Warn("DB snapshot has no DB instance identifier, keeping snapshot info")
+			continue
+		}
+		created, err := smgr.createdAt(tags)
+		if err != nil {
+			logger.Warnf("Couldn't parse created at tag, keeping snapshot info: %+v", err)
+			continue
+		}
+		if err := smgr.datastore.DeleteSnapshotInfo(ctx, &datastore.SnapshotInfo{
+			Resource:  datastore.SnapshotResource(resource),
+			ID:        datastore.SnapshotID(*snap.DBSnapshotIdentifier),
+			CreatedAt: created,
+		}); err != nil {
+			logger.Error(err)
+		}
+	}
+
+	return nil
+}
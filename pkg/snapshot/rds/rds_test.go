@@ -0,0 +1,162 @@
+package rds_test
+
+import (
+	"testing"
+	"time"
+
+	"github.com/google/go-cmp/cmp"
+
+	"github.com/grid-x/aws-auto-snapshot/pkg/snapshot/rds"
+)
+
+func Test_SnapshotTags(t *testing.T) {
+	created := time.Date(2018, 3, 1, 12, 0, 0, 0, time.UTC)
+	testcases := []struct {
+		name         string
+		resourceTags map[string]string
+		opts         []rds.Opt
+		want         map[string]string
+	}{
+		{
+			name:         "retention tag",
+			resourceTags: map[string]string{"backup": "", "retention": "3"},
+			want: map[string]string{
+				"_DELETE_AFTER": "2018-03-04T12:00:00Z",
+				"_CREATED_AT":   "2018-03-01T12:00:00Z",
+			},
+		},
+		{
+			name:         "retention tag is case insensitive",
+			resourceTags: map[string]string{"Retention": "30"},
+			want: map[string]string{
+				"_DELETE_AFTER": "2018-03-31T12:00:00Z",
+				"_CREATED_AT":   "2018-03-01T12:00:00Z",
+			},
+		},
+		{
+			name:         "exact retention tag takes precedence",
+			resourceTags: map[string]string{"RETENTION": "1", "Retention": "30", "retention": "3"},
+			want: map[string]string{
+				"_DELETE_AFTER": "2018-03-04T12:00:00Z",
+				"_CREATED_AT":   "2018-03-01T12:00:00Z",
+			},
+		},
+		{
+			name:         "case insensitive matches in sorted order",
+			resourceTags: map[string]string{"Retention": "30", "RETENTION": "1"},
+			want: map[string]string{
+				"_DELETE_AFTER": "2018-03-02T12:00:00Z",
+				"_CREATED_AT":   "2018-03-01T12:00:00Z",
+			},
+		},
+		{
+			name:         "default retention",
+			resourceTags: map[string]string{"backup": ""},
+			want: map[string]string{
+				"_DELETE_AFTER": "2018-03-08T12:00:00Z",
+				"_CREATED_AT":   "2018-03-01T12:00:00Z",
+			},
+		},
+		{
+			name:         "invalid retention falls back to default",
+			resourceTags: map[string]string{"retention": "a week"},
+			want: map[string]string{
+				"_DELETE_AFTER": "2018-03-08T12:00:00Z",
+				"_CREATED_AT":   "2018-03-01T12:00:00Z",
+			},
+		},
+		{
+			name:         "custom tags",
+			resourceTags: map[string]string{"retention": "3", "keep-days": "1"},
+			opts: []rds.Opt{
+				rds.WithRetentionTag("keep-days"),
+				rds.WithDeleteAfterTag("delete-after"),
+			},
+			want: map[string]string{
+				"delete-after": "2018-03-02T12:00:00Z",
+				"_CREATED_AT":  "2018-03-01T12:00:00Z",
+			},
+		},
+	}
+
+	for _, tc := range testcases {
+		got := rds.SnapshotTags(created, tc.resourceTags, tc.opts...)
+		if diff := cmp.Diff(tc.want, got); diff != "" {
+			t.Errorf("%s: unexpected tags (-want +got):\n%s", tc.name, diff)
+		}
+	}
+}
+
+func Test_Expired(t *testing.T) {
+	now := time.Now()
+	testcases := []struct {
+		name    string
+		tags    map[string]string
+		opts    []rds.Opt
+		want    bool
+		wantErr bool
+	}{
+		{
+			name: "past",
+			tags: map[string]string{"_DELETE_AFTER": now.Add(-time.Hour).Format(time.RFC3339)},
+			want: true,
+		},
+		{
+			name: "future",
+			tags: map[string]string{"_DELETE_AFTER": now.Add(time.Hour).Format(time.RFC3339)},
+			want: false,
+		},
+		{
+			name: "custom tag",
+			tags: map[string]string{
+				"_DELETE_AFTER": now.Add(time.Hour).Format(time.RFC3339),
+				"delete-after":  now.Add(-time.Hour).Format(time.RFC3339),
+			},
+			opts: []rds.Opt{rds.WithDeleteAfterTag("delete-after")},
+			want: true,
+		},
+		{
+			name:    "missing tag",
+			tags:    map[string]string{"_CREATED_AT": now.Format(time.RFC3339)},
+			wantErr: true,
+		},
+		{
+			name:    "invalid tag",
+			tags:    map[string]string{"_DELETE_AFTER": "tomorrow"},
+			wantErr: true,
+		},
+	}
+
+	for _, tc := range testcases {
+		got, err := rds.Expired(tc.tags, tc.opts...)
+		if tc.wantErr {
+			if err == nil {
+				t.Errorf("%s: expected error, got none", tc.name)
+			}
+			continue
+		}
+		if err != nil {
+			t.Errorf("%s: unexpected error: %+v", tc.name, err)
+			continue
+		}
+		if got != tc.want {
+			t.Errorf("%s: expected expired %t, got %t", tc.name, tc.want, got)
+		}
+	}
+}
+
+func Test_CreatedAt(t *testing.T) {
+	created := time.Date(2018, 3, 1, 12, 0, 0, 0, time.UTC)
+
+	got, err := rds.CreatedAt(rds.SnapshotTags(created, nil))
+	if err != nil {
+		t.Fatalf("createdAt: %+v", err)
+	}
+	if !got.Equal(created) {
+		t.Errorf("expected %s, got %s", created, got)
+	}
+
+	if _, err := rds.CreatedAt(map[string]string{}); err == nil {
+		t.Errorf("expected error for missing created at tag, got none")
+	}
+}
@@ -0,0 +1,128 @@
+package snapshot
+
+import (
+	"fmt"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// RetentionPolicy is a grandfather-father-son retention policy, e.g. keep the
+// last 7 daily, 4 weekly and 12 monthly snapshots. It is evaluated at prune
+// time over all snapshots of a resource
+type RetentionPolicy struct {
+	Daily   int
+	Weekly  int
+	Monthly int
+	Yearly  int
+}
+
+// ParseRetentionPolicy parses a policy given as a comma separated list of
+// counts with the units d (daily), w (weekly), m (monthly) and y (yearly),
+// e.g. "7d,4w,12m"
+func ParseRetentionPolicy(s string) (RetentionPolicy, error) {
+	var p RetentionPolicy
+	for _, part := range strings.Split(s, ",") {
+		part = strings.TrimSpace(part)
+		if len(part) < 2 {
+			return RetentionPolicy{}, fmt.Errorf("invalid retention policy %q", s)
+		}
+		n, err := strconv.Atoi(part[:len(part)-1])
+		if err != nil || n < 0 {
+			return RetentionPolicy{}, fmt.Errorf("invalid retention policy %q: invalid count %q", s, part)
+		}
+		switch part[len(part)-1] {
+		case 'd':
+			p.Daily = n
+		case 'w':
+			p.Weekly = n
+		case 'm':
+			p.Monthly = n
+		case 'y':
+			p.Yearly = n
+		default:
+			return RetentionPolicy{}, fmt.Errorf("invalid retention policy %q: unknown unit in %q", s, part)
+		}
+	}
+	if p.IsZero() {
+		return RetentionPolicy{}, fmt.Errorf("retention policy %q keeps no snapshots", s)
+	}
+	return p, nil
+}
+
+// IsZero reports whether no policy is set
+func (p RetentionPolicy) IsZero() bool {
+	return p == RetentionPolicy{}
+}
+
+func (p RetentionPolicy) String() string {
+	var parts []string
+	for _, c := range []struct {
+		n    int
+		unit string
+	}{
+		{p.Daily, "d"}, {p.Weekly, "w"}, {p.Monthly, "m"}, {p.Yearly, "y"},
+	} {
+		if c.n > 0 {
+			parts = append(parts, strconv.Itoa(c.n)+c.unit)
+		}
+	}
+	return strings.Join(parts, ",")
+}
+
+// Keep returns which of the snapshots created at the given times are kept by
+// the policy. For each configured period, the newest snapshot of each of the
+// most recent periods containing a snapshot is kept
+func (p RetentionPolicy) Keep(createdAt []time.Time) []bool {
+	order := newestFirst(createdAt)
+
+	keep := make([]bool, len(createdAt))
+	for _, b := range []struct {
+		n   int
+		key func(time.Time) int
+	}{
+		{p.Daily, func(t time.Time) int { return t.Year()*1000 + t.YearDay() }},
+		{p.Weekly, func(t time.Time) int { y, w := t.ISOWeek(); return y*100 + w }},
+		{p.Monthly, func(t time.Time) int { return t.Year()*100 + int(t.Month()) }},
+		{p.Yearly, func(t time.Time) int { return t.Year() }},
+	} {
+		n, last := b.n, -1
+		for _, i := range order {
+			if n <= 0 {
+				break
+			}
+			if k := b.key(createdAt[i].UTC()); k != last {
+				keep[i] = true
+				last = k
+				n--
+			}
+		}
+	}
+	return keep
+}
+
+// KeepNewest returns which of the snapshots created at the given times are
+// among the newest n
+func KeepNewest(createdAt []time.Time, n int) []bool {
+	order := newestFirst(createdAt)
+
+	keep := make([]bool, len(createdAt))
+	for i := 0; i < n && i < len(order); i++ {
+		keep[order[i]] = true
+	}
+	return keep
+}
+
+// newestFirst returns the indices of the given times ordered from the newest
+// to the oldest
+func newestFirst(createdAt []time.Time) []int {
+	order := make([]int, len(createdAt))
+	for i := range order {
+		order[i] = i
+	}
+	sort.SliceStable(order, func(a, b int) bool {
+		return createdAt[order[a]].After(createdAt[order[b]])
+	})
+	return order
+}
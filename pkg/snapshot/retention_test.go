@@ -0,0 +1,114 @@
+package snapshot_test
+
+import (
+	"testing"
+	"time"
+
+	"github.com/google/go-cmp/cmp"
+
+	"github.com/grid-x/aws-auto-snapshot/pkg/snapshot"
+)
+
+func Test_ParseRetentionPolicy(t *testing.T) {
+	testcases := []struct {
+		input   string
+		want    snapshot.RetentionPolicy
+		wantErr bool
+	}{
+		{
+			input: "7d,4w,12m",
+			want:  snapshot.RetentionPolicy{Daily: 7, Weekly: 4, Monthly: 12},
+		},
+		{
+			input: " 1y, 3d",
+			want:  snapshot.RetentionPolicy{Daily: 3, Yearly: 1},
+		},
+		{input: "", wantErr: true},
+		{input: "7", wantErr: true},
+		{input: "7h", wantErr: true},
+		{input: "-1d", wantErr: true},
+		{input: "0d", wantErr: true},
+	}
+
+	for _, tc := range testcases {
+		got, err := snapshot.ParseRetentionPolicy(tc.input)
+		if tc.wantErr {
+			if err == nil {
+				t.Errorf("%q: expected error, got none", tc.input)
+			}
+			continue
+		}
+		if err != nil {
+			t.Fatalf("%q: parse: %+v", tc.input, err)
+		}
+		if got != tc.want {
+			t.Errorf("%q: expected %+v, got %+v", tc.input, tc.want, got)
+		}
+	}
+}
+
+func Test_RetentionPolicyKeep(t *testing.T) {
+	// One snapshot per day over 60 days, in random order, newest on
+	// Wednesday, 2020-03-04
+	newest := time.Date(2020, 3, 4, 2, 0, 0, 0, time.UTC)
+	var createdAt []time.Time
+	for _, i := range []int{3, 0, 59, 1, 2} {
+		createdAt = append(createdAt, newest.AddDate(0, 0, -i))
+	}
+	for i := 4; i < 59; i++ {
+		createdAt = append(createdAt, newest.AddDate(0, 0, -i))
+	}
+
+	policy := snapshot.RetentionPolicy{Daily: 3, Weekly: 2, Monthly: 3}
+	keep := policy.Keep(createdAt)
+
+	var got []string
+	for i, k := range keep {
+		if k {
+			got = append(got, createdAt[i].Format("2006-01-02"))
+		}
+	}
+	want := []string{
+		"2020-03-04", // daily, weekly and monthly
+		"2020-03-03", // daily
+		"2020-03-02", // daily
+		"2020-03-01", // weekly, i.e. newest of the previous week
+		"2020-02-29", // monthly
+		"2020-01-31", // monthly
+	}
+	if !cmp.Equal(set(want), set(got)) {
+		t.Errorf("unexpected snapshots kept: %s", cmp.Diff(set(want), set(got)))
+	}
+}
+
+func set(s []string) map[string]bool {
+	m := make(map[string]bool, len(s))
+	for _, v := range s {
+		m[v] = true
+	}
+	return m
+}
+
+func Test_KeepNewest(t *testing.T) {
+	now := time.Now()
+	createdAt := []time.Time{
+		now.Add(-2 * time.Hour),
+		now,
+		now.Add(-3 * time.Hour),
+		now.Add(-1 * time.Hour),
+	}
+
+	testcases := []struct {
+		n    int
+		want []bool
+	}{
+		{0, []bool{false, false, false, false}},
+		{2, []bool{false, true, false, true}},
+		{5, []bool{true, true, true, true}},
+	}
+	for _, tc := range testcases {
+		if got := snapshot.KeepNewest(createdAt, tc.n); !cmp.Equal(tc.want, got) {
+			t.Errorf("%d: unexpected snapshots kept: %s", tc.n, cmp.Diff(tc.want, got))
+		}
+	}
+}
@@ -0,0 +1,72 @@
+// Package snapshot contains the functionality shared by the different
+// snapshot managers
+package snapshot
+
+import (
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// DefaultRetentionDays is the number of days a snapshot is kept if no
+// retention is configured for a resource
+const DefaultRetentionDays = 7
+
+// RetentionDays returns the number of retention days set by the retention tag
+// in the given tags. The lookup of the tag key is case insensitive, but an
+// exact match takes precedence; of several other matches, the first in sorted
+// order is used. If the tag is not set, the DefaultRetentionDays are returned.
+// If the tag value cannot be parsed, the DefaultRetentionDays are returned
+// together with the parse error so the caller can decide whether to warn
+// about it
+func RetentionDays(tags map[string]string, retentionTag string) (int64, error) {
+	v, ok := tags[retentionTag]
+	if !ok {
+		keys := make([]string, 0, len(tags))
+		for k := range tags {
+			if strings.ToLower(k) == strings.ToLower(retentionTag) {
+				keys = append(keys, k)
+			}
+		}
+		if len(keys) == 0 {
+			return DefaultRetentionDays, nil
+		}
+		sort.Strings(keys)
+		v = tags[keys[0]]
+	}
+	days, err := strconv.ParseInt(v, 10, 64)
+	if err != nil {
+		return DefaultRetentionDays, err
+	}
+	if days == 0 {
+		return DefaultRetentionDays, nil
+	}
+	return days, nil
+}
+
+// HasTag checks whether the given tag key is set in tags. The lookup is case
+// insensitive
+func HasTag(tags map[string]string, key string) bool {
+	for k := range tags {
+		if strings.ToLower(k) == strings.ToLower(key) {
+			return true
+		}
+	}
+	return false
+}
+
+// Description describes a snapshot managed by this tool, e.g. for listing
+type Description struct {
+	ID        string    `json:"id"`
+	Resource  string    `json:"resource"`
+	CreatedAt time.Time `json:"createdAt"`
+	// DeleteAfter is nil if the snapshot is pruned by a retention policy
+	DeleteAfter     *time.Time `json:"deleteAfter,omitempty"`
+	RetentionPolicy string     `json:"retentionPolicy,omitempty"`
+	State           string     `json:"state"`
+	SizeGiB         int64      `json:"sizeGiB"`
+	// SourceSnapshotID is the ID of the snapshot this snapshot is a copy of,
+	// if any
+	SourceSnapshotID string `json:"sourceSnapshotID,omitempty"`
+}